@@ -1,174 +1,440 @@
 package main
 
 import (
-	"./goleg"
 	"./lib9p"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strings"
 	"time"
 )
 
 type FidData struct {
 	Qid  lib9p.Qid
+	Fs   *OlegFs // Database the fid is in, nil for the list of databases
 	Path []string
+
+	/* Open state */
+	Open     bool
+	Mode     uint8
+	Buffer   *WriteBuffer // Pending contents, only set when open for writing
+	Dirty    bool         // Buffer has changes that aren't in the database yet
+	Append   bool         // Buffer only holds what gets appended, see modes.go
+	Snapshot []byte       // Contents at open time, only set when open for reading
+	Listing  []lib9p.Stat // Directory entries, read again at offset 0
+	Pending  []byte       // Written to a synthetic file but not handled yet
+	Cursor   *Cursor      // Position in the cursor file, see cursor.go
+	Events   *EventQueue  // Changes not read yet, see events.go
+	Txn      *Txn         // Transaction of a txn fid, see txn.go
+	Export   *Export      // Archive being read, see archive.go
+	Import   *Import      // Archive being written, see archive.go
 }
 
 type Client struct {
-	Fids map[uint32]FidData
+	Uname string
+	Caps  Capability
+	Top   bool // Attached to the list of databases, ".." from a database leads back to it
+	Fids  map[uint32]*FidData
 }
 
+/* One database, served as a tree of its own, see Server for what's shared */
 type OlegFs struct {
-	vfs     *lib9p.Server
-	db      goleg.Database
-	clients map[net.Conn]Client
+	*Server
+	name     string
+	db       Store
+	meta     MetaStore
+	cache    *ReadCache
+	qidBase  uint64 // Set on every qid path, so they're unique across databases
+	synth    map[string]*SynthFile
+	expiring map[string]time.Time // Keys with an expiration, see watchExpiry
+	idle     time.Time            // Since when no fid uses the database, zero if in use
+	done     chan bool            // Closed along with the database
 }
 
-func makeFs(dbdir string, dbname string) *OlegFs {
+func makeFs(srv *Server, dbdir string, dbname string, qidBase uint64) (*OlegFs, error) {
 	/* Make OlegFs instance */
 	ofs := new(OlegFs)
-	ofs.clients = make(map[net.Conn]Client)
+	ofs.Server = srv
+	ofs.name = dbname
+	ofs.qidBase = qidBase
+	ofs.cache = makeReadCache(defaultCacheSize)
+	ofs.expiring = make(map[string]time.Time)
+	ofs.done = make(chan bool)
 
 	/* Open OlegDB database */
 	var err error
-	ofs.db, err = goleg.Open(dbdir, dbname, goleg.F_APPENDONLY|goleg.F_LZ4|goleg.F_SPLAYTREE|goleg.F_AOL_FFLUSH)
+	ofs.db, err = ofs.backend.Open(dbdir, dbname, ofs.features)
+	if err != nil {
+		return nil, err
+	}
+	ofs.meta = makeMetaStore(ofs.db)
+	moved, err := ofs.meta.Migrate(srv.readOnly)
 	if err != nil {
-		panic(err.Error())
+		ofs.db.Close()
+		return nil, fmt.Errorf("migrating %s: %s", dbname, err.Error())
+	}
+	if moved > 0 {
+		logf(LogInfo, "%s: moved %d keys into the reserved namespace", dbname, moved)
+	}
+	if srv.readOnly {
+		ofs.db = readOnlyStore{ofs.db}
+		ofs.meta = makeMetaStore(ofs.db)
 	}
 
-	/* Make VFS */
-	vfs := new(lib9p.Server)
-	vfs.OnConnError = ofs.ConnError
-	vfs.OnAttach = ofs.Attach
-	vfs.OnWalk = ofs.Walk
-	vfs.OnClunk = ofs.Clunk
-	vfs.OnOpen = ofs.Open
-	vfs.OnRead = ofs.Read
-	vfs.OnStat = ofs.Stat
+	/* Make synthetic files */
+	ofs.synth = map[string]*SynthFile{
+		"ctl":        {PathId: 1, Mode: 0664, Uid: "adm", Gid: "adm", WriteCap: CapCtl, Read: ofs.ctlRead, Write: ofs.ctlWrite},
+		"export.tar": {PathId: 2, Mode: 0440, Uid: "adm", Gid: "adm", Read: ofs.exportRead},
+		"import":     {PathId: 3, Mode: 0220, Uid: "adm", Gid: "adm", WriteCap: CapCtl, Write: ofs.importWrite},
+		"cursor":     {PathId: 4, Mode: 0666, Uid: "adm", Gid: "adm", WriteCap: CapRead, Read: ofs.cursorRead, Write: ofs.cursorWrite},
+		"events":     {PathId: 5, Mode: 0666, Uid: "adm", Gid: "adm", WriteCap: CapRead, Open: ofs.eventsOpen, Write: ofs.eventsWrite},
+		"txn":        {PathId: 6, Mode: 0666, Uid: "adm", Gid: "adm", WriteCap: CapWrite, Open: ofs.txnOpen, Read: ofs.txnRead, Write: ofs.txnWrite},
+		"groups":     {PathId: 7, Mode: 0644, Uid: "adm", Gid: "adm", WriteCap: CapCtl, Read: ofs.groupsRead, Write: ofs.groupsWrite},
+	}
 
-	ofs.vfs = vfs
-	return ofs
+	go ofs.watchExpiry()
+	return ofs, nil
 }
 
-func (ofs *OlegFs) ConnError(con net.Conn, err error) {
-	fmt.Println(err.Error())
+func (ofs *OlegFs) close() {
+	close(ofs.done)
+	ofs.db.Close()
 }
 
-func (ofs *OlegFs) Attach(con net.Conn, req lib9p.AttachRequest) (out lib9p.AttachResponse, err error) {
-	path := make([]string, 0)
-	out.Qid, _ = ofs.getQid(path)
+/*
+   The 9P handlers below are called by the Server for fids in this
+   database, with the server mutex already held.
+*/
 
-	ofs.clients[con] = Client{
-		Fids: make(map[uint32]FidData),
+func (ofs *OlegFs) Open(con net.Conn, req lib9p.OpenRequest) (out lib9p.OpenResponse, err error) {
+	client, fid, err := ofs.getFC(con, req.Fid)
+	if err != nil {
+		return
 	}
-
-	ofs.clients[con].Fids[req.Fid] = FidData{
-		Qid:  out.Qid,
-		Path: path,
+	out.Qid, err = ofs.getQid(fid.Path)
+	if err != nil {
+		return
 	}
+	out.IoUnit = ofs.ioUnit
 
-	return
-}
-
-func (ofs *OlegFs) Walk(con net.Conn, req lib9p.WalkRequest) (out lib9p.WalkResponse, err error) {
-	client, fid, err := ofs.getFC(con, req.Fid)
+	err = ofs.checkCap(client, ofs.openCaps(fid.Path, req.Mode))
 	if err != nil {
 		return
 	}
-
-	current := FidData{
-		Qid:  fid.Qid,
-		Path: fid.Path[:],
+	err = ofs.checkPerm(client, fid.Path, openPerm(req.Mode))
+	if err != nil {
+		return
+	}
+	if out.Qid.Type&lib9p.QtExcl != 0 && ofs.inUse(fid.Path) {
+		err = errors.New(lib9p.ErrInUse)
+		return
 	}
 
-	out.Qids = make([]lib9p.Qid, len(req.Paths))
-	for i := range out.Qids {
-		fmt.Printf("Walking to %s..\n", req.Paths[i])
+	if isWriteMode(req.Mode) {
+		if out.Qid.Type&lib9p.QtDir != 0 {
+			err = errors.New(lib9p.ErrIsDirectory)
+			return
+		}
 
-		switch req.Paths[i] {
-		case ".":
-			out.Qids[i] = current.Qid
-		case "..":
-			nlen := len(current.Path) - 1
-			if nlen < 0 {
-				nlen = 0
+		// Writes go to a buffer, seeded with the current value unless truncating
+		if synth := ofs.getSynth(fid.Path); synth != nil {
+			if synth.Write == nil {
+				err = errors.New(lib9p.ErrDenied)
+				return
 			}
-			current.Qid, err = ofs.getQid(current.Path[:nlen])
-			out.Qids[i] = current.Qid
-		default:
-			current.Path = append(current.Path, req.Paths[i])
-			current.Qid, err = ofs.getQid(current.Path)
+		} else {
+			fid.Append = out.Qid.Type&lib9p.QtAppend != 0
+			truncate := req.Mode&lib9p.MTrunc != 0 && !fid.Append
+			fid.Buffer = ofs.openBuffer(pathKey(fid.Path), truncate || fid.Append)
+			fid.Dirty = truncate
+		}
+	} else if out.Qid.Type&lib9p.QtDir == 0 && ofs.getSynth(fid.Path) == nil {
+		key := pathKey(fid.Path)
+		err = ofs.keyError(key)
+		if err != nil {
+			return
+		}
+
+		// Reads from this fid all see the value as it was when opened,
+		// except for chunked values which are too big to hold on to
+		if _, chunked := ofs.loadManifest(key); !chunked {
+			fid.Snapshot, err = ofs.readData(key)
 			if err != nil {
 				return
 			}
-			out.Qids[i] = current.Qid
+		}
+	}
+	if synth := ofs.getSynth(fid.Path); synth != nil && synth.Open != nil {
+		err = synth.Open(client, fid)
+		if err != nil {
+			return
 		}
 	}
 
-	client.Fids[req.NewFid] = current
+	fid.Qid = out.Qid
+	fid.Open = true
+	fid.Mode = req.Mode
 	return
 }
 
-func (ofs *OlegFs) Clunk(con net.Conn, req lib9p.ClunkRequest) error {
-	client, _, err := ofs.getFC(con, req.Fid)
+func (ofs *OlegFs) Create(con net.Conn, req lib9p.CreateRequest) (out lib9p.CreateResponse, err error) {
+	client, fid, err := ofs.getFC(con, req.Fid)
 	if err != nil {
-		return err
+		return
 	}
 
-	delete(client.Fids, req.Fid)
-	return nil
-}
+	if fid.Qid.Type&lib9p.QtDir == 0 {
+		err = errors.New(lib9p.ErrNonDirCreate)
+		return
+	}
+	err = ofs.checkCap(client, CapWrite)
+	if err != nil {
+		return
+	}
 
-func (ofs *OlegFs) Open(con net.Conn, req lib9p.OpenRequest) (out lib9p.OpenResponse, err error) {
-	_, fid, err := ofs.getFC(con, req.Fid)
+	if req.Name == "." || req.Name == ".." || strings.Contains(req.Name, "/") {
+		err = errors.New(lib9p.ErrCantCreate)
+		return
+	}
+
+	path := append(append([]string{}, fid.Path...), req.Name)
+	err = ofs.checkKeyLength(pathKey(path))
 	if err != nil {
 		return
 	}
-	out.Qid, err = ofs.getQid(fid.Path)
-	out.IoUnit = 4096
+	if _, qerr := ofs.getQid(path); qerr == nil {
+		err = errors.New(lib9p.ErrExists)
+		return
+	}
+
+	// Creating needs write access to the directory, which also decides the group
+	dir, err := ofs.getMeta(fid.Path)
+	if err != nil {
+		return
+	}
+	if !ofs.allowed(client.Uname, dir, lib9p.DmWrite) {
+		err = errors.New(lib9p.ErrDenied)
+		return
+	}
+	now := uint32(time.Now().Unix())
+	stat := lib9p.Stat{
+		Atime: now,
+		Mtime: now,
+		Name:  req.Name,
+		Uid:   client.Uname,
+		Gid:   dir.Gid,
+		Muid:  client.Uname,
+	}
+
+	key := pathKey(path)
+	created := &FidData{
+		Fs:   ofs,
+		Path: path,
+		Open: true,
+		Mode: req.Mode,
+	}
+	if req.Permission&lib9p.DmDir != 0 {
+		// Directories are kept alive by a marker key
+		if isWriteMode(req.Mode) {
+			err = errors.New(lib9p.ErrIsDirectory)
+			return
+		}
+		_, err = ofs.meta.NewPathId(key + "/")
+		if err != nil {
+			return
+		}
+		if ofs.meta.MarkDir(key) != nil {
+			err = errors.New(lib9p.ErrCantCreate)
+			return
+		}
+		stat.Mode = lib9p.DmDir | req.Permission&(^uint32(0777)|dir.Mode&0777)&0777
+		stat.Qid, _ = ofs.getQid(path)
+		err = ofs.meta.Save(key+"/", stat)
+		if err != nil {
+			// Without its metadata it's not the directory that was asked for
+			ofs.meta.UnmarkDir(key)
+			return
+		}
+	} else {
+		// Files start empty, so they show up right away, and nothing left
+		// by a chunked key of the same name that expired may show through
+		ofs.dropChunks(key)
+		_, err = ofs.meta.NewPathId(key)
+		if err != nil {
+			return
+		}
+		if ofs.jarData(key, []byte{}) != nil {
+			err = errors.New(lib9p.ErrCantCreate)
+			return
+		}
+		ofs.notify("jar", key, "0")
+		stat.Mode = req.Permission&(^uint32(0666)|dir.Mode&0666)&0777 | req.Permission&modeBits
+		stat.Qid, _ = ofs.getQid(path)
+		stat.Qid.Type |= modeQidType(stat.Mode)
+		err = ofs.meta.Save(key, stat)
+		if err != nil {
+			ofs.removeKey(key)
+			return
+		}
+
+		if isWriteMode(req.Mode) {
+			created.Append = stat.Mode&lib9p.DmAppend != 0
+			created.Buffer = ofs.openBuffer(key, true)
+		}
+	}
+
+	out.Qid, err = ofs.getQid(path)
+	if err != nil {
+		return
+	}
+	out.IoUnit = ofs.ioUnit
+
+	// The fid now represents the newly created file
+	created.Qid = out.Qid
+	client.Fids[req.Fid] = created
 	return
 }
 
 func (ofs *OlegFs) Read(con net.Conn, req lib9p.ReadRequest) (b []byte, err error) {
-	_, fid, err := ofs.getFC(con, req.Fid)
-	key := strings.Join(fid.Path, "/")
+	client, fid, err := ofs.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	key := pathKey(fid.Path)
+
+	// Permissions are checked on open, so reading needs the fid to be open
+	if !fid.Open {
+		err = errors.New(lib9p.ErrNotOpen)
+		return
+	}
+	if fid.Mode&3 == lib9p.MWrite {
+		err = errors.New(lib9p.ErrDenied)
+		return
+	}
 
 	// Check if we need to do a directory read or file read
-	if fid.Qid.Type == lib9p.QtDir {
-		//todo
-		err = errors.New("Directory listing not implemented")
-	} else {
-		// /ctl is a special file
-		if key == "ctl" {
-			//todo
-			b = make([]byte, 0)
+	if fid.Qid.Type&lib9p.QtDir != 0 {
+		// Reads after the first carry on with the same listing
+		if req.Offset == 0 || fid.Listing == nil {
+			fid.Listing = ofs.listDir(fid.Path)
+		}
+		b = lib9p.PackDir(fid.Listing, req.Offset, req.Count)
+	} else if fid.Events != nil {
+		// Blocks until there's something to read, see events.go
+		b, err = ofs.eventsRead(fid.Events, req.Flushed, req.Count)
+	} else if synth := ofs.getSynth(fid.Path); synth != nil {
+		if synth.Read == nil {
+			err = errors.New(lib9p.ErrDenied)
 			return
 		}
-
+		b, err = synth.Read(client, fid, req.Offset, req.Count)
+	} else if fid.Buffer != nil && !fid.Append {
+		// Open for writing, read back what we have so far
+		b = ofs.readBuffer(fid.Buffer, req.Offset, uint64(req.Count))
+	} else if fid.Snapshot != nil {
+		b = sliceData(fid.Snapshot, req.Offset, req.Count)
+	} else {
 		// Any clever client should stat first, but you never know..
-		if !ofs.db.Exists(key) {
-			err = errors.New(lib9p.ErrNotFound)
-			return
+		b, err = ofs.readRange(key, req.Offset, uint64(req.Count))
+	}
+	return
+}
+
+/* Whether reading from the fid only reads its value, which leaves the fid and the database as they are */
+func (ofs *OlegFs) readsValue(fid *FidData) bool {
+	return fid.Open && fid.Mode&3 != lib9p.MWrite && fid.Qid.Type&lib9p.QtDir == 0 &&
+		fid.Events == nil && fid.Buffer == nil && ofs.getSynth(fid.Path) == nil
+}
+
+func (ofs *OlegFs) listDir(path []string) []lib9p.Stat {
+	stats := make([]lib9p.Stat, 0)
+	for _, name := range ofs.children(path) {
+		stat, err := ofs.getMeta(append(append([]string{}, path...), name))
+		if err != nil {
+			// Probably got removed while we were listing
+			continue
 		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+func (ofs *OlegFs) Write(con net.Conn, req lib9p.WriteRequest) (out lib9p.WriteResponse, err error) {
+	client, fid, err := ofs.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
 
-		// Return early if the offset is too big, spare us some unjars
-		datasize := uint64(ofs.db.GetSize(key))
-		if req.Offset > datasize {
-			b = make([]byte, 0)
+	if !fid.Open {
+		err = errors.New(lib9p.ErrNotOpen)
+		return
+	}
+	if synth := ofs.getSynth(fid.Path); synth != nil && isWriteMode(fid.Mode) {
+		out.Count, err = synth.Write(client, fid, req.Offset, req.Data)
+		return
+	}
+	if fid.Buffer == nil {
+		err = errors.New(lib9p.ErrDenied)
+		return
+	}
+
+	// Writing past the end grows the buffer, the gap is zero filled
+	offset := req.Offset
+	if fid.Append {
+		offset = fid.Buffer.Length
+	}
+	if offset > ofs.maxSize || uint64(len(req.Data)) > ofs.maxSize-offset {
+		err = errors.New(lib9p.ErrTooBig)
+		return
+	}
+	ofs.writeBuffer(fid.Buffer, offset, req.Data)
+	fid.Dirty = true
+
+	// Chunks behind the write go to the database, like imports do. What
+	// gets appended is only put where it goes on commit, see appendBuffer.
+	if !fid.Append {
+		err = ofs.spillBuffer(fid.Buffer, offset+uint64(len(req.Data)))
+		if err != nil {
 			return
 		}
+	}
+
+	out.Count = uint32(len(req.Data))
+	return
+}
 
-		// Unjar and send
-		data := ofs.db.Unjar(key)
-		limit := req.Offset + uint64(req.Count)
-		if limit > datasize {
-			limit = datasize
+func (ofs *OlegFs) Remove(con net.Conn, req lib9p.RemoveRequest) error {
+	client, fid, err := ofs.getFC(con, req.Fid)
+	if err != nil {
+		return err
+	}
+
+	// The fid is clunked even if the remove fails, pending writes are lost
+	delete(client.Fids, req.Fid)
+	ofs.closeEvents(fid)
+
+	if len(fid.Path) < 1 || ofs.getSynth(fid.Path) != nil {
+		return errors.New(lib9p.ErrCantRemove)
+	}
+	err = ofs.checkCap(client, CapWrite)
+	if err != nil {
+		return err
+	}
+	err = ofs.checkPerm(client, parentPath(fid.Path), lib9p.DmWrite)
+	if err != nil {
+		return err
+	}
+
+	key := pathKey(fid.Path)
+	if fid.Qid.Type&lib9p.QtDir != 0 {
+		if len(ofs.children(fid.Path)) > 0 {
+			return errors.New(lib9p.ErrNotEmpty)
 		}
-		b = data[req.Offset:limit]
+		ofs.meta.UnmarkDir(key)
+		return nil
 	}
-	return
+	return ofs.removeKey(key)
 }
 
 func (ofs *OlegFs) Stat(con net.Conn, req lib9p.StatRequest) (out lib9p.StatResponse, err error) {
@@ -178,24 +444,210 @@ func (ofs *OlegFs) Stat(con net.Conn, req lib9p.StatRequest) (out lib9p.StatResp
 	}
 
 	meta, err := ofs.getMeta(fid.Path)
+	if fid.Dirty && fid.Append {
+		meta.Length += fid.Buffer.Length
+	} else if fid.Dirty {
+		meta.Length = fid.Buffer.Length
+	}
 	out = lib9p.StatResponse{
 		Stat: meta,
 	}
 	return
 }
 
-func (ofs *OlegFs) getFC(con net.Conn, fid uint32) (*Client, *FidData, error) {
-	client, ok := ofs.clients[con]
-	if !ok {
-		return nil, nil, errors.New(lib9p.ErrDenied)
+func (ofs *OlegFs) Wstat(con net.Conn, req lib9p.WstatRequest) error {
+	client, fid, err := ofs.getFC(con, req.Fid)
+	if err != nil {
+		return err
+	}
+
+	// A wstat that changes nothing asks us to flush to disk (fsync)
+	stat := req.Stat
+	if isSyncStat(stat) {
+		return ofs.commit(client, fid)
 	}
 
-	fidData, ok := client.Fids[fid]
-	if !ok {
-		return nil, nil, errors.New(lib9p.ErrUnknownFid)
+	// Renaming and changing owner aren't supported
+	if stat.Name != "" || stat.Uid != "" || stat.Muid != "" {
+		return errors.New(lib9p.ErrCantWstat)
+	}
+	if len(fid.Path) < 1 || ofs.getSynth(fid.Path) != nil {
+		return errors.New(lib9p.ErrCantWstat)
+	}
+	err = ofs.checkCap(client, CapWrite)
+	if err != nil {
+		return err
+	}
+	key := pathKey(fid.Path)
+	err = ofs.checkKeyLength(key)
+	if err != nil {
+		return err
+	}
+
+	meta, err := ofs.getMeta(fid.Path)
+	if err != nil {
+		return err
+	}
+	isOwner := meta.Uid == client.Uname
+	canWrite := ofs.allowed(client.Uname, meta, lib9p.DmWrite)
+
+	// Only the owner can change mode and group, and only to a group they're in
+	if stat.Mode != ^uint32(0) && !isOwner {
+		return errors.New(lib9p.ErrDenied)
+	}
+	if stat.Gid != "" && (!isOwner || !ofs.inGroup(client.Uname, stat.Gid)) {
+		return errors.New(lib9p.ErrDenied)
+	}
+	if (stat.Mtime != ^uint32(0) || stat.Atime != ^uint32(0)) && !isOwner && !canWrite {
+		return errors.New(lib9p.ErrDenied)
 	}
 
-	return &client, &fidData, nil
+	if fid.Qid.Type&lib9p.QtDir != 0 {
+		// Directories have no length, their metadata is stored as "key/"
+		if stat.Length != ^uint64(0) {
+			return errors.New(lib9p.ErrCantWstat)
+		}
+		key += "/"
+	} else if stat.Length != ^uint64(0) {
+		if !canWrite {
+			return errors.New(lib9p.ErrDenied)
+		}
+		if stat.Length > ofs.maxSize {
+			return errors.New(lib9p.ErrTooBig)
+		}
+
+		// Truncating a file that isn't open goes through a temporary buffer
+		target := fid
+		if fid.Buffer == nil || fid.Append {
+			target = &FidData{Path: fid.Path, Buffer: ofs.openBuffer(key, false)}
+		}
+		ofs.resizeBuffer(target.Buffer, stat.Length)
+		target.Dirty = true
+		err = ofs.commit(client, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	if stat.Mode == ^uint32(0) && stat.Gid == "" && stat.Mtime == ^uint32(0) && stat.Atime == ^uint32(0) {
+		return nil
+	}
+
+	// Reload, the truncation above might have changed things
+	meta, err = ofs.getMeta(fid.Path)
+	if err != nil {
+		return err
+	}
+	if stat.Mode != ^uint32(0) {
+		bits := uint32(0777)
+		if fid.Qid.Type&lib9p.QtDir == 0 {
+			bits |= modeBits
+		}
+		meta.Mode = meta.Mode&^bits | stat.Mode&bits
+	}
+	if stat.Gid != "" {
+		meta.Gid = stat.Gid
+	}
+	if stat.Mtime != ^uint32(0) {
+		meta.Mtime = stat.Mtime
+	}
+	if stat.Atime != ^uint32(0) {
+		meta.Atime = stat.Atime
+	}
+	return ofs.meta.Save(key, meta)
+}
+
+/*
+   Writes are buffered per fid and the whole value is jarred back in one go,
+   together with the updated metadata, when the fid is clunked or synced.
+*/
+
+func (ofs *OlegFs) commit(client *Client, fid *FidData) error {
+	if fid.Txn != nil && len(fid.Txn.Ops) > 0 {
+		return ofs.commitTxn(client, fid.Txn)
+	}
+	if !fid.Dirty {
+		return nil
+	}
+
+	key := pathKey(fid.Path)
+	buffer := fid.Buffer
+	if fid.Append {
+		buffer = ofs.appendBuffer(fid.Buffer)
+	}
+	err := ofs.commitBuffer(buffer)
+	if err != nil {
+		return err
+	}
+	fid.Qid, err = ofs.modified(client, fid.Path, buffer.Length)
+	if err != nil {
+		return err
+	}
+	fid.Dirty = false
+	if fid.Append {
+		// Appended data is in now, don't append it twice
+		fid.Buffer = ofs.openBuffer(key, true)
+	}
+	return nil
+}
+
+/* Records a write by client to the file at path, which now holds length bytes */
+func (ofs *OlegFs) modified(client *Client, path []string, length uint64) (lib9p.Qid, error) {
+	stat, err := ofs.getMeta(path)
+	if err != nil {
+		return lib9p.Qid{}, err
+	}
+	stat.Length = length
+	stat.Mtime = uint32(time.Now().Unix())
+	stat.Muid = client.Uname
+	stat.Qid.Version++
+	return stat.Qid, ofs.meta.Save(pathKey(path), stat)
+}
+
+/* nil if key is there, or what clients get told when it isn't */
+func (ofs *OlegFs) keyError(key string) error {
+	ok, err := ofs.db.Exists(key)
+	if err == nil && !ok {
+		return errors.New(lib9p.ErrNotFound)
+	}
+	return storeError(err)
+}
+
+func (ofs *OlegFs) removeKey(key string) error {
+	err := ofs.keyError(key)
+	if err != nil {
+		return err
+	}
+	err = ofs.scoopData(key)
+	if err != nil {
+		return err
+	}
+	ofs.dropChunks(key)
+	ofs.meta.Delete(key)
+	ofs.notify("scoop", key)
+	return nil
+}
+
+func isWriteMode(mode uint8) bool {
+	rw := mode & 3
+	return rw == lib9p.MWrite || rw == lib9p.MRdwr || mode&lib9p.MTrunc != 0
+}
+
+func isSyncStat(stat lib9p.Stat) bool {
+	return stat.Mode == ^uint32(0) && stat.Atime == ^uint32(0) && stat.Mtime == ^uint32(0) &&
+		stat.Length == ^uint64(0) && stat.Name == "" && stat.Uid == "" && stat.Gid == "" && stat.Muid == ""
+}
+
+func sliceData(data []byte, offset uint64, count uint32) []byte {
+	datasize := uint64(len(data))
+	if offset > datasize {
+		return make([]byte, 0)
+	}
+	limit := offset + uint64(count)
+	if limit > datasize {
+		limit = datasize
+	}
+	return data[offset:limit]
 }
 
 func (ofs *OlegFs) getQid(path []string) (qid lib9p.Qid, err error) {
@@ -204,27 +656,41 @@ func (ofs *OlegFs) getQid(path []string) (qid lib9p.Qid, err error) {
 		qid = lib9p.Qid{
 			Type:    lib9p.QtDir,
 			Version: 1,
-			PathId:  0,
+			PathId:  ofs.qidBase,
 		}
 	} else {
 		// Check for special cases
-		if len(path) == 1 && path[0] == "ctl" {
-			qid = lib9p.Qid{
-				Type:    lib9p.QtFile,
-				Version: 1,
-				PathId:  1,
-			}
+		if synth := ofs.getSynth(path); synth != nil {
+			qid = synthQid(synth)
+			qid.PathId |= ofs.qidBase
 			return
 		}
 
 		// Make key from path
-		key := strings.Join(path, "/")
-		exists := ofs.db.Exists(key)
-		if exists {
+		key := pathKey(path)
+		var exists bool
+		exists, err = ofs.db.Exists(key)
+		if err != nil {
+			err = storeError(err)
+		} else if exists {
 			qid = lib9p.Qid{
 				Type:    lib9p.QtFile,
 				Version: 1,
-				PathId:  0, //todo set this to sha256 or something
+				PathId:  ofs.meta.PathId(key) | ofs.qidBase,
+			}
+			// Writes bump the version stored in the metadata
+			if meta, ok := ofs.meta.Load(key); ok {
+				qid.Version = meta.Qid.Version
+				qid.Type |= modeQidType(meta.Mode)
+			}
+			if expiration, err := ofs.db.Expiration(key); err == nil && !expiration.IsZero() {
+				qid.Type |= lib9p.QtTmp
+			}
+		} else if ofs.isDir(key) {
+			qid = lib9p.Qid{
+				Type:    lib9p.QtDir,
+				Version: 1,
+				PathId:  ofs.meta.DirPathId(key) | ofs.qidBase,
 			}
 		} else {
 			err = errors.New(lib9p.ErrNotFound)
@@ -235,55 +701,73 @@ func (ofs *OlegFs) getQid(path []string) (qid lib9p.Qid, err error) {
 }
 
 func (ofs *OlegFs) getMeta(path []string) (stat lib9p.Stat, err error) {
-	fullpath := strings.Join(path, "/")
+	fullpath := pathKey(path)
 	if len(path) < 1 {
 		// Root dir
 		now := time.Now().Unix()
 		qid, _ := ofs.getQid(path)
 		stat = lib9p.Stat{
 			Qid:    qid,
-			Mode:   lib9p.DmDir,
+			Mode:   lib9p.DmDir | 0777,
 			Atime:  uint32(now),
 			Mtime:  uint32(now),
 			Length: 0,
-			Name:   fullpath,
+			Name:   "/",
 			Uid:    "none",
 			Gid:    "none",
 			Muid:   "none",
 		}
 	} else {
 		// Check for special cases
-		if len(path) == 1 && path[0] == "ctl" {
-			qid, _ := ofs.getQid(path)
-			now := time.Now().Unix()
-			stat = lib9p.Stat{
-				Qid:    qid,
-				Mode:   0,
-				Atime:  uint32(now),
-				Mtime:  0,
-				Length: 0,
-				Name:   fullpath,
-				Uid:    "none",
-				Gid:    "none",
-				Muid:   "none",
-			}
+		if synth := ofs.getSynth(path); synth != nil {
+			stat = synthMeta(path[len(path)-1], synth)
+			stat.Qid.PathId |= ofs.qidBase
 			return
 		}
 
 		// Make key from path
-		key := strings.Join(path, "/")
-		exists := ofs.db.Exists(key)
-		if exists {
-			metaexists := ofs.db.Exists("_ofsmeta_" + key)
+		key := fullpath
+		var exists bool
+		exists, err = ofs.db.Exists(key)
+		if err != nil {
+			err = storeError(err)
+		} else if exists {
+			// Keys OlegFs didn't write have none, until somebody does
+			meta, metaexists := ofs.meta.Load(key)
 			if metaexists {
-				err = json.Unmarshal(ofs.db.Unjar("_ofsmeta_"+key), &stat)
+				stat = meta
 			} else {
 				stat = ofs.makeMeta(path)
-				data, err := json.Marshal(stat)
-				if err == nil {
-					ofs.db.Jar("_ofsmeta_"+key, data)
+			}
+			// The value might have been changed by someone else
+			stat.Length, err = ofs.dataSize(key)
+			if err != nil {
+				return
+			}
+			stat.Name = path[len(path)-1]
+			stat.Qid.PathId = ofs.meta.PathId(key) | ofs.qidBase
+			stat.Qid.Type = lib9p.QtFile | modeQidType(stat.Mode)
+			ofs.markExpiring(key, &stat)
+		} else if ofs.isDir(key) {
+			// Directories are virtual, only those made with mkdir have metadata
+			qid, _ := ofs.getQid(path)
+			meta, metaexists := ofs.meta.Load(key + "/")
+			if metaexists {
+				stat = meta
+			} else {
+				now := time.Now().Unix()
+				stat = lib9p.Stat{
+					Mode:   lib9p.DmDir | 0777,
+					Atime:  uint32(now),
+					Mtime:  uint32(now),
+					Length: 0,
+					Uid:    "none",
+					Gid:    "none",
+					Muid:   "none",
 				}
 			}
+			stat.Qid = qid
+			stat.Name = path[len(path)-1]
 		} else {
 			err = errors.New(lib9p.ErrNotFound)
 		}
@@ -292,19 +776,89 @@ func (ofs *OlegFs) getMeta(path []string) (stat lib9p.Stat, err error) {
 	return
 }
 
+/* Everything but the length, which getMeta fills in */
 func (ofs *OlegFs) makeMeta(path []string) lib9p.Stat {
-	fullpath := strings.Join(path, "/")
 	now := time.Now().Unix()
 	qid, _ := ofs.getQid(path)
 	return lib9p.Stat{
-		Qid:    qid,
-		Mode:   0,
-		Atime:  uint32(now),
-		Mtime:  uint32(now),
-		Length: uint64(ofs.db.GetSize(fullpath)),
-		Name:   fullpath,
-		Uid:    "none",
-		Gid:    "none",
-		Muid:   "none",
+		Qid:   qid,
+		Mode:  0666,
+		Atime: uint32(now),
+		Mtime: uint32(now),
+		Name:  path[len(path)-1],
+		Uid:   "none",
+		Gid:   "none",
+		Muid:  "none",
+	}
+}
+
+/*
+   Directories don't exist in OlegDB, they are inferred from keys: every
+   "/" in a key separates a directory from its contents. Empty directories
+   made with mkdir are kept around with a marker key.
+*/
+
+func pathKey(path []string) string {
+	return dataKey(strings.Join(path, "/"))
+}
+
+func (ofs *OlegFs) isDir(key string) bool {
+	if ofs.meta.IsMarkedDir(key) {
+		return true
+	}
+	for range ofs.db.Keys(key + "/") {
+		return true
+	}
+	return false
+}
+
+func (ofs *OlegFs) children(path []string) []string {
+	prefix := ""
+	if len(path) > 0 {
+		prefix = pathKey(path) + "/"
+	}
+
+	// Get every key under this directory, plus the empty directories
+	var keys []string
+	if prefix == "" {
+		keys, _ = ofs.db.DumpKeys()
+	} else {
+		keys, _ = ofs.db.PrefixMatch(prefix)
+	}
+	keys = append(keys, ofs.meta.MarkedDirs(prefix)...)
+
+	// Only keep the first path element after the prefix
+	names := make(map[string]bool)
+	if prefix == "" {
+		for name := range ofs.synth {
+			names[name] = true
+		}
+	}
+	for _, key := range keys {
+		if prefix == "" {
+			var ok bool
+			key, ok = userKey(key)
+			if !ok {
+				continue
+			}
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		name := key[len(prefix):]
+		if i := strings.Index(name, "/"); i >= 0 {
+			name = name[:i]
+		}
+		if name != "" {
+			names[name] = true
+		}
+	}
+
+	// Sort them so offsets stay the same between reads
+	out := make([]string, 0, len(names))
+	for name := range names {
+		out = append(out, name)
 	}
+	sort.Strings(out)
+	return out
 }
@@ -0,0 +1,1277 @@
+package main
+
+import (
+	"./goleg"
+	"./lib9p"
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Every test gets a server of its own on the memory backend, with an empty
+// database "test" in it. Handlers are called directly, the way lib9p would.
+
+const rootFid = 1
+
+func makeTestServer(t *testing.T) *Server {
+	t.Helper()
+	config := defaultConfig()
+	config.Backend = "memory"
+	config.DataDir = t.TempDir()
+	err := config.validate()
+	if err != nil {
+		t.Fatalf("Can't validate config: %s", err.Error())
+	}
+	config.apply()
+	srv, err := makeServer(config)
+	if err != nil {
+		t.Fatalf("Can't make server: %s", err.Error())
+	}
+	t.Cleanup(srv.closeAll)
+
+	srv.mutex.Lock()
+	err = srv.createDatabase("test")
+	srv.mutex.Unlock()
+	if err != nil {
+		t.Fatalf("Can't create database: %s", err.Error())
+	}
+	return srv
+}
+
+func testFs(srv *Server) *OlegFs {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return srv.dbs["test"]
+}
+
+type testClient struct {
+	t       *testing.T
+	srv     *Server
+	con     net.Conn
+	nextFid uint32
+}
+
+// Attaches uname to the test database, with the default policy unless
+// another one is given
+func attach(t *testing.T, srv *Server, uname string, policy ...string) *testClient {
+	t.Helper()
+	aname := "test"
+	if len(policy) > 0 {
+		aname += ":" + policy[0]
+	}
+	return attachTo(t, srv, uname, aname)
+}
+
+func attachTo(t *testing.T, srv *Server, uname, aname string) *testClient {
+	t.Helper()
+	con, other := net.Pipe()
+	t.Cleanup(func() {
+		con.Close()
+		other.Close()
+	})
+	_, err := srv.Attach(con, lib9p.AttachRequest{Fid: rootFid, Uname: uname, Aname: aname})
+	if err != nil {
+		t.Fatalf("Can't attach: %s", err.Error())
+	}
+	return &testClient{t: t, srv: srv, con: con, nextFid: rootFid + 1}
+}
+
+func check(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+}
+
+func checkErr(t *testing.T, err error, want string) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("Expected %q, got no error", want)
+	}
+	if err.Error() != want {
+		t.Fatalf("Expected %q, got %q", want, err.Error())
+	}
+}
+
+func splitPath(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// Walks a new fid to path, which has to get there all the way
+func (c *testClient) walk(path string) (uint32, lib9p.Qid, error) {
+	fid := c.nextFid
+	c.nextFid++
+	names := splitPath(path)
+	out, err := c.srv.Walk(c.con, lib9p.WalkRequest{Fid: rootFid, NewFid: fid, Paths: names})
+	if err != nil {
+		return 0, lib9p.Qid{}, err
+	}
+	if len(out.Qids) < len(names) {
+		return 0, lib9p.Qid{}, errors.New(lib9p.ErrNotFound)
+	}
+	qid := lib9p.Qid{}
+	if len(out.Qids) > 0 {
+		qid = out.Qids[len(out.Qids)-1]
+	}
+	return fid, qid, nil
+}
+
+func (c *testClient) open(path string, mode uint8) (uint32, error) {
+	fid, _, err := c.walk(path)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.srv.Open(c.con, lib9p.OpenRequest{Fid: fid, Mode: mode})
+	if err != nil {
+		c.clunk(fid)
+		return 0, err
+	}
+	return fid, nil
+}
+
+// Creates path in its directory, open for writing
+func (c *testClient) create(path string, perm uint32) (uint32, error) {
+	names := splitPath(path)
+	fid, _, err := c.walk(strings.Join(names[:len(names)-1], "/"))
+	if err != nil {
+		return 0, err
+	}
+	mode := uint8(lib9p.MWrite)
+	if perm&lib9p.DmDir != 0 {
+		mode = lib9p.MRead
+	}
+	_, err = c.srv.Create(c.con, lib9p.CreateRequest{Fid: fid, Name: names[len(names)-1], Permission: perm, Mode: mode})
+	if err != nil {
+		c.clunk(fid)
+		return 0, err
+	}
+	return fid, nil
+}
+
+func (c *testClient) read(fid uint32, offset uint64, count uint32) ([]byte, error) {
+	return c.srv.Read(c.con, lib9p.ReadRequest{Fid: fid, Offset: offset, Count: count})
+}
+
+func (c *testClient) write(fid uint32, offset uint64, data []byte) error {
+	_, err := c.srv.Write(c.con, lib9p.WriteRequest{Fid: fid, Offset: offset, Data: data})
+	return err
+}
+
+func (c *testClient) clunk(fid uint32) error {
+	return c.srv.Clunk(c.con, lib9p.ClunkRequest{Fid: fid})
+}
+
+func (c *testClient) stat(path string) (lib9p.Stat, error) {
+	fid, _, err := c.walk(path)
+	if err != nil {
+		return lib9p.Stat{}, err
+	}
+	defer c.clunk(fid)
+	out, err := c.srv.Stat(c.con, lib9p.StatRequest{Fid: fid})
+	return out.Stat, err
+}
+
+func (c *testClient) remove(path string) error {
+	fid, _, err := c.walk(path)
+	if err != nil {
+		return err
+	}
+	return c.srv.Remove(c.con, lib9p.RemoveRequest{Fid: fid})
+}
+
+// Whole contents of a file, or of a synthetic one, read from the start
+func (c *testClient) readFile(path string) ([]byte, error) {
+	fid, err := c.open(path, lib9p.MRead)
+	if err != nil {
+		return nil, err
+	}
+	defer c.clunk(fid)
+	out := make([]byte, 0)
+	for {
+		data, err := c.read(fid, uint64(len(out)), 4096)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) == 0 {
+			return out, nil
+		}
+		out = append(out, data...)
+	}
+}
+
+func (c *testClient) writeFile(path string, data []byte) error {
+	fid, err := c.open(path, lib9p.MWrite|lib9p.MTrunc)
+	if err != nil {
+		return err
+	}
+	err = c.write(fid, 0, data)
+	if err != nil {
+		c.clunk(fid)
+		return err
+	}
+	return c.clunk(fid)
+}
+
+func (c *testClient) createFile(path string, perm uint32, data []byte) error {
+	fid, err := c.create(path, perm)
+	if err != nil {
+		return err
+	}
+	err = c.write(fid, 0, data)
+	if err != nil {
+		c.clunk(fid)
+		return err
+	}
+	return c.clunk(fid)
+}
+
+func (c *testClient) mkdir(path string, perm uint32) error {
+	fid, err := c.create(path, lib9p.DmDir|perm)
+	if err != nil {
+		return err
+	}
+	return c.clunk(fid)
+}
+
+// Names in a directory, from the packed stats a directory read returns
+func (c *testClient) list(path string) ([]string, error) {
+	data, err := c.readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	names := dirNames(data)
+	sort.Strings(names)
+	return names, nil
+}
+
+func dirNames(data []byte) []string {
+	names := make([]string, 0)
+	for len(data) >= 43 {
+		size := int(data[0]) | int(data[1])<<8
+		nlen := int(data[41]) | int(data[42])<<8
+		names = append(names, string(data[43:43+nlen]))
+		data = data[2+size:]
+	}
+	return names
+}
+
+func checkFile(t *testing.T, c *testClient, path string, want string) {
+	t.Helper()
+	data, err := c.readFile(path)
+	if err != nil {
+		t.Fatalf("Can't read %s: %s", path, err.Error())
+	}
+	if !bytes.Equal(data, []byte(want)) {
+		t.Fatalf("%s is %q, expected %q", path, data, want)
+	}
+}
+
+func checkList(t *testing.T, c *testClient, path string, want ...string) {
+	t.Helper()
+	names, err := c.list(path)
+	if err != nil {
+		t.Fatalf("Can't list %s: %s", path, err.Error())
+	}
+	sort.Strings(want)
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("%s has %v, expected %v", path, names, want)
+	}
+}
+
+// The synthetic files every database root has
+var synthNames = []string{"ctl", "cursor", "events", "export.tar", "groups", "import", "txn"}
+
+func TestDirectories(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+
+	// Keys put there by something else still show up as a tree
+	db := testFs(srv).db
+	for _, key := range []string{"users/alice", "users/bob/inbox", "top"} {
+		check(t, db.Jar(key, []byte(key)))
+	}
+
+	_, qid, err := c.walk("users")
+	check(t, err)
+	if qid.Type&lib9p.QtDir == 0 {
+		t.Fatalf("users isn't a directory")
+	}
+	_, qid, err = c.walk("users/bob")
+	check(t, err)
+	if qid.Type&lib9p.QtDir == 0 {
+		t.Fatalf("users/bob isn't a directory")
+	}
+	_, qid, err = c.walk("users/alice")
+	check(t, err)
+	if qid.Type&lib9p.QtDir != 0 {
+		t.Fatalf("users/alice is a directory")
+	}
+	_, _, err = c.walk("users/carol")
+	checkErr(t, err, lib9p.ErrNotFound)
+
+	checkList(t, c, "", append([]string{"top", "users"}, synthNames...)...)
+	checkList(t, c, "users", "alice", "bob")
+	checkFile(t, c, "users/bob/inbox", "users/bob/inbox")
+
+	// Empty directories stay around until removed
+	check(t, c.mkdir("empty", 0777))
+	checkList(t, c, "empty")
+	check(t, c.createFile("empty/file", 0666, []byte("x")))
+	err = c.remove("empty")
+	checkErr(t, err, lib9p.ErrNotEmpty)
+	check(t, c.remove("empty/file"))
+	checkList(t, c, "empty")
+	check(t, c.remove("empty"))
+	_, _, err = c.walk("empty")
+	checkErr(t, err, lib9p.ErrNotFound)
+}
+
+func TestDirListing(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.mkdir("dir", 0777))
+	for _, name := range []string{"dir/a", "dir/b", "dir/c"} {
+		check(t, c.createFile(name, 0666, nil))
+	}
+
+	fid, err := c.open("dir", lib9p.MRead)
+	check(t, err)
+	first, err := c.read(fid, 0, 100)
+	check(t, err)
+	names := dirNames(first)
+	if len(names) != 1 {
+		t.Fatalf("Expected one entry in 100 bytes, got %v", names)
+	}
+
+	// Changes after the first read don't show up until reading from 0 again
+	check(t, c.createFile("dir/0", 0666, nil))
+	check(t, c.remove("dir/c"))
+	rest, err := c.read(fid, uint64(len(first)), 8192)
+	check(t, err)
+	names = append(names, dirNames(rest)...)
+	sort.Strings(names)
+	if strings.Join(names, " ") != "a b c" {
+		t.Fatalf("Listing in pieces gave %v", names)
+	}
+	all, err := c.read(fid, 0, 8192)
+	check(t, err)
+	names = dirNames(all)
+	sort.Strings(names)
+	if strings.Join(names, " ") != "0 a b" {
+		t.Fatalf("Reading from 0 again gave %v", names)
+	}
+	check(t, c.clunk(fid))
+}
+
+func TestWriteBuffering(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	other := attach(t, srv, "glenda")
+
+	fid, err := c.create("notes", 0666)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("hello")))
+	check(t, c.write(fid, 5, []byte(" world")))
+
+	// Nothing is in the database until the fid is clunked
+	checkFile(t, other, "notes", "")
+	check(t, c.clunk(fid))
+	checkFile(t, other, "notes", "hello world")
+
+	before, err := c.stat("notes")
+	check(t, err)
+	if before.Length != 11 || before.Uid != "glenda" || before.Muid != "glenda" {
+		t.Fatalf("Unexpected stat %+v", before)
+	}
+
+	// Writing past the end fills the gap with zeros, fsync commits
+	fid, err = c.open("notes", lib9p.MRdwr)
+	check(t, err)
+	check(t, c.write(fid, 13, []byte("!")))
+	data, err := c.read(fid, 0, 100)
+	check(t, err)
+	if string(data) != "hello world\x00\x00!" {
+		t.Fatalf("Read back %q from the buffer", data)
+	}
+	sync := lib9p.Stat{Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+	check(t, srv.Wstat(c.con, lib9p.WstatRequest{Fid: fid, Stat: sync}))
+	checkFile(t, other, "notes", "hello world\x00\x00!")
+	check(t, c.clunk(fid))
+
+	after, err := c.stat("notes")
+	check(t, err)
+	if after.Length != 14 || after.Qid.Version <= before.Qid.Version || after.Qid.PathId != before.Qid.PathId {
+		t.Fatalf("Stat went from %+v to %+v", before, after)
+	}
+
+	// Truncating starts over
+	check(t, c.writeFile("notes", []byte("short")))
+	checkFile(t, other, "notes", "short")
+}
+
+func TestRemove(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+
+	check(t, c.createFile("gone", 0666, []byte("soon")))
+	check(t, c.remove("gone"))
+	_, _, err := c.walk("gone")
+	checkErr(t, err, lib9p.ErrNotFound)
+	if _, ok := testFs(srv).meta.Load("gone"); ok {
+		t.Fatalf("Metadata outlived its key")
+	}
+
+	err = c.remove("ctl")
+	checkErr(t, err, lib9p.ErrCantRemove)
+}
+
+func TestPermissionBits(t *testing.T) {
+	srv := makeTestServer(t)
+	alice := attach(t, srv, "alice")
+	bob := attach(t, srv, "bob")
+
+	check(t, alice.createFile("diary", 0600, []byte("dear diary")))
+	check(t, alice.createFile("board", 0644, []byte("hi all")))
+	check(t, alice.mkdir("private", 0755))
+
+	_, err := bob.open("diary", lib9p.MRead)
+	checkErr(t, err, lib9p.ErrDenied)
+	checkFile(t, alice, "diary", "dear diary")
+	checkFile(t, bob, "board", "hi all")
+	err = bob.writeFile("board", []byte("defaced"))
+	checkErr(t, err, lib9p.ErrDenied)
+	_, err = bob.create("private/mine", 0666)
+	checkErr(t, err, lib9p.ErrDenied)
+	check(t, alice.createFile("private/mine", 0666, nil))
+
+	// Only the owner changes the mode
+	fid, _, err := bob.walk("board")
+	check(t, err)
+	wstat := lib9p.Stat{Mode: 0666, Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+	checkErr(t, srv.Wstat(bob.con, lib9p.WstatRequest{Fid: fid, Stat: wstat}), lib9p.ErrDenied)
+	fid, _, err = alice.walk("board")
+	check(t, err)
+	check(t, srv.Wstat(alice.con, lib9p.WstatRequest{Fid: fid, Stat: wstat}))
+	check(t, bob.writeFile("board", []byte("defaced")))
+
+	// Names with a slash can't get around the directories on the way
+	check(t, alice.mkdir("secret", 0700))
+	check(t, alice.createFile("secret/x", 0666, []byte("hidden")))
+	_, _, err = bob.walk("secret/x")
+	checkErr(t, err, lib9p.ErrNotFound)
+	for _, names := range [][]string{{"secret/x"}, {""}, {"private", "mine/"}} {
+		out, err := srv.Walk(bob.con, lib9p.WalkRequest{Fid: rootFid, NewFid: 100, Paths: names})
+		if err == nil && len(out.Qids) == len(names) {
+			t.Fatalf("Walked %q", names)
+		}
+	}
+}
+
+func TestTxn(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.createFile("a", 0666, []byte("1")))
+
+	fid, err := c.open("txn", lib9p.MRdwr)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("expect a 1\n1\nput a 1\n2\nput b 1\n3\ncommit\n")))
+	result, err := c.read(fid, 0, 100)
+	check(t, err)
+	if string(result) != "ok\n" {
+		t.Fatalf("Commit says %q", result)
+	}
+	checkFile(t, c, "a", "2")
+	checkFile(t, c, "b", "3")
+
+	// A failed expectation applies nothing
+	check(t, c.write(fid, 0, []byte("put b 1\n4\nexpect a 1\n1\ncommit\n")))
+	result, err = c.read(fid, 0, 100)
+	check(t, err)
+	if string(result) != "failed: value mismatch on a\n" {
+		t.Fatalf("Commit says %q", result)
+	}
+	checkFile(t, c, "b", "3")
+	check(t, c.clunk(fid))
+}
+
+func TestTxnOrder(t *testing.T) {
+	tests := []struct {
+		ops, result string
+		a           string // Value of a after the commit
+		absent      []string
+	}{
+		{"delete a\ndelete a\n", "failed: file not found: a\n", "1", nil},
+		{"put x 1\n1\nput x/y 1\n2\n", "failed: not a directory: x\n", "1", []string{"x"}},
+		{"put d/e 1\n1\nput d 1\n2\n", "failed: is a directory\n", "1", []string{"d/e"}},
+		{"put n 1\n5\nexpect n 1\n5\ndelete n\nabsent n\n", "ok\n", "1", []string{"n"}},
+		{"delete a\nabsent a\nput a 1\n9\nexpect a 1\n9\n", "ok\n", "9", nil},
+	}
+	for _, test := range tests {
+		srv := makeTestServer(t)
+		c := attach(t, srv, "glenda")
+		check(t, c.createFile("a", 0666, []byte("1")))
+
+		fid, err := c.open("txn", lib9p.MRdwr)
+		check(t, err)
+		check(t, c.write(fid, 0, []byte(test.ops+"commit\n")))
+		result, err := c.read(fid, 0, 100)
+		check(t, err)
+		if string(result) != test.result {
+			t.Fatalf("%q: commit says %q, expected %q", test.ops, result, test.result)
+		}
+		checkFile(t, c, "a", test.a)
+		for _, key := range test.absent {
+			if exists(testFs(srv).db, key) {
+				t.Fatalf("%q: %s is there", test.ops, key)
+			}
+		}
+		check(t, c.clunk(fid))
+	}
+}
+
+func TestTxnDisconnect(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	fid, err := c.open("txn", lib9p.MRdwr)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("put a 1\n1\n")))
+
+	// The rest of the transaction might never have made it
+	srv.Disconnect(c.con)
+	if exists(testFs(srv).db, "a") {
+		t.Fatal("Disconnecting committed the transaction")
+	}
+}
+
+func TestStoreErrors(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{&goleg.Error{Op: "unjar", Key: "x", Err: goleg.ErrNotFound}, lib9p.ErrNotFound},
+		{&goleg.Error{Op: "jar", Key: "x", Err: goleg.ErrKeyTooLong}, lib9p.ErrNameTooLong},
+		{&goleg.Error{Op: "jar", Key: "x", Err: goleg.ErrFailed}, lib9p.ErrIO},
+		{errors.New("anything else"), lib9p.ErrIO},
+	}
+	for _, test := range tests {
+		checkErr(t, storeError(test.err), test.want)
+	}
+	check(t, storeError(nil))
+
+	// Through 9P
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	_, _, err := c.walk(strings.Repeat("x", goleg.KeySize+1))
+	checkErr(t, err, lib9p.ErrNameTooLong)
+	_, _, err = c.walk("missing")
+	checkErr(t, err, lib9p.ErrNotFound)
+}
+
+func TestNameTooLong(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+
+	// The longest name that still has room for the keys derived from it
+	longest := goleg.KeySize
+	for ofs.checkKeyLength(strings.Repeat("x", longest)) != nil {
+		longest--
+	}
+	if longest >= goleg.KeySize-len(chunkPrefix) {
+		t.Fatalf("%d bytes leaves no room for chunk keys", longest)
+	}
+	fits, long := strings.Repeat("f", longest), strings.Repeat("l", longest+1)
+	check(t, c.createFile(fits, 0666, []byte("x")))
+	check(t, c.mkdir(strings.Repeat("d", longest), 0777))
+	checkErr(t, c.createFile(long, 0666, nil), lib9p.ErrNameTooLong)
+	checkErr(t, c.mkdir(long, 0777), lib9p.ErrNameTooLong)
+
+	fid, err := c.open("txn", lib9p.MRdwr)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("put "+long+" 1\n1\ncommit\n")))
+	result, err := c.read(fid, 0, 1000)
+	check(t, err)
+	if string(result) != "failed: "+lib9p.ErrNameTooLong+": "+long+"\n" {
+		t.Fatalf("Commit says %q", result)
+	}
+	check(t, c.clunk(fid))
+
+	// Keys that got in some other way can't get metadata either
+	ofs.db.Jar(long, []byte("outside"))
+	fid, _, err = c.walk(long)
+	check(t, err)
+	stat := lib9p.Stat{Mode: 0600, Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+	checkErr(t, c.srv.Wstat(c.con, lib9p.WstatRequest{Fid: fid, Stat: stat}), lib9p.ErrNameTooLong)
+	check(t, c.clunk(fid))
+
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	check(t, writer.WriteHeader(&tar.Header{Name: long, Typeflag: tar.TypeReg, Mode: 0644}))
+	check(t, writer.Close())
+	admin := attach(t, srv, "adm", "admin")
+	fid, err = admin.open("import", lib9p.MWrite)
+	check(t, err)
+	checkErr(t, admin.write(fid, 0, archive.Bytes()), lib9p.ErrNameTooLong)
+	admin.clunk(fid)
+}
+
+func TestCreateRollback(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	ofs.db = failingStore{ofs.db, metaPrefix}
+	ofs.meta.db = ofs.db
+
+	checkErr(t, c.createFile("file", 0666, nil), lib9p.ErrIO)
+	checkErr(t, c.mkdir("dir", 0777), lib9p.ErrIO)
+	if exists(ofs.db, "file") || ofs.meta.IsMarkedDir("dir") {
+		t.Fatal("Create left behind what it couldn't finish")
+	}
+	if _, _, err := c.walk("file"); err == nil {
+		t.Fatal("Walked to a file that failed to be created")
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	srv := makeTestServer(t)
+	srv.maxSize = 64
+	c := attach(t, srv, "glenda")
+
+	fid, err := c.create("big", 0644)
+	check(t, err)
+	checkErr(t, c.write(fid, 1<<62, []byte("x")), lib9p.ErrTooBig)
+	checkErr(t, c.write(fid, 60, []byte("too far")), lib9p.ErrTooBig)
+	checkErr(t, c.write(fid, ^uint64(0), []byte("x")), lib9p.ErrTooBig)
+	check(t, c.write(fid, 60, []byte("last")))
+	check(t, c.clunk(fid))
+
+	stat, err := c.stat("big")
+	check(t, err)
+	if stat.Length != 64 {
+		t.Fatalf("Expected length 64, got %d", stat.Length)
+	}
+
+	fid, _, err = c.walk("big")
+	check(t, err)
+	stat = lib9p.Stat{Mode: ^uint32(0), Atime: ^uint32(0), Mtime: ^uint32(0), Length: 65}
+	checkErr(t, c.srv.Wstat(c.con, lib9p.WstatRequest{Fid: fid, Stat: stat}), lib9p.ErrTooBig)
+	check(t, c.clunk(fid))
+}
+
+func TestCtlCas(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "adm", "admin")
+	check(t, c.createFile("counter", 0666, []byte("1")))
+
+	check(t, c.writeFile("ctl", []byte("cas counter 1 2\n")))
+	checkFile(t, c, "counter", "2")
+	stat, err := c.stat("counter")
+	check(t, err)
+	if stat.Length != 1 || stat.Muid != "adm" {
+		t.Fatalf("Stat after cas is %+v", stat)
+	}
+
+	checkErr(t, c.writeFile("ctl", []byte("cas counter 1 3\n")), "value mismatch")
+	checkFile(t, c, "counter", "2")
+	checkErr(t, c.writeFile("ctl", []byte("cas missing 1 3\n")), lib9p.ErrNotFound)
+
+	check(t, c.writeFile("ctl", []byte("debug on\n")))
+	if !lib9p.DebugReq.Load() {
+		t.Fatal("debug on didn't turn tracing on")
+	}
+	check(t, c.writeFile("ctl", []byte("debug off\n")))
+	if lib9p.DebugReq.Load() {
+		t.Fatal("debug off didn't turn tracing off")
+	}
+}
+
+func TestCtlCommands(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "adm", "admin")
+	ofs := testFs(srv)
+	check(t, c.createFile("a", 0666, []byte("1")))
+	check(t, c.createFile("b", 0666, []byte("2")))
+
+	status, err := c.readFile("ctl")
+	check(t, err)
+	for _, line := range []string{"database test\n", "backend memory\n", "readonly off\n"} {
+		if !strings.Contains(string(status), line) {
+			t.Errorf("Status doesn't say %q:\n%s", line, status)
+		}
+	}
+
+	check(t, c.writeFile("ctl", []byte("squish\nscoop a\n")))
+	if _, _, err = c.walk("a"); err == nil {
+		t.Fatal("scoop left a there")
+	}
+	checkErr(t, c.writeFile("ctl", []byte("scoop a\n")), lib9p.ErrNotFound)
+
+	check(t, c.writeFile("ctl", []byte("spoil b +1h\n")))
+	if expiration, ok := expiresAt(ofs.db, "b"); !ok || time.Until(expiration) < 59*time.Minute {
+		t.Fatalf("spoil +1h set %v", expiration)
+	}
+	check(t, c.writeFile("ctl", []byte("spoil b never\n")))
+	if _, ok := expiresAt(ofs.db, "b"); ok {
+		t.Fatal("spoil never left the expiration")
+	}
+	checkErr(t, c.writeFile("ctl", []byte("spoil b tomorrow\n")), `bad time "tomorrow"`)
+
+	// Metadata of a key scooped behind OlegFs' back
+	check(t, ofs.db.Scoop("b"))
+	check(t, c.writeFile("ctl", []byte("gc\n")))
+	if _, ok := ofs.meta.Load("b"); ok {
+		t.Fatal("gc left the metadata of b")
+	}
+
+	check(t, c.writeFile("ctl", []byte("mkdb other\n")))
+	attachTo(t, srv, "adm", "other")
+
+	for _, line := range []string{"squish now\n", "nosuch\n", "debug maybe\n", "scoop\n"} {
+		checkErr(t, c.writeFile("ctl", []byte(line)), ErrBadCtl)
+	}
+
+	// Only policies with ctl get to write it
+	user := attach(t, srv, "glenda")
+	checkErr(t, user.writeFile("ctl", []byte("squish\n")), lib9p.ErrDenied)
+}
+
+func TestExpires(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.createFile("milk", 0666, []byte("2%")))
+
+	expiring := func(want bool) {
+		t.Helper()
+		stat, err := c.stat("milk")
+		check(t, err)
+		if (stat.Mode&lib9p.DmTmp != 0) != want {
+			t.Fatalf("Expected expiring to be %v, mode is %#o", want, stat.Mode)
+		}
+	}
+	expiring(false)
+	check(t, c.writeFile("milk.expires", []byte("+1h\n")))
+	expiring(true)
+	check(t, c.writeFile("milk.expires", []byte("never\n")))
+	expiring(false)
+	checkFile(t, c, "milk.expires", "")
+
+	// So does an empty write
+	check(t, c.writeFile("milk.expires", []byte("+1h")))
+	expiring(true)
+	check(t, c.writeFile("milk.expires", nil))
+	expiring(false)
+	checkFile(t, c, "milk", "2%")
+
+	checkErr(t, c.writeFile("milk.expires", []byte("someday")), `bad time "someday"`)
+}
+
+// Everything in the database, to tell whether something wrote to it
+func snapshot(t *testing.T, ofs *OlegFs) map[string]string {
+	t.Helper()
+	keys, err := ofs.db.DumpKeys()
+	check(t, err)
+	out := make(map[string]string)
+	for _, key := range keys {
+		value, err := ofs.db.Unjar(key)
+		check(t, err)
+		out[key] = string(value)
+	}
+	return out
+}
+
+func TestReadsDontWrite(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.mkdir("dir", 0777))
+	check(t, c.createFile("dir/a", 0666, []byte("made here")))
+	ofs := testFs(srv)
+	check(t, ofs.db.Jar("outside/b", []byte("made elsewhere")))
+
+	before := snapshot(t, ofs)
+	first, err := c.stat("outside/b")
+	check(t, err)
+	if first.Qid.PathId&hashedQid == 0 || first.Uid != "none" {
+		t.Fatalf("Key without metadata has stat %+v", first)
+	}
+	second, err := c.stat("outside/b")
+	check(t, err)
+	if second.Qid != first.Qid {
+		t.Fatalf("Qid changed from %+v to %+v", first.Qid, second.Qid)
+	}
+	for _, dir := range []string{"", "dir", "outside"} {
+		_, err = c.list(dir)
+		check(t, err)
+	}
+	checkFile(t, c, "dir/a", "made here")
+	checkFile(t, c, "outside/b", "made elsewhere")
+	checkFile(t, c, "outside/b.expires", "")
+	if after := snapshot(t, ofs); !reflect.DeepEqual(before, after) {
+		t.Fatalf("Reading changed the database from %v to %v", before, after)
+	}
+
+	// Writing keeps the id it had
+	check(t, c.writeFile("outside/b", []byte("changed here")))
+	third, err := c.stat("outside/b")
+	check(t, err)
+	if third.Qid.PathId != first.Qid.PathId {
+		t.Fatalf("Qid path changed from %#x to %#x", first.Qid.PathId, third.Qid.PathId)
+	}
+
+	// Created files count up, a new file with the same name is a new file
+	made, err := c.stat("dir/a")
+	check(t, err)
+	check(t, c.remove("dir/a"))
+	check(t, c.createFile("dir/a", 0666, nil))
+	remade, err := c.stat("dir/a")
+	check(t, err)
+	if made.Qid.PathId&hashedQid != 0 || remade.Qid.PathId == made.Qid.PathId {
+		t.Fatalf("Qid paths %#x and %#x", made.Qid.PathId, remade.Qid.PathId)
+	}
+}
+
+func TestHashedQids(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	for _, key := range []string{"a", "b", "c"} {
+		check(t, ofs.db.Jar(key, []byte(key)))
+	}
+
+	// Something else already has the id a hashes to
+	a := ofs.meta.hashedId("a")
+	ofs.meta.hashed.keys[a+1] = "taken"
+	delete(ofs.meta.hashed.ids, "a")
+	delete(ofs.meta.hashed.keys, a)
+	ofs.meta.hashed.keys[a] = "other"
+	if id := ofs.meta.PathId("a"); id == a || id == a+1 || id&hashedQid == 0 {
+		t.Fatalf("a got id %#x, which is taken", id)
+	}
+
+	ids := make(map[uint64]string)
+	for _, key := range []string{"a", "b", "c"} {
+		stat, err := c.stat(key)
+		check(t, err)
+		if other, ok := ids[stat.Qid.PathId]; ok {
+			t.Fatalf("%s and %s share qid path %#x", key, other, stat.Qid.PathId)
+		}
+		ids[stat.Qid.PathId] = key
+	}
+
+	// Writing stores the id, and another server knows it's taken
+	before, err := c.stat("b")
+	check(t, err)
+	check(t, c.writeFile("b", []byte("changed")))
+	if id, ok := ofs.meta.loadCounter(qidPrefix + "b"); !ok || id|ofs.qidBase != before.Qid.PathId {
+		t.Fatalf("Stored id of b is %#x, expected %#x", id, before.Qid.PathId)
+	}
+	fresh := makeMetaStore(ofs.db)
+	fresh.hashedId("")
+	if fresh.hashed.keys[before.Qid.PathId&^ofs.qidBase] != "b" {
+		t.Fatal("Stored hashed ids aren't remembered")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	srv := makeTestServer(t)
+	db, err := srv.backend.Open(srv.dataRoot, "legacy", srv.features)
+	check(t, err)
+	// As they were stored before the reserved namespace
+	check(t, db.Jar("_ofsnotes", []byte("old notes")))
+	check(t, db.Jar("_ofsmeta__ofsnotes", []byte(`{"Mode":384,"Uid":"glenda","Gid":"glenda"}`)))
+	check(t, db.Jar("_ofsdir/inner", []byte("nested")))
+	check(t, db.Jar("plain", []byte("untouched")))
+
+	srv.readOnly = true
+	srv.mutex.Lock()
+	_, err = srv.database("legacy", false)
+	srv.mutex.Unlock()
+	checkErr(t, err, lib9p.ErrIO)
+
+	srv.readOnly = false
+	c := attachTo(t, srv, "glenda", "legacy")
+	checkFile(t, c, "_ofsnotes", "old notes")
+	checkFile(t, c, "_ofsdir/inner", "nested")
+	checkFile(t, c, "plain", "untouched")
+	stat, err := c.stat("_ofsnotes")
+	check(t, err)
+	if stat.Uid != "glenda" || stat.Mode&0777 != 0600 {
+		t.Fatalf("Metadata didn't move along, stat is %+v", stat)
+	}
+	if exists(db, "_ofsnotes") || !exists(db, formatKey) {
+		t.Fatal("Migration left the old layout behind")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.createFile("kept", 0666, []byte("as it was")))
+	testFs(srv).db.Jar("outside", []byte("no metadata"))
+	srv.closeAll()
+	srv.readOnly = true
+
+	c = attach(t, srv, "glenda", "admin")
+	ofs := testFs(srv)
+	before := snapshot(t, ofs)
+	checkFile(t, c, "kept", "as it was")
+	checkFile(t, c, "outside", "no metadata")
+	_, err := c.list("")
+	check(t, err)
+	checkErr(t, c.writeFile("kept", []byte("changed")), lib9p.ErrDenied)
+	checkErr(t, c.createFile("new", 0666, nil), lib9p.ErrDenied)
+	checkErr(t, c.writeFile("ctl", []byte("squish\n")), lib9p.ErrDenied)
+	checkErr(t, c.remove("kept"), lib9p.ErrDenied)
+
+	// Whatever gets past the capabilities, the store refuses
+	checkErr(t, storeError(ofs.db.Jar("kept", nil)), lib9p.ErrDenied)
+	checkErr(t, storeError(ofs.db.Scoop("kept")), lib9p.ErrDenied)
+	if after := snapshot(t, ofs); !reflect.DeepEqual(before, after) {
+		t.Fatalf("Read-only server changed the database from %v to %v", before, after)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	srv := makeTestServer(t)
+	srv.policies["backup"] = CapRead | CapCtl
+	c := attach(t, srv, "adm", "backup")
+	check(t, c.writeFile("ctl", []byte("squish\n")))
+	checkErr(t, c.createFile("new", 0666, nil), lib9p.ErrDenied)
+
+	con, _ := net.Pipe()
+	defer con.Close()
+	_, err := srv.Attach(con, lib9p.AttachRequest{Fid: rootFid, Uname: "adm", Aname: "test:missing"})
+	checkErr(t, err, lib9p.ErrDenied)
+}
+
+func TestCursor(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.createFile("a", 0666, []byte("1")))
+	check(t, c.createFile("b", 0600, []byte("22")))
+	check(t, c.createFile("c", 0666, []byte("333")))
+	// No metadata, so anyone can read it
+	check(t, testFs(srv).db.Jar("d", []byte("4444")))
+	stat, err := c.stat("b")
+	check(t, err)
+	stat.Uid = "bob"
+	stat.Gid = "bob"
+	check(t, testFs(srv).meta.Save("b", stat))
+	before := snapshot(t, testFs(srv))
+
+	fid, err := c.open("cursor", lib9p.MRdwr)
+	check(t, err)
+	defer c.clunk(fid)
+	tests := []struct{ cmd, want string }{
+		{"first", "1 1\na1\n"},
+		{"next 2", "1 3\nc333\n1 4\nd4444\n"},
+		{"next 1", ""},
+		{"prev 3", "1 3\nc333\n1 1\na1\n"},
+		{"last", "1 4\nd4444\n"},
+		{"seek b", "1 3\nc333\n"},
+	}
+	for _, test := range tests {
+		check(t, c.write(fid, 0, []byte(test.cmd+"\n")))
+		got, err := c.read(fid, 0, 8192)
+		check(t, err)
+		if string(got) != test.want {
+			t.Errorf("%s gave %q, expected %q", test.cmd, got, test.want)
+		}
+	}
+	if after := snapshot(t, testFs(srv)); !reflect.DeepEqual(before, after) {
+		t.Fatalf("Moving the cursor changed the database from %v to %v", before, after)
+	}
+}
+
+func TestCursorPermissions(t *testing.T) {
+	srv := makeTestServer(t)
+	alice := attach(t, srv, "alice")
+	big := pattern(3*chunkSize, 0)
+	check(t, alice.createFile("big", 0644, big))
+	check(t, alice.mkdir("private", 0700))
+	check(t, alice.createFile("private/x", 0666, []byte("hidden")))
+	check(t, alice.mkdir("public", 0755))
+	check(t, alice.createFile("public/y", 0644, []byte("seen")))
+
+	bob := attach(t, srv, "bob")
+	fid, err := bob.open("cursor", lib9p.MRdwr)
+	check(t, err)
+	defer bob.clunk(fid)
+	readAll := func() []byte {
+		var out []byte
+		for {
+			data, err := bob.read(fid, 0, 8192)
+			check(t, err)
+			if len(data) == 0 {
+				return out
+			}
+			out = append(out, data...)
+
+			// Values go out a chunk at a time
+			cursor := srv.clients[bob.con].Fids[fid].Cursor
+			if len(cursor.Out) > chunkSize+8192 {
+				t.Fatalf("%d bytes of the cursor output are held", len(cursor.Out))
+			}
+		}
+	}
+
+	check(t, bob.write(fid, 0, []byte("first\n")))
+	want := append([]byte(fmt.Sprintf("3 %d\nbig", len(big))), big...)
+	want = append(want, '\n')
+	if got := readAll(); !bytes.Equal(got, want) {
+		t.Fatalf("Cursor gave %d bytes of the big value, expected %d", len(got), len(want))
+	}
+
+	// Keys under a directory bob can't walk into don't show up
+	check(t, bob.write(fid, 0, []byte("next 2\n")))
+	if got := readAll(); string(got) != "8 4\npublic/yseen\n" {
+		t.Fatalf("Cursor gave %q", got)
+	}
+	check(t, bob.write(fid, 0, []byte("seek private\n")))
+	if got := readAll(); string(got) != "8 4\npublic/yseen\n" {
+		t.Fatalf("Seeking gave %q", got)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	fid, err := c.open("events", lib9p.MRead)
+	check(t, err)
+	defer c.clunk(fid)
+
+	check(t, c.createFile("plain", 0666, []byte("1")))
+	check(t, c.createFile("two words", 0666, []byte("22")))
+	check(t, c.createFile("new\nline", 0666, nil))
+	data, err := c.read(fid, 0, 8192)
+	check(t, err)
+	// Creating jars an empty value, then the write gets committed
+	want := "jar plain 0\njar plain 1\n" +
+		"jar \"two words\" 0\njar \"two words\" 2\n" +
+		"jar \"new\\nline\" 0\njar \"new\\nline\" 0\n"
+	if string(data) != want {
+		t.Fatalf("Events are %q, expected %q", data, want)
+	}
+
+	// A flushed read doesn't wait for events
+	_, err = srv.Read(c.con, lib9p.ReadRequest{Fid: fid, Count: 8192, Flushed: func() bool { return true }})
+	checkErr(t, err, lib9p.ErrFlushed)
+}
+
+func TestParallelReads(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	check(t, c.createFile("plain", 0666, []byte("data")))
+	check(t, c.createFile("big", 0666, pattern(5*chunkSize, 0)))
+	plain, err := c.open("plain", lib9p.MRead)
+	check(t, err)
+	big, err := c.open("big", lib9p.MRead)
+	check(t, err)
+	dir, err := c.open("", lib9p.MRead)
+	check(t, err)
+
+	// Values and stats don't wait for other readers
+	srv.mutex.RLock()
+	done := make(chan error)
+	go func() {
+		_, err := c.read(plain, 0, 10)
+		if err == nil {
+			_, err = c.read(big, chunkSize-5, 10)
+		}
+		if err == nil {
+			_, err = srv.Stat(c.con, lib9p.StatRequest{Fid: plain})
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		check(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Reading a value waited for the lock")
+	}
+
+	// Anything that changes the fid does
+	go func() {
+		_, err := c.read(dir, 0, 8192)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("Reading a directory didn't wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	srv.mutex.RUnlock()
+	check(t, <-done)
+}
+
+func TestEventQueue(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	all, err := c.open("events", lib9p.MRead)
+	check(t, err)
+	defer c.clunk(all)
+	logs, err := c.open("events", lib9p.MRdwr)
+	check(t, err)
+	defer c.clunk(logs)
+	check(t, c.write(logs, 0, []byte("logs/\n")))
+
+	// Reads wait for something to happen
+	done := make(chan []byte)
+	go func() {
+		data, _ := c.read(logs, 0, 8192)
+		done <- data
+	}()
+	check(t, c.createFile("other", 0666, nil))
+	select {
+	case data := <-done:
+		t.Fatalf("Read returned %q before anything under the prefix changed", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+	check(t, c.mkdir("logs", 0777))
+	check(t, c.createFile("logs/a", 0666, nil))
+	select {
+	case data := <-done:
+		if !strings.HasPrefix(string(data), "jar logs/a 0\n") {
+			t.Fatalf("Read returned %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read didn't wake up")
+	}
+
+	// Changes past what the queue holds are dropped and reported
+	srv.mutex.Lock()
+	for i := 0; i < eventQueueSize; i++ {
+		ofs.notify("scoop", "k")
+	}
+	srv.mutex.Unlock()
+	data, err := c.read(all, 0, 1<<20)
+	check(t, err)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != eventQueueSize+1 || lines[0] != "overflow" || lines[1] != "jar other 0" {
+		t.Fatalf("Read %d lines after overflowing, starting with %q", len(lines), lines[:2])
+	}
+	if last := lines[len(lines)-1]; last != "scoop k" {
+		t.Fatalf("Last line is %q", last)
+	}
+}
+
+func TestQidBases(t *testing.T) {
+	srv := makeTestServer(t)
+	config := defaultConfig()
+	config.Backend = "memory"
+	config.DataDir = srv.dataRoot
+	check(t, config.validate())
+	config.apply()
+
+	// Numbers don't depend on which database gets to the server first
+	srv.mutex.Lock()
+	check(t, srv.createDatabase("other"))
+	want := srv.qidBase("other")
+	srv.mutex.Unlock()
+	again, err := makeServer(config)
+	check(t, err)
+	attachTo(t, again, "adm", "other:admin")
+	if got := again.qidBase("other"); got != want {
+		t.Fatalf("other got qid base %#x after a restart, expected %#x", got, want)
+	}
+	if again.qidBase("test") == want {
+		t.Fatal("test and other got the same qid base")
+	}
+
+	// Read-only servers number databases without writing it down
+	file := filepath.Join(srv.dataRoot, qidBasesFile)
+	before, err := os.ReadFile(file)
+	check(t, err)
+	config.ReadOnly = true
+	readOnly, err := makeServer(config)
+	check(t, err)
+	readOnly.qidBase("unknown")
+	if after, _ := os.ReadFile(file); !bytes.Equal(before, after) {
+		t.Fatalf("Read-only server changed %s from %q to %q", qidBasesFile, before, after)
+	}
+}
+
+func TestAttachCreates(t *testing.T) {
+	srv := makeTestServer(t)
+	con, _ := net.Pipe()
+	defer con.Close()
+	_, err := srv.Attach(con, lib9p.AttachRequest{Fid: rootFid, Uname: "glenda", Aname: "fresh"})
+	checkErr(t, err, lib9p.ErrNotFound)
+
+	attachTo(t, srv, "adm", "fresh:admin")
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if !srv.databaseExists("fresh") {
+		t.Fatal("Attaching with ctl didn't make the database")
+	}
+}
+
+func TestAppendOnly(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+
+	fid, err := c.create("log", 0666|lib9p.DmAppend)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("one")))
+	check(t, c.clunk(fid))
+	_, qid, err := c.walk("log")
+	check(t, err)
+	if qid.Type&lib9p.QtAppend == 0 {
+		t.Fatal("Append-only file doesn't have QtAppend")
+	}
+
+	// Writers don't overwrite each other, whatever offset they use
+	first, err := c.open("log", lib9p.MWrite)
+	check(t, err)
+	second, err := c.open("log", lib9p.MWrite)
+	check(t, err)
+	check(t, c.write(first, 0, []byte("two")))
+	check(t, c.write(second, 0, []byte("three")))
+	check(t, c.clunk(first))
+	check(t, c.clunk(second))
+	checkFile(t, c, "log", "onetwothree")
+
+	// Nor does truncating on open
+	fid, err = c.open("log", lib9p.MWrite|lib9p.MTrunc)
+	check(t, err)
+	check(t, c.write(fid, 1, []byte("four")))
+	check(t, c.clunk(fid))
+	checkFile(t, c, "log", "onetwothreefour")
+}
+
+func TestExclusiveUse(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "adm", "admin")
+	other := attach(t, srv, "glenda")
+	check(t, c.createFile("lock", 0666|lib9p.DmExcl, nil))
+
+	fid, err := c.open("lock", lib9p.MRead)
+	check(t, err)
+	_, err = c.open("lock", lib9p.MRead)
+	checkErr(t, err, lib9p.ErrInUse)
+	_, err = other.open("lock", lib9p.MWrite)
+	checkErr(t, err, lib9p.ErrInUse)
+
+	// A key of the same name in another database is another file
+	elsewhere := attachTo(t, srv, "adm", "other:admin")
+	check(t, elsewhere.createFile("lock", 0666|lib9p.DmExcl, nil))
+	_, err = elsewhere.open("lock", lib9p.MRead)
+	check(t, err)
+
+	check(t, c.clunk(fid))
+	fid, err = other.open("lock", lib9p.MWrite)
+	check(t, err)
+	check(t, other.clunk(fid))
+}
@@ -0,0 +1,362 @@
+/*
+   Tar export and import
+
+   Reading "export.tar" returns every key as a tar archive, carrying the
+   mode, mtime, owner and group from its metadata, plus an entry for every
+   directory made with mkdir. The archive is made as it's read, going
+   through the keys in order, so it has to be read sequentially (reading
+   at offset 0 again starts over) and it isn't a consistent copy of the
+   tree if it changes in the meantime.
+
+   Writing a tar archive to "import" jars every regular file in it and makes
+   every directory, restoring their metadata, as soon as each entry has been
+   fully written. Contents go straight into a write buffer, which spills its
+   full chunks as they come, so big entries are never held in memory. Existing
+   keys get replaced. Both files get around the usual permissions, so they're
+   only for adm.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* Longest header (with its extended records) import waits for */
+const importHeaderMax = 1 << 20
+
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += n
+	return n, err
+}
+
+/* What's been made of an archive being read */
+type Export struct {
+	out    bytes.Buffer // Made but not read past yet
+	writer *tar.Writer
+	read   uint64   // Offset of the start of out in the archive
+	from   string   // Where the key scan goes on
+	dirs   []string // Directories not written yet, sorted
+	name   string   // Entry whose contents are being written
+	size   uint64   // Its length in the header
+	pos    uint64   // How much of it is written
+	done   bool
+}
+
+func (ofs *OlegFs) makeExport() *Export {
+	e := new(Export)
+	e.writer = tar.NewWriter(&e.out)
+	for _, key := range ofs.meta.MarkedDirs("") {
+		if name, ok := userKey(key); ok {
+			e.dirs = append(e.dirs, name)
+		}
+	}
+	sort.Strings(e.dirs)
+	return e
+}
+
+func (ofs *OlegFs) exportRead(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+	if fid.Export == nil || offset == 0 && fid.Export.read > 0 {
+		fid.Export = ofs.makeExport()
+	}
+	e := fid.Export
+	if offset < e.read {
+		return nil, errors.New(lib9p.ErrBadOffset)
+	}
+
+	// What's before offset won't be read again
+	err := ofs.fillExport(e, offset-e.read+uint64(count))
+	if err != nil {
+		return nil, err
+	}
+	skip := offset - e.read
+	if skip > uint64(e.out.Len()) {
+		skip = uint64(e.out.Len())
+	}
+	e.out.Next(int(skip))
+	e.read += skip
+	return sliceData(e.out.Bytes(), 0, count), nil
+}
+
+/* Makes the archive until there's size bytes of it in out, or it's all there */
+func (ofs *OlegFs) fillExport(e *Export, size uint64) error {
+	if e.done {
+		return nil
+	}
+	err := ofs.exportContents(e, size)
+	if err != nil || uint64(e.out.Len()) >= size {
+		return err
+	}
+
+	for key := range ofs.db.RangeKeys(e.from, "") {
+		e.from = key + "\x00"
+		name, ok := userKey(key)
+		if !ok {
+			continue
+		}
+
+		// Directories get a trailing slash, which also sorts them before their contents
+		for len(e.dirs) > 0 && e.dirs[0]+"/" < name {
+			err = ofs.exportHeader(e, e.dirs[0], true)
+			e.dirs = e.dirs[1:]
+			if err != nil {
+				return err
+			}
+		}
+		err = ofs.exportHeader(e, name, false)
+		if err != nil {
+			return err
+		}
+		err = ofs.exportContents(e, size)
+		if err != nil || uint64(e.out.Len()) >= size {
+			return err
+		}
+	}
+
+	for _, dir := range e.dirs {
+		err = ofs.exportHeader(e, dir, true)
+		if err != nil {
+			return err
+		}
+	}
+	e.dirs = nil
+	e.done = true
+	return e.writer.Close()
+}
+
+func (ofs *OlegFs) exportHeader(e *Export, name string, isDir bool) error {
+	stat, err := ofs.getMeta(strings.Split(name, "/"))
+	if err != nil && err.Error() == lib9p.ErrNotFound {
+		// Gone (expired?) while we were at it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(stat.Mode & 0777),
+		Uname:   stat.Uid,
+		Gname:   stat.Gid,
+		ModTime: time.Unix(int64(stat.Mtime), 0),
+	}
+	if isDir {
+		header.Name += "/"
+		header.Typeflag = tar.TypeDir
+	} else {
+		header.Typeflag = tar.TypeReg
+		header.Size = int64(stat.Length)
+		e.name = name
+		e.size = uint64(header.Size)
+		e.pos = 0
+	}
+	return e.writer.WriteHeader(header)
+}
+
+/* Writes what's left of the contents of the current entry, a chunk at a time */
+func (ofs *OlegFs) exportContents(e *Export, size uint64) error {
+	for e.pos < e.size && uint64(e.out.Len()) < size {
+		count := rangeEnd(e.pos, chunkSize, e.size) - e.pos
+		data, err := ofs.readRange(dataKey(e.name), e.pos, count)
+		if err != nil && err.Error() != lib9p.ErrNotFound {
+			return err
+		}
+		// The header is out already, whatever happened to the value since
+		if uint64(len(data)) < count {
+			data = append(data, make([]byte, count-uint64(len(data)))...)
+		}
+		_, err = e.writer.Write(data[:count])
+		if err != nil {
+			return err
+		}
+		e.pos += count
+	}
+	return nil
+}
+
+/* What's been handled of an archive being written */
+type Import struct {
+	header    []byte       // Start of a header that isn't complete yet
+	entry     *tar.Header  // Entry whose contents are being written
+	buffer    *WriteBuffer // Where they go, nil if they're not kept
+	remaining uint64       // Contents still to come
+	padding   uint64       // Then padding up to the next header
+	done      bool
+}
+
+func (ofs *OlegFs) importWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	if fid.Import == nil {
+		fid.Import = new(Import)
+	}
+	err := ofs.importData(client, fid.Import, data)
+	if err != nil {
+		fid.Import = nil
+		return 0, err
+	}
+	return uint32(len(data)), nil
+}
+
+func (ofs *OlegFs) importData(client *Client, im *Import, data []byte) error {
+	for len(data) > 0 && !im.done {
+		switch {
+		case im.entry != nil:
+			n := uint64(len(data))
+			if n > im.remaining {
+				n = im.remaining
+			}
+			if im.buffer != nil {
+				offset := uint64(im.entry.Size) - im.remaining
+				ofs.writeBuffer(im.buffer, offset, data[:n])
+				err := ofs.spillBuffer(im.buffer, offset+n)
+				if err != nil {
+					return err
+				}
+			}
+			data = data[n:]
+			im.remaining -= n
+			if im.remaining == 0 {
+				err := ofs.importEntry(client, im)
+				if err != nil {
+					return err
+				}
+			}
+		case im.padding > 0:
+			n := uint64(len(data))
+			if n > im.padding {
+				n = im.padding
+			}
+			data = data[n:]
+			im.padding -= n
+		default:
+			// Headers can span several writes, keep what we can't use yet around
+			im.header = append(im.header, data...)
+			counter := &countingReader{r: bytes.NewReader(im.header)}
+			header, err := tar.NewReader(counter).Next()
+			if err == io.ErrUnexpectedEOF {
+				if len(im.header) > importHeaderMax {
+					return tar.ErrFieldTooLong
+				}
+				return nil
+			}
+			if err == io.EOF {
+				// End of the archive, whatever comes after is padding
+				im.done = true
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			data = im.header[counter.n:]
+			im.header = nil
+			err = ofs.startEntry(client, im, header)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func importName(header *tar.Header) string {
+	return strings.Trim(path.Clean("/"+header.Name), "/")
+}
+
+func (ofs *OlegFs) startEntry(client *Client, im *Import, header *tar.Header) error {
+	im.entry = header
+	im.buffer = nil
+	im.remaining = uint64(header.Size)
+	im.padding = (512 - im.remaining%512) % 512
+
+	name := importName(header)
+	if name != "" {
+		err := ofs.checkKeyLength(pathKey(strings.Split(name, "/")))
+		if err != nil {
+			return err
+		}
+	}
+	if name != "" && header.Typeflag == tar.TypeReg {
+		if im.remaining > ofs.maxSize {
+			return errors.New(lib9p.ErrTooBig)
+		}
+		im.buffer = ofs.openBuffer(pathKey(strings.Split(name, "/")), true)
+	}
+	if im.remaining == 0 {
+		return ofs.importEntry(client, im)
+	}
+	return nil
+}
+
+/* Finishes the entry whose contents have all been written */
+func (ofs *OlegFs) importEntry(client *Client, im *Import) error {
+	header := im.entry
+	buffer := im.buffer
+	im.entry = nil
+	im.buffer = nil
+
+	name := importName(header)
+	if name == "" {
+		return nil
+	}
+	elements := strings.Split(name, "/")
+	key := pathKey(elements)
+
+	// Anything the archive brings in is created like any other file
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if !ofs.isDir(key) {
+			_, err := ofs.meta.NewPathId(key + "/")
+			if err != nil {
+				return err
+			}
+		}
+		err := ofs.meta.MarkDir(key)
+		if err != nil {
+			return err
+		}
+		key += "/"
+	case tar.TypeReg:
+		if !exists(ofs.db, key) {
+			_, err := ofs.meta.NewPathId(key)
+			if err != nil {
+				return err
+			}
+		}
+		err := ofs.commitBuffer(buffer)
+		if err != nil {
+			return err
+		}
+	default:
+		// Links and devices have no place in a key-value store
+		return nil
+	}
+
+	stat, err := ofs.getMeta(elements)
+	if err != nil {
+		return err
+	}
+	stat.Mode = stat.Mode&^0777 | uint32(header.Mode)&0777
+	if header.Uname != "" {
+		stat.Uid = header.Uname
+	}
+	if header.Gname != "" {
+		stat.Gid = header.Gname
+	}
+	stat.Mtime = uint32(header.ModTime.Unix())
+	stat.Muid = client.Uname
+	stat.Qid.Version++
+	return ofs.meta.Save(key, stat)
+}
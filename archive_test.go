@@ -0,0 +1,130 @@
+package main
+
+import (
+	"./lib9p"
+	"archive/tar"
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "adm", "admin")
+	big := pattern(2*chunkSize+100, 1)
+	check(t, c.mkdir("dir", 0775))
+	check(t, c.createFile("dir/big", 0640, big))
+	check(t, c.createFile("small", 0666, []byte("hello")))
+	check(t, c.mkdir("empty", 0775))
+
+	// Small reads make the archive a bit at a time
+	archive, err := c.readFile("export.tar")
+	check(t, err)
+	reader := tar.NewReader(bytes.NewReader(archive))
+	want := []struct {
+		name string
+		mode int64
+		data []byte
+	}{
+		{"dir/", 0775, nil},
+		{"dir/big", 0640, big},
+		{"empty/", 0775, nil},
+		{"small", 0666, []byte("hello")},
+	}
+	for _, entry := range want {
+		header, err := reader.Next()
+		check(t, err)
+		data, err := io.ReadAll(reader)
+		check(t, err)
+		if header.Name != entry.name || header.Mode != entry.mode || !bytes.Equal(data, entry.data) {
+			t.Fatalf("Entry %q (mode %o, %d bytes), expected %q (mode %o, %d bytes)",
+				header.Name, header.Mode, len(data), entry.name, entry.mode, len(entry.data))
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("Archive goes on after the last entry: %v", err)
+	}
+
+	fid, err := c.open("export.tar", lib9p.MRead)
+	check(t, err)
+	defer c.clunk(fid)
+	first, err := c.read(fid, 0, 8192)
+	check(t, err)
+	_, err = c.read(fid, 8192, 8192)
+	check(t, err)
+	_, err = c.read(fid, 100, 8192)
+	checkErr(t, err, lib9p.ErrBadOffset)
+
+	// Offset 0 starts over
+	again, err := c.read(fid, 0, 8192)
+	check(t, err)
+	if !bytes.Equal(first, again) {
+		t.Fatal("Reading from 0 again gave a different archive")
+	}
+}
+
+func TestImport(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "adm", "admin")
+	ofs := testFs(srv)
+	big := pattern(5*chunkSize+123, 2)
+
+	var archive bytes.Buffer
+	writer := tar.NewWriter(&archive)
+	entries := []struct {
+		header tar.Header
+		data   []byte
+	}{
+		{tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0755, Uname: "bob"}, nil},
+		{tar.Header{Name: "dir/big", Typeflag: tar.TypeReg, Mode: 0600, Uname: "adm", Size: int64(len(big))}, big},
+		{tar.Header{Name: "empty", Typeflag: tar.TypeReg, Mode: 0644}, nil},
+		{tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "empty"}, nil},
+		{tar.Header{Name: "small", Typeflag: tar.TypeReg, Mode: 0644, Size: 5}, []byte("hello")},
+	}
+	for _, entry := range entries {
+		entry.header.ModTime = time.Unix(1000, 0)
+		check(t, writer.WriteHeader(&entry.header))
+		_, err := writer.Write(entry.data)
+		check(t, err)
+	}
+	check(t, writer.Close())
+
+	fid, err := c.open("import", lib9p.MWrite)
+	check(t, err)
+	data := archive.Bytes()
+	halfway := false
+	for offset := 0; offset < len(data); offset += 100000 {
+		end := min(offset+100000, len(data))
+		check(t, c.write(fid, uint64(offset), data[offset:end]))
+
+		// Chunks spilled on the way belong to the import until it's done
+		if !halfway && offset > 3*chunkSize {
+			halfway = true
+			if len(chunkKeys(t, ofs)) == 0 {
+				t.Fatal("Nothing spilled halfway through a big entry")
+			}
+			if removed := ofs.collectChunks(); removed != 0 {
+				t.Fatalf("Collected %d chunks of an import", removed)
+			}
+		}
+	}
+	check(t, c.clunk(fid))
+
+	got, err := c.readFile("dir/big")
+	check(t, err)
+	if !bytes.Equal(got, big) {
+		t.Fatal("Big entry came out different")
+	}
+	checkFile(t, c, "small", "hello")
+	checkFile(t, c, "empty", "")
+	checkList(t, c, "", append(synthNames, "dir", "empty", "small")...)
+	stat, err := c.stat("dir")
+	check(t, err)
+	if stat.Mode&0777 != 0755 || stat.Uid != "bob" || stat.Mtime != 1000 {
+		t.Fatalf("Stat of imported directory is %+v", stat)
+	}
+	if removed := ofs.collectChunks(); removed != 0 {
+		t.Fatalf("Import left %d chunks behind", removed)
+	}
+}
@@ -0,0 +1,133 @@
+/*
+   Read cache
+
+   Unjarring means decompressing the whole value, so we don't want to do it
+   for every read. Values are kept in a size bounded LRU shared by every
+   connection, and every fid opened for reading gets its own snapshot so
+   sequential reads only cost one lookup.
+
+   Everything that changes a value in the database must go through jarData
+   and scoopData so the cache never serves stale data.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"container/list"
+	"errors"
+	"sync"
+)
+
+const defaultCacheSize = 64 << 20
+
+type ReadCache struct {
+	mutex    sync.Mutex
+	capacity int
+	size     int
+	entries  map[string]*list.Element
+	order    *list.List // Most recently used first
+	hits     uint64
+	misses   uint64
+}
+
+type cacheEntry struct {
+	key   string
+	value []byte
+}
+
+func makeReadCache(capacity int) *ReadCache {
+	return &ReadCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+func (c *ReadCache) Get(key string) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).value, true
+}
+
+func (c *ReadCache) Put(key string, value []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	// Values that would push everything else out aren't worth it
+	if len(value) > c.capacity/4 {
+		return
+	}
+
+	c.remove(key)
+	c.entries[key] = c.order.PushFront(&cacheEntry{key, value})
+	c.size += len(value)
+
+	for c.size > c.capacity {
+		c.remove(c.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+func (c *ReadCache) Invalidate(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.remove(key)
+}
+
+func (c *ReadCache) remove(key string) {
+	elem, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.size -= len(elem.Value.(*cacheEntry).value)
+	c.order.Remove(elem)
+	delete(c.entries, key)
+}
+
+func (c *ReadCache) Stats() (hits, misses uint64, size, capacity int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.hits, c.misses, c.size, c.capacity
+}
+
+/* Cached values are shared, callers must never modify them */
+
+func (ofs *OlegFs) readData(key string) ([]byte, error) {
+	// Keys can expire without us knowing
+	ok, err := ofs.db.Exists(key)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	if !ok {
+		ofs.cache.Invalidate(key)
+		return nil, errors.New(lib9p.ErrNotFound)
+	}
+
+	if value, ok := ofs.cache.Get(key); ok {
+		return value, nil
+	}
+	value, err := ofs.db.Unjar(key)
+	if err != nil {
+		return nil, storeError(err)
+	}
+	ofs.cache.Put(key, value)
+	return value, nil
+}
+
+func (ofs *OlegFs) jarData(key string, value []byte) error {
+	ofs.cache.Invalidate(key)
+	return storeError(ofs.db.Jar(key, value))
+}
+
+func (ofs *OlegFs) scoopData(key string) error {
+	ofs.cache.Invalidate(key)
+	return storeError(ofs.db.Scoop(key))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type cacheOp struct {
+	op, key, value string
+}
+
+// Keys in the cache, most recently used first
+func cacheKeys(c *ReadCache) []string {
+	keys := make([]string, 0)
+	for elem := c.order.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*cacheEntry).key)
+	}
+	return keys
+}
+
+func TestReadCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		capacity int
+		ops      []cacheOp
+		keys     []string
+		size     int
+		hits     uint64
+		misses   uint64
+	}{
+		{
+			name:     "empty",
+			capacity: 100,
+			ops:      []cacheOp{{"get", "a", ""}},
+			keys:     []string{},
+			misses:   1,
+		},
+		{
+			name:     "put and get",
+			capacity: 100,
+			ops:      []cacheOp{{"put", "a", "aaaa"}, {"put", "b", "bb"}, {"get", "a", "aaaa"}, {"get", "c", ""}},
+			keys:     []string{"a", "b"},
+			size:     6,
+			hits:     1,
+			misses:   1,
+		},
+		{
+			name:     "oldest goes first",
+			capacity: 40,
+			ops:      []cacheOp{{"put", "a", "0123456789"}, {"put", "b", "0123456789"}, {"put", "c", "0123456789"}, {"put", "d", "0123456789"}, {"put", "e", "0123456789"}},
+			keys:     []string{"e", "d", "c", "b"},
+			size:     40,
+		},
+		{
+			name:     "gets keep keys around",
+			capacity: 40,
+			ops:      []cacheOp{{"put", "a", "0123456789"}, {"put", "b", "0123456789"}, {"put", "c", "0123456789"}, {"put", "d", "0123456789"}, {"get", "a", "0123456789"}, {"put", "e", "0123456789"}},
+			keys:     []string{"e", "a", "d", "c"},
+			size:     40,
+			hits:     1,
+		},
+		{
+			name:     "replacing a value",
+			capacity: 100,
+			ops:      []cacheOp{{"put", "a", "short"}, {"put", "b", "bb"}, {"put", "a", "much longer"}, {"get", "a", "much longer"}},
+			keys:     []string{"a", "b"},
+			size:     13,
+			hits:     1,
+		},
+		{
+			name:     "too big to bother",
+			capacity: 40,
+			ops:      []cacheOp{{"put", "a", "0123456789"}, {"put", "big", "01234567890"}, {"get", "big", ""}},
+			keys:     []string{"a"},
+			size:     10,
+			misses:   1,
+		},
+		{
+			name:     "invalidation",
+			capacity: 100,
+			ops:      []cacheOp{{"put", "a", "aaaa"}, {"put", "b", "bb"}, {"invalidate", "a", ""}, {"invalidate", "missing", ""}, {"get", "a", ""}},
+			keys:     []string{"b"},
+			size:     2,
+			misses:   1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := makeReadCache(test.capacity)
+			for _, op := range test.ops {
+				switch op.op {
+				case "put":
+					c.Put(op.key, []byte(op.value))
+				case "get":
+					value, ok := c.Get(op.key)
+					if ok != (op.value != "") || string(value) != op.value {
+						t.Fatalf("Get(%q) is %q, %v, expected %q", op.key, value, ok, op.value)
+					}
+				case "invalidate":
+					c.Invalidate(op.key)
+				}
+			}
+			if keys := cacheKeys(c); !reflect.DeepEqual(keys, test.keys) {
+				t.Errorf("Keys are %v, expected %v", keys, test.keys)
+			}
+			hits, misses, size, capacity := c.Stats()
+			if hits != test.hits || misses != test.misses || size != test.size || capacity != test.capacity {
+				t.Errorf("Stats are %d hits %d misses %d/%d bytes, expected %d hits %d misses %d/%d bytes",
+					hits, misses, size, capacity, test.hits, test.misses, test.size, test.capacity)
+			}
+		})
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	srv := makeTestServer(t)
+	ofs := testFs(srv)
+	check(t, ofs.jarData("key", []byte("first")))
+
+	tests := []struct {
+		name   string
+		change func() error
+		want   string
+	}{
+		{"jar", func() error { return ofs.jarData("key", []byte("second")) }, "second"},
+		{"scoop", func() error { return ofs.scoopData("key") }, ""},
+		{"jar again", func() error { return ofs.jarData("key", []byte("third")) }, "third"},
+		// Behind OlegFs' back, like an expiration
+		{"gone", func() error { return ofs.db.Scoop("key") }, ""},
+	}
+	for _, test := range tests {
+		_, err := ofs.readData("key")
+		check(t, err)
+		if _, ok := ofs.cache.Get("key"); !ok {
+			t.Fatalf("%s: value isn't cached", test.name)
+		}
+		check(t, test.change())
+		value, err := ofs.readData("key")
+		if test.want != "" && string(value) != test.want {
+			t.Fatalf("%s: read %q, expected %q", test.name, value, test.want)
+		}
+		if test.want == "" {
+			// Gone, not empty
+			checkErr(t, err, lib9p.ErrNotFound)
+			check(t, ofs.jarData("key", []byte(strings.ToUpper(test.name))))
+		}
+	}
+}
+
+// Fails every read of a key starting with prefix
+type unreadableStore struct {
+	Store
+	prefix string
+}
+
+func (s unreadableStore) Unjar(key string) ([]byte, error) {
+	if strings.HasPrefix(key, s.prefix) {
+		return nil, errors.New("failing on purpose")
+	}
+	return s.Store.Unjar(key)
+}
+
+func (s unreadableStore) GetSize(key string) (int, error) {
+	if strings.HasPrefix(key, s.prefix) {
+		return 0, errors.New("failing on purpose")
+	}
+	return s.Store.GetSize(key)
+}
+
+func TestReadErrors(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	check(t, c.createFile("plain", 0666, []byte("data")))
+	check(t, c.createFile("big", 0666, pattern(5*chunkSize, 0)))
+
+	// Values that can't be read aren't empty
+	store := ofs.db
+	ofs.db = unreadableStore{store, "plain"}
+	ofs.cache = makeReadCache(defaultCacheSize)
+	_, err := c.readFile("plain")
+	checkErr(t, err, lib9p.ErrIO)
+	_, err = c.stat("plain")
+	checkErr(t, err, lib9p.ErrIO)
+	ofs.db = store
+
+	// Nor are missing chunks zeros
+	check(t, ofs.db.Scoop(chunkKeys(t, ofs)[1]))
+	ofs.cache = makeReadCache(defaultCacheSize)
+	_, err = c.readFile("big")
+	checkErr(t, err, lib9p.ErrIO)
+}
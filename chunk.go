@@ -0,0 +1,516 @@
+/*
+   Chunked storage
+
+   Values bigger than chunkThreshold are split into chunkSize pieces, each
+   jarred under its own key, plus a manifest with the total length. The key
+   itself stays around (empty) so it shows up like any other. Reads only
+   unjar the chunks they touch, and commits only jar the chunks that changed.
+
+   Every commit jars its chunks under a new generation, next to the ones
+   the manifest points to, and only then saves the manifest saying which
+   generation every chunk is at. A commit that doesn't get that far leaves
+   the old value alone, and collectChunks cleans up after it. Buffers that
+   get big can spill their full chunks under that generation before the
+   commit, so they don't have to hold the whole value.
+
+   Files open for writing keep their changes in a WriteBuffer, which works
+   in chunks no matter how the value is stored, and decides the layout when
+   it's committed.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	chunkSize      = 1 << 20
+	chunkThreshold = 4 << 20
+)
+
+const (
+	manifestPrefix    = reservedPrefix + "manifest_" // JSON encoded Manifest of a key
+	chunkPrefix       = reservedPrefix + "chunk_"    // Chunks of a key, see chunkKey
+	generationCounter = reservedPrefix + "nextgen_"  // Next free chunk generation
+)
+
+type Manifest struct {
+	Length     uint64
+	ChunkSize  uint64
+	Generation uint64   // Of the last commit
+	Chunks     []uint64 // Generation of every chunk, missing for 0
+}
+
+type WriteBuffer struct {
+	Key        string
+	Length     uint64
+	base       []byte            // Value at open time, unless stored in chunks
+	baseLength uint64            // Base data past this was truncated away
+	chunked    bool              // Base is stored in chunks
+	chunks     map[uint64][]byte // Chunks that have been written to
+	generation uint64            // Of the next commit, once chunks have been spilled
+	spilled    map[uint64]bool   // Written chunks jarred ahead of the commit
+}
+
+func chunkKey(key string, index, generation uint64) string {
+	name := chunkPrefix + key + "/" + strconv.FormatUint(index, 10)
+	if generation > 0 {
+		// Generation 0 is from before there were any
+		name += "." + strconv.FormatUint(generation, 10)
+	}
+	return name
+}
+
+/* Generations are never reused, not even by commits of different keys */
+func (ofs *OlegFs) newGeneration(key string) (uint64, error) {
+	next, ok := ofs.meta.loadCounter(generationCounter)
+	if !ok || next < 1 {
+		next = 1
+	}
+	// Manifests from before the counter counted on their own
+	if manifest, ok := ofs.loadManifest(key); ok && manifest.Generation >= next {
+		next = manifest.Generation + 1
+	}
+	err := ofs.jarData(generationCounter, []byte(strconv.FormatUint(next+1, 10)))
+	if err != nil {
+		return 0, err
+	}
+	return next, nil
+}
+
+func (m Manifest) chunkGeneration(index uint64) uint64 {
+	if index < uint64(len(m.Chunks)) {
+		return m.Chunks[index]
+	}
+	return 0
+}
+
+func (m Manifest) chunkKey(key string, index uint64) string {
+	return chunkKey(key, index, m.chunkGeneration(index))
+}
+
+/* Number of chunks in a value of the given length */
+func chunkCount(length, size uint64) uint64 {
+	return (length + size - 1) / size
+}
+
+/* Size of chunk number index in a value of the given length */
+func chunkLen(length, index uint64) uint64 {
+	start := index * chunkSize
+	if start >= length {
+		return 0
+	}
+	if length-start < chunkSize {
+		return length - start
+	}
+	return chunkSize
+}
+
+func (ofs *OlegFs) loadManifest(key string) (manifest Manifest, ok bool) {
+	data, err := ofs.db.Unjar(manifestPrefix + key)
+	if err != nil {
+		return
+	}
+	ok = json.Unmarshal(data, &manifest) == nil && manifest.ChunkSize > 0
+	return
+}
+
+func (ofs *OlegFs) saveManifest(key string, manifest Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return ofs.jarData(manifestPrefix+key, data)
+}
+
+func (ofs *OlegFs) dataSize(key string) (uint64, error) {
+	if manifest, ok := ofs.loadManifest(key); ok {
+		return manifest.Length, nil
+	}
+	size, err := ofs.db.GetSize(key)
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return uint64(size), nil
+}
+
+/* The end of count bytes from offset, in a value of the given length */
+func rangeEnd(offset, count, length uint64) uint64 {
+	if offset < length && count < length-offset {
+		return offset + count
+	}
+	return length
+}
+
+func (ofs *OlegFs) readRange(key string, offset, count uint64) ([]byte, error) {
+	manifest, chunked := ofs.loadManifest(key)
+	if !chunked {
+		data, err := ofs.readData(key)
+		if err != nil {
+			return nil, err
+		}
+		if offset > uint64(len(data)) {
+			return make([]byte, 0), nil
+		}
+		return data[offset:rangeEnd(offset, count, uint64(len(data)))], nil
+	}
+	if !exists(ofs.db, key) {
+		return nil, errors.New(lib9p.ErrNotFound)
+	}
+
+	end := rangeEnd(offset, count, manifest.Length)
+	out := make([]byte, 0)
+	for pos := offset; pos < end; {
+		index := pos / manifest.ChunkSize
+		start := index * manifest.ChunkSize
+		limit := start + manifest.ChunkSize
+		if limit > end {
+			limit = end
+		}
+
+		chunk, err := ofs.readChunk(manifest, key, index)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk[pos-start:limit-start]...)
+		pos = limit
+	}
+	return out, nil
+}
+
+/* A chunk the manifest lists that's missing or short is broken, not empty */
+func (ofs *OlegFs) readChunk(manifest Manifest, key string, index uint64) ([]byte, error) {
+	chunk, err := ofs.readData(manifest.chunkKey(key, index))
+	if err != nil && err.Error() != lib9p.ErrNotFound {
+		return nil, err
+	}
+	start := index * manifest.ChunkSize
+	if err != nil || uint64(len(chunk)) < rangeEnd(start, manifest.ChunkSize, manifest.Length)-start {
+		logf(LogError, "chunk %d of %s is missing or short", index, key)
+		return nil, errors.New(lib9p.ErrIO)
+	}
+	return chunk, nil
+}
+
+/* Whole value, no matter how it's stored. Only for values known to be small */
+func (ofs *OlegFs) readValue(key string) ([]byte, error) {
+	size, err := ofs.dataSize(key)
+	if err != nil {
+		return nil, err
+	}
+	return ofs.readRange(key, 0, size)
+}
+
+func (ofs *OlegFs) dropChunks(key string) {
+	manifest, ok := ofs.loadManifest(key)
+	if !ok {
+		return
+	}
+	// Without the manifest the chunks are garbage, whether or not they're gone
+	ofs.scoopData(manifestPrefix + key)
+	for index := uint64(0); index < chunkCount(manifest.Length, manifest.ChunkSize); index++ {
+		ofs.scoopData(manifest.chunkKey(key, index))
+	}
+}
+
+func (ofs *OlegFs) openBuffer(key string, truncate bool) *WriteBuffer {
+	buf := &WriteBuffer{
+		Key:     key,
+		chunks:  make(map[uint64][]byte),
+		spilled: make(map[uint64]bool),
+	}
+	if truncate {
+		return buf
+	}
+
+	manifest, ok := ofs.loadManifest(key)
+	if ok && manifest.ChunkSize == chunkSize {
+		buf.chunked = true
+		buf.Length = manifest.Length
+	} else {
+		buf.base, _ = ofs.readValue(key)
+		buf.Length = uint64(len(buf.base))
+	}
+	buf.baseLength = buf.Length
+	return buf
+}
+
+/* Current contents of a chunk, sized to fit the buffer length */
+func (ofs *OlegFs) bufferChunk(buf *WriteBuffer, index uint64) []byte {
+	if chunk, ok := buf.chunks[index]; ok {
+		return chunk
+	}
+
+	chunk := make([]byte, chunkLen(buf.Length, index))
+	if buf.spilled[index] {
+		data, _ := ofs.readData(chunkKey(buf.Key, index, buf.generation))
+		copy(chunk, data)
+		return chunk
+	}
+	start := index * chunkSize
+	if start < buf.baseLength {
+		end := start + chunkSize
+		if end > buf.baseLength {
+			end = buf.baseLength
+		}
+		var data []byte
+		if buf.chunked {
+			// Whatever is committed now, like for plain values
+			manifest, _ := ofs.loadManifest(buf.Key)
+			data, _ = ofs.readData(manifest.chunkKey(buf.Key, index))
+		} else {
+			data = buf.base[start:]
+		}
+		if uint64(len(data)) > end-start {
+			data = data[:end-start]
+		}
+		copy(chunk, data)
+	}
+	return chunk
+}
+
+func (ofs *OlegFs) readBuffer(buf *WriteBuffer, offset, count uint64) []byte {
+	end := rangeEnd(offset, count, buf.Length)
+	out := make([]byte, 0)
+	for pos := offset; pos < end; {
+		index := pos / chunkSize
+		start := index * chunkSize
+		chunk := ofs.bufferChunk(buf, index)
+		limit := uint64(len(chunk))
+		if start+limit > end {
+			limit = end - start
+		}
+		out = append(out, chunk[pos-start:limit]...)
+		pos = start + limit
+	}
+	return out
+}
+
+func (ofs *OlegFs) writeBuffer(buf *WriteBuffer, offset uint64, data []byte) {
+	end := offset + uint64(len(data))
+	if end > buf.Length {
+		ofs.resizeBuffer(buf, end)
+	}
+	for pos := offset; pos < end; {
+		index := pos / chunkSize
+		chunk := ofs.bufferChunk(buf, index)
+		n := copy(chunk[pos-index*chunkSize:], data[pos-offset:])
+		buf.chunks[index] = chunk
+		pos += uint64(n)
+	}
+}
+
+func (ofs *OlegFs) resizeBuffer(buf *WriteBuffer, length uint64) {
+	if length < buf.baseLength {
+		buf.baseLength = length
+	}
+	// Only full chunks are spilled, any other size goes back in memory
+	for index := range buf.spilled {
+		if chunkLen(length, index) == chunkSize {
+			continue
+		}
+		if chunkLen(length, index) > 0 {
+			buf.chunks[index] = ofs.bufferChunk(buf, index)
+		}
+		ofs.scoopData(chunkKey(buf.Key, index, buf.generation))
+		delete(buf.spilled, index)
+	}
+	for index, chunk := range buf.chunks {
+		size := chunkLen(length, index)
+		if size == 0 {
+			delete(buf.chunks, index)
+		} else if size != uint64(len(chunk)) {
+			resized := make([]byte, size)
+			copy(resized, chunk)
+			buf.chunks[index] = resized
+		}
+	}
+	buf.Length = length
+}
+
+/* Jars the full chunks before offset, that the buffer isn't expected to touch again */
+func (ofs *OlegFs) spillBuffer(buf *WriteBuffer, offset uint64) error {
+	for index, chunk := range buf.chunks {
+		if (index+1)*chunkSize > offset || uint64(len(chunk)) != chunkSize {
+			continue
+		}
+		if buf.generation == 0 {
+			generation, err := ofs.newGeneration(buf.Key)
+			if err != nil {
+				return err
+			}
+			buf.generation = generation
+		}
+		err := ofs.jarData(chunkKey(buf.Key, index, buf.generation), chunk)
+		if err != nil {
+			return err
+		}
+		buf.spilled[index] = true
+		delete(buf.chunks, index)
+	}
+	return nil
+}
+
+func (ofs *OlegFs) commitBuffer(buf *WriteBuffer) error {
+	key := buf.Key
+	// A manifest without its key is from one that expired, not the base
+	if !exists(ofs.db, key) {
+		ofs.dropChunks(key)
+	}
+	manifest, wasChunked := ofs.loadManifest(key)
+
+	if buf.Length <= chunkThreshold {
+		// Small enough for a single value
+		value := ofs.readBuffer(buf, 0, buf.Length)
+		err := ofs.jarData(key, value)
+		if err != nil {
+			return err
+		}
+		// The manifest still wins over the value until it's gone
+		if wasChunked {
+			ofs.dropChunks(key)
+		}
+		for index := range buf.spilled {
+			ofs.scoopData(chunkKey(key, index, buf.generation))
+		}
+		buf.resetPlain(value)
+		ofs.notify("jar", key, strconv.FormatUint(buf.Length, 10))
+		return nil
+	}
+
+	// Only chunks that changed need to be jarred, unless the layout did too
+	intact := buf.chunked && wasChunked && manifest.ChunkSize == chunkSize
+	if buf.generation == 0 {
+		generation, err := ofs.newGeneration(key)
+		if err != nil {
+			return err
+		}
+		buf.generation = generation
+	}
+	committed := Manifest{
+		Length:     buf.Length,
+		ChunkSize:  chunkSize,
+		Generation: buf.generation,
+		Chunks:     make([]uint64, chunkCount(buf.Length, chunkSize)),
+	}
+	for index := range committed.Chunks {
+		index := uint64(index)
+		chunk, modified := buf.chunks[index]
+		if !modified && buf.spilled[index] {
+			committed.Chunks[index] = committed.Generation
+			continue
+		}
+		if !modified {
+			stored := chunkLen(manifest.Length, index)
+			wanted := chunkLen(buf.Length, index)
+			if intact && stored == wanted && index*chunkSize+wanted <= buf.baseLength {
+				committed.Chunks[index] = manifest.chunkGeneration(index)
+				continue
+			}
+			chunk = ofs.bufferChunk(buf, index)
+		}
+		err := ofs.jarData(chunkKey(key, index, committed.Generation), chunk)
+		if err != nil {
+			return err
+		}
+		committed.Chunks[index] = committed.Generation
+	}
+
+	// This is where the new value takes over
+	err := ofs.saveManifest(key, committed)
+	if err != nil {
+		return err
+	}
+	if wasChunked {
+		for index := uint64(0); index < chunkCount(manifest.Length, manifest.ChunkSize); index++ {
+			if index >= uint64(len(committed.Chunks)) || committed.Chunks[index] != manifest.chunkGeneration(index) {
+				ofs.scoopData(manifest.chunkKey(key, index))
+			}
+		}
+	} else {
+		// The plain value isn't needed any more
+		err := ofs.jarData(key, []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	buf.resetChunked()
+	ofs.notify("jar", key, strconv.FormatUint(buf.Length, 10))
+	return nil
+}
+
+/* After a commit, the committed contents become the new base */
+
+func (buf *WriteBuffer) resetPlain(value []byte) {
+	buf.base = value
+	buf.chunked = false
+	buf.baseLength = buf.Length
+	buf.chunks = make(map[uint64][]byte)
+	buf.generation = 0
+	buf.spilled = make(map[uint64]bool)
+}
+
+func (buf *WriteBuffer) resetChunked() {
+	buf.base = nil
+	buf.chunked = true
+	buf.baseLength = buf.Length
+	buf.chunks = make(map[uint64][]byte)
+	buf.generation = 0
+	buf.spilled = make(map[uint64]bool)
+}
+
+/* Chunks jarred by buffers that haven't been committed yet */
+func (ofs *OlegFs) spilledChunks() map[string]bool {
+	spilled := make(map[string]bool)
+	for _, client := range ofs.clients {
+		for _, fid := range client.Fids {
+			buffers := []*WriteBuffer{fid.Buffer}
+			if fid.Import != nil {
+				buffers = append(buffers, fid.Import.buffer)
+			}
+			for _, buf := range buffers {
+				if buf == nil || fid.Fs != ofs {
+					continue
+				}
+				for index := range buf.spilled {
+					spilled[chunkKey(buf.Key, index, buf.generation)] = true
+				}
+			}
+		}
+	}
+	return spilled
+}
+
+/* Chunks and manifests whose key is gone, and chunks no manifest or buffer points to */
+func (ofs *OlegFs) collectChunks() (removed int) {
+	manifests, _ := ofs.db.PrefixMatch(manifestPrefix)
+	for _, manifest := range manifests {
+		if !exists(ofs.db, manifest[len(manifestPrefix):]) {
+			ofs.scoopData(manifest)
+			removed++
+		}
+	}
+
+	spilled := ofs.spilledChunks()
+	chunks, _ := ofs.db.PrefixMatch(chunkPrefix)
+	for _, chunk := range chunks {
+		key := chunk[len(chunkPrefix):]
+		used := spilled[chunk]
+		if i := strings.LastIndex(key, "/"); i >= 0 {
+			manifest, ok := ofs.loadManifest(key[:i])
+			index, err := strconv.ParseUint(strings.SplitN(key[i+1:], ".", 2)[0], 10, 64)
+			used = used || ok && err == nil && index < chunkCount(manifest.Length, manifest.ChunkSize) &&
+				manifest.chunkKey(key[:i], index) == chunk
+		}
+		if !used {
+			ofs.scoopData(chunk)
+			removed++
+		}
+	}
+	return
+}
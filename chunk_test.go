@@ -0,0 +1,245 @@
+package main
+
+import (
+	"./lib9p"
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pattern(length int, seed byte) []byte {
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(i/1000) + seed
+	}
+	return out
+}
+
+func chunkKeys(t *testing.T, ofs *OlegFs) []string {
+	t.Helper()
+	keys, err := ofs.db.PrefixMatch(chunkPrefix)
+	check(t, err)
+	return keys
+}
+
+// Fails every Jar of a key starting with prefix
+type failingStore struct {
+	Store
+	prefix string
+}
+
+func (s failingStore) Jar(key string, value []byte) error {
+	if strings.HasPrefix(key, s.prefix) {
+		return errors.New("failing on purpose")
+	}
+	return s.Store.Jar(key, value)
+}
+
+func TestRangeEnd(t *testing.T) {
+	tests := []struct{ offset, count, length, want uint64 }{
+		{0, 10, 100, 10},
+		{95, 10, 100, 100},
+		{200, 10, 100, 100},
+		{0, 1 << 33, 1 << 40, 1 << 33}, // More than a uint32 holds
+		{10, ^uint64(0), 100, 100},     // Doesn't wrap around
+	}
+	for _, test := range tests {
+		if got := rangeEnd(test.offset, test.count, test.length); got != test.want {
+			t.Errorf("rangeEnd(%d, %d, %d) is %d, expected %d", test.offset, test.count, test.length, got, test.want)
+		}
+	}
+}
+
+func TestChunkGenerations(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	value := pattern(5*chunkSize, 0)
+	check(t, c.createFile("big", 0666, value))
+
+	manifest, ok := ofs.loadManifest("big")
+	if !ok || manifest.Generation != 1 || !reflect.DeepEqual(manifest.Chunks, []uint64{1, 1, 1, 1, 1}) {
+		t.Fatalf("Manifest after the first commit is %+v", manifest)
+	}
+
+	// Only the chunk that changed moves to the next generation
+	fid, err := c.open("big", lib9p.MWrite)
+	check(t, err)
+	check(t, c.write(fid, 2*chunkSize+10, []byte("changed")))
+	check(t, c.clunk(fid))
+	copy(value[2*chunkSize+10:], "changed")
+	manifest, _ = ofs.loadManifest("big")
+	if manifest.Generation != 2 || !reflect.DeepEqual(manifest.Chunks, []uint64{1, 1, 2, 1, 1}) {
+		t.Fatalf("Manifest after the second commit is %+v", manifest)
+	}
+	if keys := chunkKeys(t, ofs); len(keys) != 5 {
+		t.Fatalf("Old chunks were left behind: %v", keys)
+	}
+	data, err := c.readFile("big")
+	check(t, err)
+	if !bytes.Equal(data, value) {
+		t.Fatal("Read back something else")
+	}
+
+	// Back to a plain value, nothing chunked stays
+	check(t, c.writeFile("big", []byte("small")))
+	checkFile(t, c, "big", "small")
+	if _, ok := ofs.loadManifest("big"); ok || len(chunkKeys(t, ofs)) > 0 {
+		t.Fatalf("Chunks left after shrinking: %v", chunkKeys(t, ofs))
+	}
+}
+
+func TestInterruptedCommit(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	old := pattern(5*chunkSize, 0)
+	check(t, c.createFile("big", 0666, old))
+
+	// The chunks make it, the manifest doesn't
+	store := ofs.db
+	ofs.db = failingStore{store, manifestPrefix}
+	checkErr(t, c.writeFile("big", pattern(6*chunkSize, 1)), "i/o error")
+	ofs.db = store
+	ofs.cache = makeReadCache(defaultCacheSize)
+
+	data, err := c.readFile("big")
+	check(t, err)
+	if !bytes.Equal(data, old) {
+		t.Fatal("Half a commit is visible")
+	}
+	if removed := ofs.collectChunks(); removed != 6 {
+		t.Fatalf("Collected %d chunks, expected the 6 new ones", removed)
+	}
+	data, err = c.readFile("big")
+	check(t, err)
+	if !bytes.Equal(data, old) {
+		t.Fatal("Collecting chunks broke the value")
+	}
+
+	// Going from plain to chunked, the plain value stays until the manifest is there
+	check(t, c.createFile("growing", 0666, []byte("plain")))
+	ofs.db = failingStore{store, manifestPrefix}
+	checkErr(t, c.writeFile("growing", pattern(5*chunkSize, 2)), "i/o error")
+	ofs.db = store
+	checkFile(t, c, "growing", "plain")
+}
+
+func TestUngeneratedChunks(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+
+	// Stored before chunks had generations
+	value := pattern(5*chunkSize, 3)
+	check(t, ofs.db.Jar("old", []byte{}))
+	check(t, ofs.db.Jar(manifestPrefix+"old", []byte(`{"Length":5242880,"ChunkSize":1048576}`)))
+	for index := 0; index < 5; index++ {
+		check(t, ofs.db.Jar(chunkKey("old", uint64(index), 0), value[index*chunkSize:(index+1)*chunkSize]))
+	}
+	data, err := c.readFile("old")
+	check(t, err)
+	if !bytes.Equal(data, value) {
+		t.Fatal("Can't read chunks without generations")
+	}
+	if removed := ofs.collectChunks(); removed != 0 {
+		t.Fatalf("Collected %d chunks still in use", removed)
+	}
+
+	fid, err := c.open("old", lib9p.MWrite)
+	check(t, err)
+	check(t, c.write(fid, 0, []byte("new")))
+	check(t, c.clunk(fid))
+	manifest, _ := ofs.loadManifest("old")
+	if !reflect.DeepEqual(manifest.Chunks, []uint64{1, 0, 0, 0, 0}) {
+		t.Fatalf("Chunks are at generations %v", manifest.Chunks)
+	}
+	if exists(ofs.db, chunkKey("old", 0, 0)) {
+		t.Fatal("Replaced chunk is still there")
+	}
+	copy(value, "new")
+	data, err = c.readFile("old")
+	check(t, err)
+	if !bytes.Equal(data, value) {
+		t.Fatal("Read back something else")
+	}
+}
+
+func TestChunkExpiry(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	past := time.Now().Add(-time.Second)
+
+	// Recreated before anybody noticed the old one expired
+	check(t, c.createFile("big", 0666, pattern(5*chunkSize, 0)))
+	check(t, ofs.db.Spoil("big", past))
+	check(t, c.createFile("big", 0666, nil))
+	stat, err := c.stat("big")
+	check(t, err)
+	if stat.Length != 0 {
+		t.Fatalf("Recreated file is %d bytes", stat.Length)
+	}
+	checkFile(t, c, "big", "")
+	if keys := chunkKeys(t, ofs); len(keys) > 0 {
+		t.Fatalf("Chunks of the expired value are left: %v", keys)
+	}
+
+	// Written to through a fid opened before it expired
+	check(t, c.createFile("open", 0666, pattern(5*chunkSize, 1)))
+	fid, err := c.open("open", lib9p.MWrite|lib9p.MTrunc)
+	check(t, err)
+	check(t, ofs.db.Spoil("open", past))
+	check(t, c.write(fid, 0, []byte("small")))
+	check(t, c.clunk(fid))
+	checkFile(t, c, "open", "small")
+
+	// Noticed by the expiry watcher
+	check(t, c.createFile("gone", 0666, pattern(5*chunkSize, 2)))
+	check(t, ofs.spoil("gone", past))
+	ofs.expireDue(time.Now())
+	if _, ok := ofs.loadManifest("gone"); ok || len(chunkKeys(t, ofs)) > 0 {
+		t.Fatalf("Expiring left the manifest or chunks: %v", chunkKeys(t, ofs))
+	}
+	if _, ok := ofs.meta.Load("gone"); ok {
+		t.Fatal("Expiring left the metadata")
+	}
+}
+
+func TestWriteSpills(t *testing.T) {
+	srv := makeTestServer(t)
+	c := attach(t, srv, "glenda")
+	ofs := testFs(srv)
+	value := pattern(5*chunkSize+100, 3)
+
+	fid, err := c.create("big", 0666)
+	check(t, err)
+	for offset := 0; offset < len(value); offset += 65536 {
+		end := min(offset+65536, len(value))
+		check(t, c.write(fid, uint64(offset), value[offset:end]))
+	}
+
+	// Everything but the last chunk is in the database already
+	client := srv.clients[c.con]
+	buf := client.Fids[fid].Buffer
+	if len(buf.spilled) != 5 || len(buf.chunks) != 1 {
+		t.Fatalf("%d chunks spilled, %d in memory", len(buf.spilled), len(buf.chunks))
+	}
+	if removed := ofs.collectChunks(); removed != 0 {
+		t.Fatalf("Collected %d chunks of an open file", removed)
+	}
+
+	// The commit goes through them
+	check(t, c.clunk(fid))
+	data, err := c.readFile("big")
+	check(t, err)
+	if !bytes.Equal(data, value) {
+		t.Fatal("Committed something else")
+	}
+	if keys := chunkKeys(t, ofs); len(keys) != 6 {
+		t.Fatalf("Expected 6 chunks, got %v", keys)
+	}
+}
@@ -0,0 +1,278 @@
+/*
+   Configuration
+
+   Everything can be set from the command line, or from a config file given
+   with -config, one setting per line:
+
+     # comments start with a hash
+     listen *:564 localhost:5640
+     data /var/lib/9oleg
+     backend oleg
+     features appendonly,lz4,splaytree,aol_fflush
+     msize 65560
+     iounit 65536
+     maxsize 17179869184
+     readonly false
+     policy default read,write,expire
+     policy backup read,ctl
+     log info
+
+   Every policy line adds a policy (or replaces one, "default" is the one
+   used when the attach name has none) on top of the built-in ones, see
+   defaultPolicies.
+
+   Flags win over the config file, which wins over the defaults.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* 9P message header overhead of Rread/Twrite, iounit + this must fit in msize */
+const ioHeaderSize = 24
+
+type Config struct {
+	Listen   []string
+	DataDir  string
+	Backend  string
+	Features int // Resolved by validate, once the backend is known
+	features string
+	MSize    uint32 // 0 lets the client pick
+	IOUnit   uint32
+	MaxSize  uint64 // Largest a file can grow to
+	ReadOnly bool
+	Policies map[string]Capability
+	LogLevel int
+}
+
+const (
+	LogNone = iota
+	LogError
+	LogInfo
+	LogDebug // Trace 9P messages
+	LogTrace // Dump their bytes too
+)
+
+var logLevels = []string{"none", "error", "info", "debug", "trace"}
+
+var logLevel = LogError
+
+func logf(level int, format string, args ...interface{}) {
+	if level <= logLevel {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+func defaultConfig() Config {
+	return Config{
+		Listen:   []string{"*"},
+		DataDir:  "data",
+		Backend:  "oleg",
+		MSize:    0,
+		IOUnit:   4096,
+		MaxSize:  16 << 30,
+		ReadOnly: false,
+		Policies: defaultPolicies(),
+		LogLevel: LogError,
+	}
+}
+
+var configUsage = map[string]string{
+	"listen":   "addresses to listen on, comma separated (default \"*\")",
+	"data":     "directory with the databases (default \"data\")",
+	"backend":  "storage backend: oleg, or memory to keep nothing on disk (default \"oleg\")",
+	"features": "backend features, comma separated (oleg default \"appendonly,lz4,splaytree,aol_fflush\")",
+	"msize":    "largest 9P message size, 0 lets clients pick (default 0)",
+	"iounit":   "largest read or write handed out to clients (default 4096)",
+	"maxsize":  "largest a file can grow to, in bytes (default 17179869184)",
+	"readonly": "refuse every change",
+	"policy":   "\"<name> <capabilities>\" to add an attach policy, can be repeated",
+	"log":      "log level: " + strings.Join(logLevels, ", ") + " (default \"error\")",
+}
+
+func (c *Config) set(name, value string) error {
+	var err error
+	switch name {
+	case "listen":
+		c.Listen = strings.FieldsFunc(value, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t'
+		})
+	case "data":
+		c.DataDir = value
+	case "backend":
+		c.Backend = value
+	case "features":
+		c.features = value
+	case "msize", "iounit":
+		var n uint64
+		n, err = strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a size", name, value)
+		}
+		if name == "msize" {
+			c.MSize = uint32(n)
+		} else {
+			c.IOUnit = uint32(n)
+		}
+	case "maxsize":
+		c.MaxSize, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("maxsize: %q is not a size", value)
+		}
+	case "readonly":
+		c.ReadOnly, err = strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("readonly: %q is not true or false", value)
+		}
+	case "policy":
+		fields := strings.Fields(value)
+		if len(fields) != 2 {
+			return fmt.Errorf("policy: expected a name and capabilities, got %q", value)
+		}
+		policy := fields[0]
+		if policy == "default" {
+			policy = ""
+		} else if strings.ContainsAny(policy, "/:") {
+			return fmt.Errorf("policy: bad name %q", policy)
+		}
+		caps, err := parseCaps(fields[1])
+		if err != nil {
+			return fmt.Errorf("policy: %s", err.Error())
+		}
+		c.Policies[policy] = caps
+	case "log":
+		c.LogLevel = -1
+		for level, levelName := range logLevels {
+			if value == levelName {
+				c.LogLevel = level
+			}
+		}
+		if c.LogLevel < 0 {
+			return fmt.Errorf("log: unknown level %q", value)
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", name)
+	}
+	return err
+}
+
+func (c *Config) validate() error {
+	backend, ok := backends[c.Backend]
+	if !ok {
+		return fmt.Errorf("backend: unknown backend %q, this build has %s", c.Backend, strings.Join(backendNames(), ", "))
+	}
+	c.Features = backend.DefaultFeatures
+	if c.features != "" {
+		var err error
+		c.Features, err = backend.parseFeatures(c.features)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(c.Listen) == 0:
+		return errors.New("nothing to listen on")
+	case c.DataDir == "":
+		return errors.New("no data directory")
+	case c.MSize != 0 && c.MSize < 256:
+		return fmt.Errorf("msize %d is too small, 9P needs at least 256", c.MSize)
+	case c.IOUnit == 0:
+		return errors.New("iounit can't be 0")
+	case c.MaxSize == 0:
+		return errors.New("maxsize can't be 0")
+	case c.MSize != 0 && c.IOUnit+ioHeaderSize > c.MSize:
+		return fmt.Errorf("iounit %d doesn't fit in msize %d, it can be %d at most", c.IOUnit, c.MSize, c.MSize-ioHeaderSize)
+	}
+	return nil
+}
+
+/* Applies the process wide settings */
+func (c *Config) apply() {
+	logLevel = c.LogLevel
+	lib9p.DebugReq.Store(c.LogLevel >= LogDebug)
+	lib9p.DebugSend.Store(c.LogLevel >= LogDebug)
+	lib9p.DebugBytes.Store(c.LogLevel >= LogTrace)
+}
+
+func loadConfig(path string, c *Config) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		value := ""
+		if len(fields) > 1 {
+			value = strings.TrimSpace(fields[1])
+		}
+		err = c.set(fields[0], value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+func parseArgs(args []string) (Config, error) {
+	flags := flag.NewFlagSet("9oleg", flag.ContinueOnError)
+	configPath := flags.String("config", "", "config file to load before the flags")
+	var policies []string
+	for name, usage := range configUsage {
+		if name == "readonly" {
+			flags.Bool(name, false, usage)
+		} else if name == "policy" {
+			flags.Func(name, usage, func(value string) error {
+				policies = append(policies, value)
+				return nil
+			})
+		} else {
+			flags.String(name, "", usage)
+		}
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return Config{}, err
+	}
+	if flags.NArg() > 0 {
+		return Config{}, fmt.Errorf("unexpected argument %q", flags.Arg(0))
+	}
+
+	config := defaultConfig()
+	if *configPath != "" {
+		err = loadConfig(*configPath, &config)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if err == nil && f.Name != "config" && f.Name != "policy" {
+			err = config.set(f.Name, f.Value.String())
+		}
+	})
+	for _, policy := range policies {
+		if err == nil {
+			err = config.set("policy", policy)
+		}
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	return config, config.validate()
+}
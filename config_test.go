@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "9oleg.conf")
+	check(t, os.WriteFile(path, []byte(text), 0644))
+	return path
+}
+
+func TestParseArgs(t *testing.T) {
+	config, err := parseArgs([]string{"-backend", "memory", "-listen", "a:1,b:2", "-data", "/tmp/x",
+		"-msize", "8192", "-iounit", "8000", "-maxsize", "1024", "-readonly",
+		"-policy", "backup read,ctl", "-policy", "default read"})
+	check(t, err)
+	if !reflect.DeepEqual(config.Listen, []string{"a:1", "b:2"}) || config.DataDir != "/tmp/x" ||
+		config.MSize != 8192 || config.IOUnit != 8000 || config.MaxSize != 1024 || !config.ReadOnly {
+		t.Fatalf("Flags gave %+v", config)
+	}
+	if config.Policies["backup"] != CapRead|CapCtl || config.Policies[""] != CapRead || config.Policies["admin"] != CapAll {
+		t.Fatalf("Policies are %v", config.Policies)
+	}
+
+	// Flags win over the file
+	path := writeConfig(t, "backend memory\ndata /from/file\niounit 1000\n")
+	config, err = parseArgs([]string{"-config", path, "-iounit", "2000"})
+	check(t, err)
+	if config.DataDir != "/from/file" || config.IOUnit != 2000 {
+		t.Fatalf("Config file and flags gave %+v", config)
+	}
+
+	for _, args := range [][]string{
+		{"-backend", "memory", "extra"},
+		{"-backend", "memory", "-nosuchflag"},
+		{"-backend", "memory", "-config", filepath.Join(t.TempDir(), "missing")},
+		{"-backend", "memory", "-msize", "big"},
+	} {
+		if _, err := parseArgs(args); err == nil {
+			t.Errorf("%v didn't fail", args)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `# comment
+listen *:564 localhost:5640
+
+data   /var/lib/9oleg
+backend memory
+maxsize 4096
+readonly true
+policy backup read,ctl
+log info
+`)
+	config := defaultConfig()
+	check(t, loadConfig(path, &config))
+	if !reflect.DeepEqual(config.Listen, []string{"*:564", "localhost:5640"}) || config.DataDir != "/var/lib/9oleg" ||
+		config.Backend != "memory" || config.MaxSize != 4096 || !config.ReadOnly || config.LogLevel != LogInfo {
+		t.Fatalf("Config file gave %+v", config)
+	}
+	if config.Policies["backup"] != CapRead|CapCtl {
+		t.Fatalf("Policies are %v", config.Policies)
+	}
+
+	tests := []struct{ text, want string }{
+		{"nosuch thing\n", ":1: unknown setting"},
+		{"\nmsize -1\n", ":2: msize"},
+		{"maxsize lots\n", ":1: maxsize"},
+		{"readonly maybe\n", ":1: readonly"},
+		{"log loud\n", ":1: log"},
+		{"policy backup\n", ":1: policy: expected"},
+		{"policy a:b read\n", ":1: policy: bad name"},
+		{"policy backup fly\n", ":1: policy"},
+	}
+	for _, test := range tests {
+		config := defaultConfig()
+		err := loadConfig(writeConfig(t, test.text), &config)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q gave %v, expected %q", test.text, err, test.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		change func(*Config)
+		want   string // Empty if it's valid
+	}{
+		{func(c *Config) {}, ""},
+		{func(c *Config) { c.Backend = "nosuch" }, "unknown backend"},
+		{func(c *Config) { c.features = "nosuch" }, "unknown feature"},
+		{func(c *Config) { c.Listen = nil }, "nothing to listen on"},
+		{func(c *Config) { c.DataDir = "" }, "no data directory"},
+		{func(c *Config) { c.MSize = 100 }, "too small"},
+		{func(c *Config) { c.IOUnit = 0 }, "iounit can't be 0"},
+		{func(c *Config) { c.MaxSize = 0 }, "maxsize can't be 0"},
+		{func(c *Config) { c.MSize, c.IOUnit = 8192, 8192 }, "doesn't fit in msize"},
+		{func(c *Config) { c.MSize, c.IOUnit = 8192, 8192-ioHeaderSize }, ""},
+	}
+	for i, test := range tests {
+		config := defaultConfig()
+		config.Backend = "memory"
+		test.change(&config)
+		err := config.validate()
+		if test.want == "" && err != nil {
+			t.Errorf("Case %d: %s", i, err.Error())
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("Case %d gave %v, expected %q", i, err, test.want)
+		}
+	}
+}
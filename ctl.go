@@ -0,0 +1,129 @@
+/*
+   The ctl file
+
+   Reading it returns the server status, writing it runs administration
+   commands, one per line:
+
+     squish                     compact the database
+     scoop <key>                delete a key
+     spoil <key> <rfc3339>      set the expiration of a key (+<duration>, never)
+     cas <key> <old> <value>    replace the value of a key if it matches old
+     gc                         remove metadata left behind by deleted keys
+     debug on|off               toggle 9P message tracing
+     mkdb <name>                make a new database
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const ErrBadCtl = "bad ctl message"
+
+func (ofs *OlegFs) ctlRead(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+	var status bytes.Buffer
+	fmt.Fprintf(&status, "database %s\n", ofs.name)
+	fmt.Fprintf(&status, "uptime %d\n", ofs.db.Uptime())
+	fmt.Fprintf(&status, "backend %s\n", ofs.backendName)
+	fmt.Fprintf(&status, "records %d\n", ofs.db.Records())
+	fmt.Fprintf(&status, "connections %d\n", len(ofs.clients))
+	fmt.Fprintf(&status, "databases %d open %d\n", len(ofs.listDatabases()), len(ofs.dbs))
+	fmt.Fprintf(&status, "features %s\n", strings.Join(ofs.backend.featureNames(ofs.features), " "))
+	hits, misses, size, capacity := ofs.cache.Stats()
+	fmt.Fprintf(&status, "cache %d/%d bytes %d hits %d misses\n", size, capacity, hits, misses)
+	fmt.Fprintf(&status, "readonly %s\n", onOff(ofs.readOnly))
+	fmt.Fprintf(&status, "debug %s\n", onOff(lib9p.DebugReq.Load()))
+	return sliceData(status.Bytes(), offset, count), nil
+}
+
+func (ofs *OlegFs) ctlWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		args := strings.Fields(line)
+		if len(args) < 1 {
+			continue
+		}
+		err := ofs.ctlCommand(client, args[0], args[1:])
+		if err != nil {
+			return 0, err
+		}
+	}
+	return uint32(len(data)), nil
+}
+
+func (ofs *OlegFs) ctlCommand(client *Client, cmd string, args []string) error {
+	switch {
+	case cmd == "mkdb" && len(args) == 1:
+		return ofs.createDatabase(args[0])
+
+	case cmd == "squish" && len(args) == 0:
+		return storeError(ofs.db.Squish())
+
+	case cmd == "scoop" && len(args) == 1:
+		return ofs.removeKey(dataKey(args[0]))
+
+	case cmd == "spoil" && len(args) == 2:
+		expiration, err := parseExpiration(args[1])
+		if err != nil {
+			return err
+		}
+		key := dataKey(args[0])
+		err = ofs.keyError(key)
+		if err != nil {
+			return err
+		}
+		return ofs.spoil(key, expiration)
+
+	case cmd == "cas" && len(args) == 3:
+		key := dataKey(args[0])
+		err := ofs.keyError(key)
+		if err != nil {
+			return err
+		}
+		// Chunked values are bigger than anything a ctl line holds
+		if _, chunked := ofs.loadManifest(key); chunked {
+			return errors.New("value mismatch")
+		}
+		value := []byte(args[2])
+		ofs.cache.Invalidate(key)
+		swapped, err := ofs.db.Cas(key, []byte(args[1]), value)
+		if err != nil {
+			return storeError(err)
+		}
+		if !swapped {
+			return errors.New("value mismatch")
+		}
+		ofs.notify("jar", key, strconv.Itoa(len(value)))
+		_, err = ofs.modified(client, strings.Split(args[0], "/"), uint64(len(value)))
+		return err
+
+	case cmd == "gc" && len(args) == 0:
+		removed := ofs.meta.Collect(func(key string) bool {
+			return exists(ofs.db, key)
+		}, ofs.isDir)
+		chunks := ofs.collectChunks()
+		logf(LogInfo, "gc: removed %d metadata records, %d chunks", removed, chunks)
+
+	case cmd == "debug" && len(args) == 1 && (args[0] == "on" || args[0] == "off"):
+		on := args[0] == "on"
+		lib9p.DebugReq.Store(on)
+		lib9p.DebugSend.Store(on)
+		lib9p.DebugBytes.Store(on)
+
+	default:
+		return errors.New(ErrBadCtl)
+	}
+	return nil
+}
+
+func onOff(value bool) string {
+	if value {
+		return "on"
+	}
+	return "off"
+}
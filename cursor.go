@@ -0,0 +1,204 @@
+/*
+   Ordered iteration
+
+   The "cursor" file walks the keys in the database order. Every open fid
+   has its own position. Writing a command to it:
+
+     first        moves to the first key
+     last         moves to the last key
+     seek <key>   moves to the first key that's not before <key>
+     next <n>     moves forward by up to n keys (from the start if unset)
+     prev <n>     moves backward by up to n keys (from the end if unset)
+
+   makes the following reads return every record that was moved onto, in
+   order, each one framed as
+
+     <key length> <value length>\n<key><value>\n
+
+   Reads ignore the offset and consume the output, an empty read means it's
+   all been read. Values are read a chunk at a time as the output is, so big
+   ones are never held whole; if one shrinks in the meantime the rest of it
+   reads as zeros. Keys the user can't read, or couldn't walk to, are skipped,
+   as are OlegFs' own.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Cursor struct {
+	Key     string   // Stored key the cursor is at
+	Valid   bool     // Key is set
+	Out     []byte   // Records made but not read yet
+	Pending []string // Keys moved onto whose records aren't in Out yet
+	Value   string   // Key whose value is going into Out
+	Size    uint64   // Its length in the header
+	Pos     uint64   // How much of it is in Out
+}
+
+/* Limit for a single next/prev, to keep the output size sane */
+const maxCursorStep = 4096
+
+func (ofs *OlegFs) cursorRead(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+	if fid.Cursor == nil {
+		return make([]byte, 0), nil
+	}
+	err := ofs.cursorFill(fid.Cursor, uint64(count))
+	if err != nil {
+		return nil, err
+	}
+	out := sliceData(fid.Cursor.Out, 0, count)
+	fid.Cursor.Out = fid.Cursor.Out[len(out):]
+	return out, nil
+}
+
+/* Makes records until there's size bytes of them in Out, or they're all there */
+func (ofs *OlegFs) cursorFill(cursor *Cursor, size uint64) error {
+	for uint64(len(cursor.Out)) < size {
+		if cursor.Pos < cursor.Size {
+			count := rangeEnd(cursor.Pos, chunkSize, cursor.Size) - cursor.Pos
+			data, err := ofs.readRange(cursor.Value, cursor.Pos, count)
+			if err != nil && err.Error() != lib9p.ErrNotFound {
+				return err
+			}
+			// The header is out already, whatever happened to the value since
+			if uint64(len(data)) < count {
+				data = append(data, make([]byte, count-uint64(len(data)))...)
+			}
+			cursor.Out = append(cursor.Out, data[:count]...)
+			cursor.Pos += count
+			if cursor.Pos == cursor.Size {
+				cursor.Out = append(cursor.Out, '\n')
+			}
+			continue
+		}
+		if len(cursor.Pending) == 0 {
+			return nil
+		}
+
+		// Keys that expired since they were moved onto read as empty
+		key := cursor.Pending[0]
+		size, err := ofs.dataSize(key)
+		if err != nil && err.Error() != lib9p.ErrNotFound {
+			return err
+		}
+		cursor.Pending = cursor.Pending[1:]
+		name, _ := userKey(key)
+		cursor.Value = key
+		cursor.Size = size
+		cursor.Pos = 0
+		cursor.Out = append(cursor.Out, fmt.Sprintf("%d %d\n", len(name), cursor.Size)...)
+		cursor.Out = append(cursor.Out, name...)
+		if cursor.Size == 0 {
+			cursor.Out = append(cursor.Out, '\n')
+		}
+	}
+	return nil
+}
+
+func (ofs *OlegFs) cursorWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	if fid.Cursor == nil {
+		fid.Cursor = new(Cursor)
+	}
+	cursor := fid.Cursor
+
+	// Keys can have spaces, so only split off the command
+	cmd := strings.TrimSuffix(string(data), "\n")
+	arg := ""
+	if i := strings.Index(cmd, " "); i >= 0 {
+		cmd, arg = cmd[:i], cmd[i+1:]
+	}
+
+	// Anything that wasn't read is gone
+	cursor.Out = make([]byte, 0)
+	cursor.Pending = nil
+	cursor.Size = 0
+	cursor.Pos = 0
+
+	switch {
+	case cmd == "first" && arg == "":
+		ofs.cursorWalk(client, cursor, "", false, 1, true)
+	case cmd == "last" && arg == "":
+		ofs.cursorWalk(client, cursor, "", false, 1, false)
+	case cmd == "seek" && arg != "":
+		key, ok := ofs.cursorSeek(client, dataKey(arg))
+		ofs.cursorMove(client, cursor, key, ok)
+	case (cmd == "next" || cmd == "prev") && arg != "":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > maxCursorStep {
+			return 0, errors.New(ErrBadCtl)
+		}
+		ofs.cursorWalk(client, cursor, cursor.Key, cursor.Valid, n, cmd == "next")
+	default:
+		return 0, errors.New(ErrBadCtl)
+	}
+	return uint32(len(data)), nil
+}
+
+/* Sets the position and queues the record there, which is made as it's read */
+func (ofs *OlegFs) cursorMove(client *Client, cursor *Cursor, key string, ok bool) {
+	if !ok {
+		return
+	}
+	cursor.Key = key
+	cursor.Valid = true
+	cursor.Pending = append(cursor.Pending, key)
+}
+
+/* Whether a stored key should show up through the cursor */
+func (ofs *OlegFs) cursorVisible(client *Client, key string) bool {
+	name, ok := userKey(key)
+	if !ok {
+		return false
+	}
+	// Walking to it takes exec on every directory on the way, like Walk does
+	path := strings.Split(name, "/")
+	for i := range path {
+		if ofs.checkPerm(client, path[:i], lib9p.DmExec) != nil {
+			return false
+		}
+	}
+	// Keys OlegFs didn't write get the permissions makeMeta gives them
+	stat, ok := ofs.meta.Load(key)
+	if !ok {
+		stat = lib9p.Stat{Mode: 0666, Uid: "none", Gid: "none"}
+	}
+	return ofs.allowed(client.Uname, stat, lib9p.DmRead)
+}
+
+/* First visible key that's not before key */
+func (ofs *OlegFs) cursorSeek(client *Client, key string) (string, bool) {
+	for key := range ofs.db.RangeKeys(key, "") {
+		if ofs.cursorVisible(client, key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+/* Moves by up to n visible keys from the one at from, or from the ends if it isn't set. The key doesn't have to exist any more */
+func (ofs *OlegFs) cursorWalk(client *Client, cursor *Cursor, from string, set bool, n int, forward bool) {
+	if !set {
+		from = ""
+	}
+	keys := ofs.db.KeysBefore(from)
+	if forward {
+		keys = ofs.db.RangeKeys(from, "")
+	}
+	for key := range keys {
+		if (set && key == from) || !ofs.cursorVisible(client, key) {
+			continue
+		}
+		ofs.cursorMove(client, cursor, key, true)
+		n--
+		if n == 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,642 @@
+/*
+   Databases
+
+   The server manages every OlegDB database in its data directory. The
+   attach name picks what a client gets, along with a policy:
+
+     ""  or "<policy>"                 every database, as a directory each
+     "<database>" or "<database>:<policy>"  just that database
+
+   Databases are opened the first time someone gets to them, and closed
+   once no fid has used them for idleTimeout. New ones are made through
+   ctl with "mkdb <name>", or by attaching to them with a policy that
+   allows ctl, which is the only way to make the first one.
+
+   Every database gets a number, the top bits of all its qid paths, which
+   is kept in .qidbases in the data directory so it stays the same across
+   restarts, whichever order databases get opened in.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	idleTimeout  = 5 * time.Minute
+	idleInterval = time.Minute
+)
+
+/* Top qid bits are the database number, see OlegFs.qidBase */
+const (
+	databaseQidShift = 48
+	qidBasesFile     = ".qidbases" // Database numbers, one "<number> <quoted name>" per line
+)
+
+type Server struct {
+	vfs         *lib9p.Server
+	dataRoot    string
+	backend     Backend
+	backendName string
+	features    int    // Backend features every database is opened with
+	ioUnit      uint32 // Largest read or write clients should make
+	maxSize     uint64 // Largest a file can grow to
+	readOnly    bool
+	policies    map[string]Capability
+	clients     map[net.Conn]*Client
+	dbs         map[string]*OlegFs // Open databases
+	dbIds       map[string]uint64  // Numbers given to databases, see qidBasesFile
+	events      *sync.Cond         // Wakes up blocked event readers, uses mutex
+	mutex       sync.RWMutex       // Shared by reads of values and stats, held alone by everything else
+}
+
+func makeServer(config Config) (*Server, error) {
+	srv := new(Server)
+	srv.dataRoot = config.DataDir
+	srv.backend = backends[config.Backend]
+	srv.backendName = config.Backend
+	srv.features = config.Features
+	srv.ioUnit = config.IOUnit
+	srv.maxSize = config.MaxSize
+	srv.readOnly = config.ReadOnly
+	srv.policies = config.Policies
+	srv.clients = make(map[net.Conn]*Client)
+	srv.dbs = make(map[string]*OlegFs)
+	srv.dbIds = make(map[string]uint64)
+	srv.events = sync.NewCond(&srv.mutex)
+
+	err := os.MkdirAll(srv.dataRoot, 0755)
+	if err != nil {
+		return nil, err
+	}
+	err = srv.loadQidBases()
+	if err != nil {
+		return nil, err
+	}
+
+	/* Make VFS */
+	vfs := new(lib9p.Server)
+	vfs.MaxSize = config.MSize
+	vfs.OnConnError = srv.ConnError
+	vfs.OnDisconnect = srv.Disconnect
+	vfs.OnAttach = srv.Attach
+	vfs.OnWalk = srv.Walk
+	vfs.OnClunk = srv.Clunk
+	vfs.OnOpen = srv.Open
+	vfs.OnCreate = srv.Create
+	vfs.OnRead = srv.Read
+	vfs.OnWrite = srv.Write
+	vfs.OnRemove = srv.Remove
+	vfs.OnStat = srv.Stat
+	vfs.OnWstat = srv.Wstat
+	vfs.OnFlush = srv.Flush
+
+	srv.vfs = vfs
+	go srv.closeIdle()
+	return srv, nil
+}
+
+func (srv *Server) closeAll() {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	for name, ofs := range srv.dbs {
+		ofs.close()
+		delete(srv.dbs, name)
+	}
+}
+
+/* Splits an attach name in database and policy */
+func (srv *Server) parseAname(aname string) (dbname, policy string) {
+	if _, ok := srv.policies[aname]; ok {
+		return "", aname
+	}
+	if i := strings.LastIndex(aname, ":"); i >= 0 {
+		return aname[:i], aname[i+1:]
+	}
+	return aname, ""
+}
+
+func (srv *Server) validName(name string) bool {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/:") {
+		return false
+	}
+	// Would be taken for a policy when attaching
+	_, isPolicy := srv.policies[name]
+	return !isPolicy
+}
+
+/* Names of the databases in the data directory, plus those open */
+func (srv *Server) listDatabases() []string {
+	names := make(map[string]bool)
+	for name := range srv.dbs {
+		names[name] = true
+	}
+	for _, name := range srv.backend.List(srv.dataRoot) {
+		if srv.validName(name) {
+			names[name] = true
+		}
+	}
+
+	list := make([]string, 0, len(names))
+	for name := range names {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (srv *Server) databaseExists(name string) bool {
+	for _, db := range srv.listDatabases() {
+		if db == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (srv *Server) qidBase(name string) uint64 {
+	id, ok := srv.dbIds[name]
+	if !ok {
+		for _, used := range srv.dbIds {
+			id = max(id, used)
+		}
+		id++
+		srv.dbIds[name] = id
+		if !srv.readOnly {
+			err := srv.saveQidBases()
+			if err != nil {
+				logf(LogError, "Can't save database numbers: %s", err.Error())
+			}
+		}
+	}
+	return id << databaseQidShift
+}
+
+func (srv *Server) loadQidBases() error {
+	file := filepath.Join(srv.dataRoot, qidBasesFile)
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		// A bad line would have its number handed out again
+		fields := strings.SplitN(line, " ", 2)
+		id, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil || id == 0 || id >= 1<<(64-databaseQidShift) || len(fields) < 2 {
+			return fmt.Errorf("%s: bad line %q", file, line)
+		}
+		name, err := strconv.Unquote(fields[1])
+		if err != nil {
+			return fmt.Errorf("%s: bad line %q", file, line)
+		}
+		srv.dbIds[name] = id
+	}
+	return nil
+}
+
+/* Replaces the whole file, so it's never seen half written */
+func (srv *Server) saveQidBases() error {
+	names := make([]string, 0, len(srv.dbIds))
+	for name := range srv.dbIds {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return srv.dbIds[names[i]] < srv.dbIds[names[j]] })
+
+	var data []byte
+	for _, name := range names {
+		data = fmt.Appendf(data, "%d %q\n", srv.dbIds[name], name)
+	}
+	file := filepath.Join(srv.dataRoot, qidBasesFile)
+	err := os.WriteFile(file+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+/* Opens the database if it isn't already, it must exist unless create is set */
+func (srv *Server) database(name string, create bool) (*OlegFs, error) {
+	if ofs, ok := srv.dbs[name]; ok {
+		return ofs, nil
+	}
+	if !srv.validName(name) {
+		return nil, errors.New(lib9p.ErrNotFound)
+	}
+	if !create && !srv.databaseExists(name) {
+		return nil, errors.New(lib9p.ErrNotFound)
+	}
+
+	ofs, err := makeFs(srv, srv.dataRoot, name, srv.qidBase(name))
+	if err != nil {
+		logf(LogError, "Can't open database %s: %s", name, err.Error())
+		return nil, errors.New(lib9p.ErrIO)
+	}
+	srv.dbs[name] = ofs
+	return ofs, nil
+}
+
+func (srv *Server) createDatabase(name string) error {
+	if !srv.validName(name) {
+		return errors.New(lib9p.ErrCantCreate)
+	}
+	if srv.databaseExists(name) {
+		return errors.New(lib9p.ErrExists)
+	}
+	_, err := srv.database(name, true)
+	return err
+}
+
+func (srv *Server) closeIdle() {
+	for now := range time.Tick(idleInterval) {
+		srv.mutex.Lock()
+		used := make(map[*OlegFs]bool)
+		for _, client := range srv.clients {
+			for _, fid := range client.Fids {
+				used[fid.Fs] = true
+			}
+		}
+		for name, ofs := range srv.dbs {
+			switch {
+			case used[ofs]:
+				ofs.idle = time.Time{}
+			case ofs.idle.IsZero():
+				ofs.idle = now
+			case now.Sub(ofs.idle) >= idleTimeout:
+				ofs.close()
+				delete(srv.dbs, name)
+			}
+		}
+		srv.mutex.Unlock()
+	}
+}
+
+/*
+   The list of databases, for clients that attached to all of them
+*/
+
+var topQid = lib9p.Qid{
+	Type:    lib9p.QtDir,
+	Version: 1,
+	PathId:  0,
+}
+
+func topStat() lib9p.Stat {
+	now := uint32(time.Now().Unix())
+	return lib9p.Stat{
+		Qid:   topQid,
+		Mode:  lib9p.DmDir | 0555,
+		Atime: now,
+		Mtime: now,
+		Name:  "/",
+		Uid:   "none",
+		Gid:   "none",
+		Muid:  "none",
+	}
+}
+
+/* What a database's root looks like, without opening it */
+func (srv *Server) databaseStat(name string) lib9p.Stat {
+	stat := topStat()
+	stat.Qid.PathId = srv.qidBase(name)
+	stat.Mode = lib9p.DmDir | 0777
+	stat.Name = name
+	return stat
+}
+
+func (srv *Server) topRead(req lib9p.ReadRequest) []byte {
+	names := srv.listDatabases()
+	stats := make([]lib9p.Stat, len(names))
+	for i, name := range names {
+		stats[i] = srv.databaseStat(name)
+	}
+	return lib9p.PackDir(stats, req.Offset, req.Count)
+}
+
+/*
+   9P handlers, which find the database each fid is in and pass it on
+*/
+
+func (srv *Server) getFC(con net.Conn, fid uint32) (*Client, *FidData, error) {
+	client, ok := srv.clients[con]
+	if !ok {
+		return nil, nil, errors.New(lib9p.ErrDenied)
+	}
+
+	fidData, ok := client.Fids[fid]
+	if !ok {
+		return nil, nil, errors.New(lib9p.ErrUnknownFid)
+	}
+
+	return client, fidData, nil
+}
+
+func (srv *Server) ConnError(con net.Conn, err error) {
+	logf(LogError, "%s", err.Error())
+}
+
+func (srv *Server) Disconnect(con net.Conn) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	client, ok := srv.clients[con]
+	if !ok {
+		return
+	}
+
+	// Dropping the connection clunks every fid, but a transaction nobody
+	// committed might be missing the rest of its operations
+	for _, fid := range client.Fids {
+		srv.closeEvents(fid)
+		if fid.Fs == nil {
+			continue
+		}
+		if fid.Txn != nil {
+			fid.Txn.Ops = nil
+		}
+		err := fid.Fs.commit(client, fid)
+		if err != nil {
+			logf(LogError, "%s", err.Error())
+		}
+	}
+	delete(srv.clients, con)
+}
+
+func (srv *Server) Attach(con net.Conn, req lib9p.AttachRequest) (out lib9p.AttachResponse, err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	dbname, policy := srv.parseAname(req.Aname)
+	caps, err := srv.policyCaps(policy)
+	if err != nil {
+		return
+	}
+
+	root := &FidData{
+		Qid:  topQid,
+		Path: make([]string, 0),
+	}
+	if dbname != "" {
+		// Whoever may make databases can make one by attaching to it
+		root.Fs, err = srv.database(dbname, caps&CapCtl != 0 && !srv.readOnly)
+		if err != nil {
+			return
+		}
+		root.Qid, _ = root.Fs.getQid(root.Path)
+	}
+	out.Qid = root.Qid
+
+	uname := req.Uname
+	if uname == "" {
+		uname = "none"
+	}
+	srv.clients[con] = &Client{
+		Uname: uname,
+		Caps:  caps,
+		Top:   dbname == "",
+		Fids:  make(map[uint32]*FidData),
+	}
+
+	srv.clients[con].Fids[req.Fid] = root
+	return
+}
+
+func (srv *Server) Walk(con net.Conn, req lib9p.WalkRequest) (out lib9p.WalkResponse, err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	client, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+
+	current := FidData{
+		Qid:  fid.Qid,
+		Fs:   fid.Fs,
+		Path: append([]string{}, fid.Path...),
+	}
+
+	out.Qids = make([]lib9p.Qid, len(req.Paths))
+	for i := range out.Qids {
+		if lib9p.DebugReq.Load() {
+			fmt.Printf("Walking to %s..\n", req.Paths[i])
+		}
+
+		// Only directories can be walked into, one name at a time, since
+		// a name with a "/" in it would skip the exec check on the ones before
+		if current.Qid.Type&lib9p.QtDir == 0 {
+			err = errors.New(lib9p.ErrNotDirectory)
+		} else if req.Paths[i] == "" || strings.Contains(req.Paths[i], "/") {
+			err = errors.New(lib9p.ErrNotFound)
+		} else {
+			switch req.Paths[i] {
+			case ".":
+			case "..":
+				if len(current.Path) > 0 {
+					current.Path = current.Path[:len(current.Path)-1]
+					current.Qid, err = current.Fs.getQid(current.Path)
+				} else if current.Fs != nil && client.Top {
+					// Out of the database, back to the list
+					current.Fs = nil
+					current.Qid = topQid
+				}
+			default:
+				if current.Fs == nil {
+					current.Fs, err = srv.database(req.Paths[i], false)
+				} else {
+					// Looking up a name in a directory takes exec on it
+					err = current.Fs.checkPerm(client, current.Path, lib9p.DmExec)
+					current.Path = append(current.Path, req.Paths[i])
+				}
+				if err == nil {
+					current.Qid, err = current.Fs.getQid(current.Path)
+				}
+			}
+		}
+
+		if err != nil {
+			// A partial walk is not an error, but newfid must be left alone
+			if i > 0 {
+				out.Qids = out.Qids[:i]
+				err = nil
+			}
+			return
+		}
+		out.Qids[i] = current.Qid
+	}
+
+	client.Fids[req.NewFid] = &current
+	return
+}
+
+func (srv *Server) Clunk(con net.Conn, req lib9p.ClunkRequest) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	client, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return err
+	}
+
+	// Pending writes get committed when the fid goes away
+	delete(client.Fids, req.Fid)
+	srv.closeEvents(fid)
+	if fid.Fs == nil {
+		return nil
+	}
+	return fid.Fs.commit(client, fid)
+}
+
+func (srv *Server) Open(con net.Conn, req lib9p.OpenRequest) (out lib9p.OpenResponse, err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Open(con, req)
+	}
+
+	if isWriteMode(req.Mode) {
+		err = errors.New(lib9p.ErrIsDirectory)
+		return
+	}
+	fid.Qid = topQid
+	fid.Open = true
+	fid.Mode = req.Mode
+	out.Qid = topQid
+	out.IoUnit = srv.ioUnit
+	return
+}
+
+func (srv *Server) Create(con net.Conn, req lib9p.CreateRequest) (out lib9p.CreateResponse, err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Create(con, req)
+	}
+
+	// Databases are made through ctl
+	err = errors.New(lib9p.ErrCantCreate)
+	return
+}
+
+func (srv *Server) Read(con net.Conn, req lib9p.ReadRequest) (b []byte, err error) {
+	// Reading a value changes nothing, so those don't wait for each other
+	srv.mutex.RLock()
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err == nil && fid.Fs != nil && fid.Fs.readsValue(fid) {
+		defer srv.mutex.RUnlock()
+		return fid.Fs.Read(con, req)
+	}
+	srv.mutex.RUnlock()
+
+	// The fid could have been clunked in between, look it up again
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	_, fid, err = srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Read(con, req)
+	}
+
+	if !fid.Open {
+		err = errors.New(lib9p.ErrNotOpen)
+		return
+	}
+	b = srv.topRead(req)
+	return
+}
+
+func (srv *Server) Write(con net.Conn, req lib9p.WriteRequest) (out lib9p.WriteResponse, err error) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Write(con, req)
+	}
+
+	err = errors.New(lib9p.ErrIsDirectory)
+	return
+}
+
+func (srv *Server) Remove(con net.Conn, req lib9p.RemoveRequest) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	client, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return err
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Remove(con, req)
+	}
+
+	delete(client.Fids, req.Fid)
+	return errors.New(lib9p.ErrCantRemove)
+}
+
+func (srv *Server) Stat(con net.Conn, req lib9p.StatRequest) (out lib9p.StatResponse, err error) {
+	srv.mutex.RLock()
+	defer srv.mutex.RUnlock()
+
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Stat(con, req)
+	}
+
+	out.Stat = topStat()
+	return
+}
+
+func (srv *Server) Wstat(con net.Conn, req lib9p.WstatRequest) error {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	_, fid, err := srv.getFC(con, req.Fid)
+	if err != nil {
+		return err
+	}
+	if fid.Fs != nil {
+		return fid.Fs.Wstat(con, req)
+	}
+
+	// Nothing to sync up here
+	if isSyncStat(req.Stat) {
+		return nil
+	}
+	return errors.New(lib9p.ErrCantWstat)
+}
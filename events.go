@@ -0,0 +1,134 @@
+/*
+   Change notification
+
+   Reading "events" blocks until something changes, then returns one line
+   per change:
+
+     jar <key> <length>
+     scoop <key>
+     spoil <key> <expiration>   (or "never" once it's cleared)
+     expire <key>
+
+   Keys with spaces, quotes or anything unprintable in them are quoted and
+   escaped like Go strings, so they can't break up the line.
+
+   Writing a key prefix to the fid first only gets changes to keys starting
+   with it. Every fid has its own queue of eventQueueSize lines, if a reader
+   falls behind the changes that don't fit are dropped and the next read
+   starts with an "overflow" line.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const eventQueueSize = 1024
+
+type EventQueue struct {
+	Prefix   string
+	lines    []string
+	overflow bool
+	closed   bool // Fid is gone, wake up and leave
+}
+
+func makeEventQueue() *EventQueue {
+	return &EventQueue{
+		lines: make([]string, 0),
+	}
+}
+
+func (ofs *OlegFs) eventsOpen(client *Client, fid *FidData) error {
+	fid.Events = makeEventQueue()
+	return nil
+}
+
+func (ofs *OlegFs) eventsWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	fid.Events.Prefix = strings.TrimSuffix(string(data), "\n")
+	return uint32(len(data)), nil
+}
+
+/* Called with the fs mutex held, which gets released while waiting. flushed can be nil */
+func (ofs *OlegFs) eventsRead(queue *EventQueue, flushed func() bool, count uint32) ([]byte, error) {
+	if flushed == nil {
+		flushed = func() bool { return false }
+	}
+	for len(queue.lines) == 0 && !queue.overflow && !queue.closed && !flushed() {
+		ofs.events.Wait()
+	}
+	if flushed() {
+		return nil, errors.New(lib9p.ErrFlushed)
+	}
+	if queue.closed {
+		return nil, errors.New(lib9p.ErrNotOpen)
+	}
+
+	// Whole lines only, as many as fit
+	out := make([]byte, 0)
+	if queue.overflow {
+		out = append(out, "overflow\n"...)
+		queue.overflow = false
+	}
+	for len(queue.lines) > 0 && len(out)+len(queue.lines[0]) <= int(count) {
+		out = append(out, queue.lines[0]...)
+		queue.lines = queue.lines[1:]
+	}
+	if len(out) == 0 && len(queue.lines) > 0 {
+		// Tiny reads get a line in pieces rather than nothing
+		out = append(out, queue.lines[0][:count]...)
+		queue.lines[0] = queue.lines[0][count:]
+	}
+	return sliceData(out, 0, count), nil
+}
+
+func (srv *Server) closeEvents(fid *FidData) {
+	if fid.Events != nil {
+		fid.Events.closed = true
+		srv.events.Broadcast()
+	}
+}
+
+func quoteKey(name string) string {
+	quoted := strconv.Quote(name)
+	if name == "" || strings.Contains(name, " ") || quoted[1:len(quoted)-1] != name {
+		return quoted
+	}
+	return name
+}
+
+/* Queues a change for every reader interested in it, never blocks */
+func (ofs *OlegFs) notify(event, key string, args ...string) {
+	name, ok := userKey(key)
+	if !ok {
+		return
+	}
+	line := strings.Join(append([]string{event, quoteKey(name)}, args...), " ") + "\n"
+
+	for _, client := range ofs.clients {
+		for _, fid := range client.Fids {
+			queue := fid.Events
+			if queue == nil || fid.Fs != ofs || !strings.HasPrefix(name, queue.Prefix) {
+				continue
+			}
+			if len(queue.lines) >= eventQueueSize {
+				queue.overflow = true
+				continue
+			}
+			queue.lines = append(queue.lines, line)
+		}
+	}
+	ofs.events.Broadcast()
+}
+
+func (srv *Server) Flush(con net.Conn, req lib9p.FlushRequest) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+
+	// The read knows it's been flushed, it only has to wake up to see it
+	srv.events.Broadcast()
+}
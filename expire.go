@@ -0,0 +1,181 @@
+/*
+   Record expiration
+
+   Keys with an expiration set (see Spoil) show up with the DmTmp bit, and
+   every key has a companion "<key>.expires" file that isn't listed but can
+   be walked to. Reading it returns the expiration time (RFC3339, empty if
+   the key never expires), writing a time or a "+<duration>" sets it and
+   writing nothing or "never" clears it.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const expiresSuffix = ".expires"
+
+func (ofs *OlegFs) expiresFile(path []string) *SynthFile {
+	name := path[len(path)-1]
+	if !strings.HasSuffix(name, expiresSuffix) || name == expiresSuffix {
+		return nil
+	}
+
+	// A real key with that name always wins
+	key := pathKey(path)
+	if exists(ofs.db, key) {
+		return nil
+	}
+	target := strings.TrimSuffix(key, expiresSuffix)
+	if !exists(ofs.db, target) {
+		return nil
+	}
+
+	// Same permissions as the key it belongs to
+	targetPath := append(append([]string{}, parentPath(path)...), strings.TrimSuffix(name, expiresSuffix))
+	stat, err := ofs.getMeta(targetPath)
+	if err != nil {
+		return nil
+	}
+
+	return &SynthFile{
+		PathId:   ofs.meta.PathId(target) | companionQid,
+		Mode:     stat.Mode & 0666,
+		Uid:      stat.Uid,
+		Gid:      stat.Gid,
+		WriteCap: CapExpire,
+		Read: func(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+			expiration, ok := expiresAt(ofs.db, target)
+			if !ok {
+				return make([]byte, 0), nil
+			}
+			return sliceData([]byte(expiration.Format(time.RFC3339)+"\n"), offset, count), nil
+		},
+		Write: func(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+			expiration, err := parseExpiration(strings.TrimSpace(string(data)))
+			if err != nil {
+				return 0, err
+			}
+			err = ofs.spoil(target, expiration)
+			if err != nil {
+				return 0, err
+			}
+			return uint32(len(data)), nil
+		},
+	}
+}
+
+/* The zero time for "never", or nothing at all */
+func parseExpiration(value string) (time.Time, error) {
+	if value == "" || value == "never" {
+		return time.Time{}, nil
+	}
+	if strings.HasPrefix(value, "+") {
+		ttl, err := time.ParseDuration(value[1:])
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad duration %q", value)
+		}
+		return time.Now().Add(ttl), nil
+	}
+	expiration, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q", value)
+	}
+	return expiration, nil
+}
+
+func (ofs *OlegFs) markExpiring(key string, stat *lib9p.Stat) {
+	if _, ok := expiresAt(ofs.db, key); ok {
+		stat.Mode |= lib9p.DmTmp
+		stat.Qid.Type |= lib9p.QtTmp
+	}
+}
+
+func (ofs *OlegFs) spoil(key string, expiration time.Time) error {
+	err := ofs.db.Spoil(key, expiration)
+	if err != nil {
+		return storeError(err)
+	}
+	if expiration.IsZero() {
+		delete(ofs.expiring, key)
+		ofs.notify("spoil", key, "never")
+		return nil
+	}
+	ofs.expiring[key] = expiration
+	ofs.notify("spoil", key, expiration.Format(time.RFC3339))
+	return nil
+}
+
+/*
+   OlegDB only drops expired keys when something looks at them, so expire
+   events come from checking the keys we know have an expiration set every
+   expiryInterval.
+*/
+
+const expiryInterval = time.Second
+
+func (ofs *OlegFs) watchExpiry() {
+	// Keys spoiled before we started, looked up without holding up clients
+	found := make(map[string]time.Time)
+	keys, _ := ofs.db.DumpKeys()
+	for _, key := range keys {
+		if expiration, ok := expiresAt(ofs.db, key); ok {
+			found[key] = expiration
+		}
+	}
+	ofs.mutex.Lock()
+	for key, expiration := range found {
+		if _, ok := ofs.expiring[key]; !ok {
+			ofs.expiring[key] = expiration
+		}
+	}
+	ofs.mutex.Unlock()
+
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		var now time.Time
+		select {
+		case <-ofs.done:
+			return
+		case now = <-ticker.C:
+		}
+
+		// The database might have been closed while we waited for the lock
+		ofs.mutex.Lock()
+		select {
+		case <-ofs.done:
+			ofs.mutex.Unlock()
+			return
+		default:
+		}
+		ofs.expireDue(now)
+		ofs.mutex.Unlock()
+	}
+}
+
+/* Cleans up after the keys that expired by now, with the lock held */
+func (ofs *OlegFs) expireDue(now time.Time) {
+	for key, expiration := range ofs.expiring {
+		if expiration.After(now) {
+			continue
+		}
+		if current, ok := expiresAt(ofs.db, key); ok && current.After(now) {
+			// Spoiled again by someone else
+			ofs.expiring[key] = current
+			continue
+		}
+		delete(ofs.expiring, key)
+		if !exists(ofs.db, key) {
+			// OlegDB only dropped the key, what OlegFs keeps about it goes too
+			ofs.cache.Invalidate(key)
+			ofs.dropChunks(key)
+			ofs.meta.Delete(key)
+			ofs.notify("expire", key)
+		}
+	}
+}
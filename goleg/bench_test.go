@@ -0,0 +1,159 @@
+package goleg
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// What the benchmarks need, shared by Database, MemDatabase and exclusive
+type benchDB interface {
+	Jar(key string, value []byte) error
+	Unjar(key string) ([]byte, error)
+	Exists(key string) (bool, error)
+	GetSize(key string) (int, error)
+}
+
+// exclusive puts every call behind one mutex, the way Database used to lock,
+// so benchmarks can compare against it on the same backend
+type exclusive struct {
+	db    benchDB
+	mutex sync.Mutex
+}
+
+func (e *exclusive) Jar(key string, value []byte) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.db.Jar(key, value)
+}
+
+func (e *exclusive) Unjar(key string) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.db.Unjar(key)
+}
+
+func (e *exclusive) Exists(key string) (bool, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.db.Exists(key)
+}
+
+func (e *exclusive) GetSize(key string) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.db.GetSize(key)
+}
+
+const (
+	BENCHKEYS  = 1000
+	BENCHVALUE = 1 << 10
+	BIGVALUE   = 8 << 20
+)
+
+func benchValue(size int) []byte {
+	value := make([]byte, size)
+	rand.Read(value)
+	return value
+}
+
+func benchFill(b *testing.B, database benchDB) {
+	value := benchValue(BENCHVALUE)
+	for i := 0; i < BENCHKEYS; i++ {
+		if err := database.Jar("bench"+strconv.Itoa(i), value); err != nil {
+			b.Fatalf("Can't jar: %s", err.Error())
+		}
+	}
+}
+
+// Runs bench on database as it is, and behind a single mutex
+func benchLocking(b *testing.B, database benchDB, bench func(*testing.B, benchDB)) {
+	b.Run("shared", func(b *testing.B) {
+		bench(b, database)
+	})
+	b.Run("exclusive", func(b *testing.B) {
+		bench(b, &exclusive{db: database})
+	})
+}
+
+func benchParallelUnjar(b *testing.B, database benchDB) {
+	benchFill(b, database)
+	b.SetBytes(BENCHVALUE)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := database.Unjar("bench" + strconv.Itoa(r.Intn(BENCHKEYS))); err != nil {
+				b.Errorf("Can't unjar: %s", err.Error())
+				return
+			}
+		}
+	})
+}
+
+func benchParallelExists(b *testing.B, database benchDB) {
+	benchFill(b, database)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			key := "bench" + strconv.Itoa(r.Intn(BENCHKEYS))
+			database.Exists(key)
+			database.GetSize(key)
+		}
+	})
+}
+
+// Small reads while something keeps unjarring a big value, which is what
+// used to hold every 9oleg client up
+func benchReadsDuringBigUnjar(b *testing.B, database benchDB) {
+	benchFill(b, database)
+	if err := database.Jar("big", benchValue(BIGVALUE)); err != nil {
+		b.Fatalf("Can't jar big value: %s", err.Error())
+	}
+
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				database.Unjar("big")
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			database.Unjar("bench" + strconv.Itoa(r.Intn(BENCHKEYS)))
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+// One write for every 10 reads
+func benchParallelMixed(b *testing.B, database benchDB) {
+	benchFill(b, database)
+	value := benchValue(BENCHVALUE)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for i := 0; pb.Next(); i++ {
+			key := "bench" + strconv.Itoa(r.Intn(BENCHKEYS))
+			if i%10 == 0 {
+				database.Jar(key, value)
+			} else {
+				database.Unjar(key)
+			}
+		}
+	})
+}
@@ -0,0 +1,522 @@
+package goleg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"iter"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	JARN       = 10
+	CASWORKERS = 8
+	CASROUNDS  = 50
+)
+
+// Everything Database and MemDatabase have in common, they must behave the same
+type conformer interface {
+	Close() error
+	Unjar(key string) ([]byte, error)
+	Jar(key string, value []byte) error
+	Cas(key string, old, value []byte) (bool, error)
+	Scoop(key string) error
+	Uptime() int
+	Expiration(key string) (time.Time, error)
+	Spoil(key string, expiration time.Time) error
+	Exists(key string) (bool, error)
+	Squish() error
+	PrefixMatch(prefix string) ([]string, error)
+	DumpKeys() ([]string, error)
+	First() (string, []byte, error)
+	Last() (string, []byte, error)
+	Next(key string) (string, []byte, error)
+	Prev(key string) (string, []byte, error)
+	GetSize(key string) (int, error)
+	Records() int
+	Range(start, end string) iter.Seq2[Record, error]
+	RangeKeys(start, end string) iter.Seq[string]
+	Keys(prefix string) iter.Seq[string]
+	KeysBefore(end string) iter.Seq[string]
+}
+
+// Opens an empty database, and returns a function that gets rid of it
+type conformerOpener func(t *testing.T) (conformer, func())
+
+func testConformance(t *testing.T, open conformerOpener) {
+	tests := []struct {
+		name string
+		test func(*testing.T, conformer)
+	}{
+		{"JarUnjar", conformJarUnjar},
+		{"Scoop", conformScoop},
+		{"Size", conformSize},
+		{"Order", conformOrder},
+		{"PrefixMatch", conformPrefixMatch},
+		{"DumpKeys", conformDumpKeys},
+		{"Spoil", conformSpoil},
+		{"Cas", conformCas},
+		{"Squish", conformSquish},
+		{"Errors", conformErrors},
+		{"BinaryKeys", conformBinaryKeys},
+		{"EmptyValues", conformEmptyValues},
+		{"Range", conformRange},
+		{"RangeBatches", conformRangeBatches},
+		{"RangeChanges", conformRangeChanges},
+		{"KeysBefore", conformKeysBefore},
+	}
+	for _, test := range tests {
+		database, done := open(t)
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, database)
+		})
+		done()
+	}
+}
+
+func jarAll(t *testing.T, database conformer, keys ...string) {
+	for _, key := range keys {
+		if err := database.Jar(key, []byte("value of "+key)); err != nil {
+			t.Fatalf("Can't jar %s: %s", key, err.Error())
+		}
+	}
+}
+
+func exists(database conformer, key string) bool {
+	ok, err := database.Exists(key)
+	return ok && err == nil
+}
+
+func conformJarUnjar(t *testing.T, database conformer) {
+	for i := 0; i < JARN; i++ {
+		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != nil {
+			t.Fatalf("Can't jar value #%d", i)
+		}
+	}
+	for i := 0; i < JARN; i++ {
+		value, err := database.Unjar("record" + strconv.Itoa(i))
+		if err != nil || !bytes.Equal(value, []byte("value"+strconv.Itoa(i))) {
+			t.Errorf("Value #%d doesn't match", i)
+		}
+	}
+
+	// Jarring again replaces the value
+	database.Jar("record0", []byte("replaced"))
+	if value, _ := database.Unjar("record0"); !bytes.Equal(value, []byte("replaced")) {
+		t.Error("Value wasn't replaced")
+	}
+	if _, err := database.Unjar("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for a key that doesn't exist, got %v", err)
+	}
+	if database.Records() != JARN {
+		t.Errorf("Expected %d records, got %d", JARN, database.Records())
+	}
+}
+
+func conformScoop(t *testing.T, database conformer) {
+	jarAll(t, database, "a", "b")
+	if err := database.Scoop("a"); err != nil {
+		t.Fatalf("Can't scoop a: %s", err.Error())
+	}
+	if _, err := database.Unjar("a"); exists(database, "a") || err == nil {
+		t.Error("a is still there after scooping it")
+	}
+	if !exists(database, "b") {
+		t.Error("b went away with a")
+	}
+	if err := database.Scoop("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound scooping a twice, got %v", err)
+	}
+}
+
+func conformSize(t *testing.T, database conformer) {
+	database.Jar("sized", make([]byte, 1234))
+	if size, err := database.GetSize("sized"); err != nil || size != 1234 {
+		t.Errorf("Expected size 1234, got %d", size)
+	}
+	if _, err := database.GetSize("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound for the size of a missing key, got %v", err)
+	}
+}
+
+func conformOrder(t *testing.T, database conformer) {
+	if _, _, err := database.First(); err != ErrEnd {
+		t.Errorf("Expected ErrEnd on an empty database, got %v", err)
+	}
+
+	jarAll(t, database, "c", "a", "d", "b")
+	order := []string{"a", "b", "c", "d"}
+
+	key, value, err := database.First()
+	if err != nil || key != "a" || !bytes.Equal(value, []byte("value of a")) {
+		t.Fatalf("First is %q, expected a", key)
+	}
+	for _, expected := range order[1:] {
+		key, _, err = database.Next(key)
+		if err != nil || key != expected {
+			t.Fatalf("Next is %q, expected %q", key, expected)
+		}
+	}
+	if key, _, err = database.Next("d"); err != ErrEnd {
+		t.Errorf("Got %q after the last key", key)
+	}
+
+	key, _, err = database.Last()
+	if err != nil || key != "d" {
+		t.Fatalf("Last is %q, expected d", key)
+	}
+	for i := len(order) - 2; i >= 0; i-- {
+		key, _, err = database.Prev(key)
+		if err != nil || key != order[i] {
+			t.Fatalf("Prev is %q, expected %q", key, order[i])
+		}
+	}
+	if key, _, err = database.Prev("a"); err != ErrEnd {
+		t.Errorf("Got %q before the first key", key)
+	}
+	if _, _, err = database.Next("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound stepping from a missing key, got %v", err)
+	}
+}
+
+func conformPrefixMatch(t *testing.T, database conformer) {
+	jarAll(t, database, "users/alice", "users/bob", "groups/adm", "usersfile")
+	keys, err := database.PrefixMatch("users/")
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("Expected 2 matches, got %v", keys)
+	}
+	for _, key := range keys {
+		if key != "users/alice" && key != "users/bob" {
+			t.Errorf("%q doesn't start with users/", key)
+		}
+	}
+	if keys, err = database.PrefixMatch("nothing"); err != nil || len(keys) != 0 {
+		t.Errorf("Expected no matches, got %v", keys)
+	}
+}
+
+func conformDumpKeys(t *testing.T, database conformer) {
+	jarAll(t, database, "x", "y", "z")
+	keys, err := database.DumpKeys()
+	if err != nil || len(keys) != 3 {
+		t.Fatalf("Expected 3 keys, got %v", keys)
+	}
+}
+
+func conformSpoil(t *testing.T, database conformer) {
+	jarAll(t, database, "fresh", "stale", "forever")
+	expiration := time.Now().Add(time.Hour)
+	if err := database.Spoil("fresh", expiration); err != nil {
+		t.Fatalf("Can't spoil fresh: %s", err.Error())
+	}
+	got, err := database.Expiration("fresh")
+	if err != nil || got.Unix() != expiration.Unix() {
+		t.Errorf("Expiration is %v, expected %v", got, expiration)
+	}
+	if got, err = database.Expiration("forever"); err != nil || !got.IsZero() {
+		t.Error("Key that was never spoiled has an expiration")
+	}
+
+	// Expired keys are gone
+	if err = database.Spoil("stale", time.Now().Add(-time.Hour)); err != nil {
+		t.Fatalf("Can't spoil stale: %s", err.Error())
+	}
+	if _, err = database.Unjar("stale"); exists(database, "stale") || err == nil {
+		t.Error("Expired key is still there")
+	}
+
+	// The zero time takes the expiration away
+	if err = database.Spoil("fresh", time.Time{}); err != nil {
+		t.Fatalf("Can't clear the expiration of fresh: %s", err.Error())
+	}
+	if got, err = database.Expiration("fresh"); err != nil || !got.IsZero() {
+		t.Errorf("Expiration is %v after clearing it", got)
+	}
+	if value, err := database.Unjar("fresh"); err != nil || string(value) != "value of fresh" {
+		t.Errorf("Clearing the expiration changed the value to %q (%v)", value, err)
+	}
+	if err = database.Spoil("missing", expiration); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound spoiling a missing key, got %v", err)
+	}
+}
+
+func conformCas(t *testing.T, database conformer) {
+	jarAll(t, database, "cas")
+	if swapped, err := database.Cas("cas", []byte("wrong"), []byte("new")); swapped || err != nil {
+		t.Fatal("Swapped with the wrong old value")
+	}
+	if swapped, err := database.Cas("cas", []byte("value of cas"), []byte("new")); !swapped || err != nil {
+		t.Fatal("Didn't swap with the right old value")
+	}
+	if swapped, _ := database.Cas("missing", []byte{}, []byte("new")); swapped {
+		t.Fatal("Swapped a key that doesn't exist")
+	}
+
+	// Concurrent increments, none of them can get lost
+	database.Jar("counter", []byte("0"))
+	var wg sync.WaitGroup
+	for w := 0; w < CASWORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < CASROUNDS; i++ {
+				for {
+					old, _ := database.Unjar("counter")
+					n, _ := strconv.Atoi(string(old))
+					if swapped, _ := database.Cas("counter", old, []byte(strconv.Itoa(n+1))); swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if counter, _ := database.Unjar("counter"); string(counter) != strconv.Itoa(CASWORKERS*CASROUNDS) {
+		t.Errorf("Lost updates, counter is %s", counter)
+	}
+}
+
+func conformSquish(t *testing.T, database conformer) {
+	jarAll(t, database, "kept")
+	if err := database.Squish(); err != nil {
+		t.Fatalf("Can't squish: %s", err.Error())
+	}
+	if value, _ := database.Unjar("kept"); !bytes.Equal(value, []byte("value of kept")) {
+		t.Error("Squishing lost a value")
+	}
+	if database.Uptime() < 0 {
+		t.Error("Negative uptime")
+	}
+}
+
+func conformErrors(t *testing.T, database conformer) {
+	long := strings.Repeat("k", KeySize+1)
+	if err := database.Jar(long, []byte("value")); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+	if _, err := database.Exists(long); !errors.Is(err, ErrKeyTooLong) {
+		t.Errorf("Expected ErrKeyTooLong from Exists, got %v", err)
+	}
+	if err := database.Jar(strings.Repeat("k", KeySize), []byte("value")); err != nil {
+		t.Errorf("Can't jar a key of KeySize bytes: %s", err.Error())
+	}
+
+	// Errors say what failed
+	_, err := database.Unjar("missing")
+	var opErr *Error
+	if !errors.As(err, &opErr) || opErr.Op != "unjar" || opErr.Key != "missing" {
+		t.Fatalf("Expected an *Error for unjar of missing, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Error %q doesn't name the key", err.Error())
+	}
+}
+
+func conformBinaryKeys(t *testing.T, database conformer) {
+	// Keys that would all be "bin" as C strings
+	keys := []string{"bin", "bin\x00a", "bin\x00b", "bin\xff\x01\n"}
+	for i, key := range keys {
+		if err := database.Jar(key, []byte(strconv.Itoa(i))); err != nil {
+			t.Fatalf("Can't jar %q: %s", key, err.Error())
+		}
+	}
+	for i, key := range keys {
+		value, err := database.Unjar(key)
+		if err != nil || string(value) != strconv.Itoa(i) {
+			t.Errorf("Value of %q is %q, expected %d", key, value, i)
+		}
+	}
+	if database.Records() != len(keys) {
+		t.Errorf("Expected %d records, got %d", len(keys), database.Records())
+	}
+
+	matches, err := database.PrefixMatch("bin\x00")
+	if err != nil || len(matches) != 2 {
+		t.Fatalf("Expected 2 keys after the NUL, got %q", matches)
+	}
+	for _, match := range matches {
+		if match != keys[1] && match != keys[2] {
+			t.Errorf("Key %q didn't come back whole", match)
+		}
+	}
+
+	if err = database.Scoop(keys[1]); err != nil {
+		t.Fatalf("Can't scoop %q: %s", keys[1], err.Error())
+	}
+	if !exists(database, keys[0]) || !exists(database, keys[2]) {
+		t.Error("Scooping one key took another with it")
+	}
+}
+
+func conformEmptyValues(t *testing.T, database conformer) {
+	if err := database.Jar("empty", []byte{}); err != nil {
+		t.Fatalf("Can't jar an empty value: %s", err.Error())
+	}
+	if err := database.Jar("nil", nil); err != nil {
+		t.Fatalf("Can't jar a nil value: %s", err.Error())
+	}
+
+	for _, key := range []string{"empty", "nil"} {
+		value, err := database.Unjar(key)
+		if err != nil || value == nil || len(value) != 0 {
+			t.Errorf("Value of %s is %v, %v, expected an empty slice", key, value, err)
+		}
+		if size, err := database.GetSize(key); err != nil || size != 0 {
+			t.Errorf("Size of %s is %d, %v", key, size, err)
+		}
+		if !exists(database, key) {
+			t.Errorf("%s doesn't exist", key)
+		}
+	}
+
+	if swapped, err := database.Cas("empty", []byte{}, []byte("full")); !swapped || err != nil {
+		t.Fatal("Didn't swap from an empty value")
+	}
+	if swapped, err := database.Cas("empty", []byte("full"), nil); !swapped || err != nil {
+		t.Fatal("Didn't swap to an empty value")
+	}
+	if value, _ := database.Unjar("empty"); len(value) != 0 {
+		t.Errorf("Value is %q after swapping it to empty", value)
+	}
+}
+
+func conformRange(t *testing.T, database conformer) {
+	jarAll(t, database, "a", "b/1", "b/2", "b/3", "c", "stale")
+	database.Spoil("stale", time.Now().Add(-time.Hour))
+
+	var got []string
+	for record, err := range database.Range("b", "c") {
+		if err != nil {
+			t.Fatalf("Range failed: %s", err.Error())
+		}
+		if !bytes.Equal(record.Value, []byte("value of "+record.Key)) {
+			t.Errorf("Value of %s is %q", record.Key, record.Value)
+		}
+		got = append(got, record.Key)
+	}
+	if strings.Join(got, " ") != "b/1 b/2 b/3" {
+		t.Errorf("Range b to c gave %v", got)
+	}
+
+	got = nil
+	for key := range database.RangeKeys("b/2", "") {
+		got = append(got, key)
+	}
+	if strings.Join(got, " ") != "b/2 b/3 c" {
+		t.Errorf("RangeKeys from b/2 gave %v", got)
+	}
+
+	got = nil
+	for key := range database.Keys("b/") {
+		got = append(got, key)
+		if len(got) == 2 {
+			break
+		}
+	}
+	if strings.Join(got, " ") != "b/1 b/2" {
+		t.Errorf("Stopping after 2 keys gave %v", got)
+	}
+
+	for key := range database.Keys("nothing") {
+		t.Errorf("Got %s for a prefix nothing has", key)
+	}
+}
+
+func conformRangeBatches(t *testing.T, database conformer) {
+	// Enough to take a few batches, with expired keys across batch boundaries
+	const records = scanBatch*3 + 5
+	for i := 0; i < records; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		database.Jar(key, []byte(key))
+		if i%scanBatch == scanBatch-1 {
+			database.Spoil(key, time.Now().Add(-time.Hour))
+		}
+	}
+
+	i := 0
+	for record, err := range database.Range("", "") {
+		if err != nil {
+			t.Fatalf("Range failed: %s", err.Error())
+		}
+		if i%scanBatch == scanBatch-1 {
+			i++
+		}
+		if expected := fmt.Sprintf("key%04d", i); record.Key != expected || string(record.Value) != expected {
+			t.Fatalf("Got %s, expected %s", record.Key, expected)
+		}
+		i++
+	}
+	if i != records {
+		t.Errorf("Scan stopped at %d out of %d", i, records)
+	}
+}
+
+func conformKeysBefore(t *testing.T, database conformer) {
+	// Enough to take a few batches, with expired keys across batch boundaries
+	const records = scanBatch*3 + 5
+	for i := 0; i < records; i++ {
+		key := fmt.Sprintf("key%04d", i)
+		database.Jar(key, []byte(key))
+		if i%scanBatch == 0 {
+			database.Spoil(key, time.Now().Add(-time.Hour))
+		}
+	}
+
+	i := records - 1
+	for key := range database.KeysBefore("") {
+		if i%scanBatch == 0 {
+			i--
+		}
+		if expected := fmt.Sprintf("key%04d", i); key != expected {
+			t.Fatalf("Got %s, expected %s", key, expected)
+		}
+		i--
+	}
+	// key0000 expired too
+	if i != 0 {
+		t.Errorf("Scan stopped at %d", i)
+	}
+
+	var got []string
+	for key := range database.KeysBefore("key0003") {
+		got = append(got, key)
+	}
+	if strings.Join(got, " ") != "key0002 key0001" {
+		t.Errorf("KeysBefore key0003 gave %v", got)
+	}
+}
+
+func conformRangeChanges(t *testing.T, database conformer) {
+	for i := 0; i < scanBatch*2; i++ {
+		database.Jar(fmt.Sprintf("key%04d", i), []byte("value"))
+	}
+
+	// Changes behind the scan go unseen, changes past the batch it's in show up
+	seen := make(map[string]bool)
+	last := ""
+	for key := range database.RangeKeys("", "") {
+		if key <= last || seen[key] {
+			t.Fatalf("Got %s after %s", key, last)
+		}
+		seen[key] = true
+		last = key
+		if err := database.Scoop(key); err != nil {
+			t.Fatalf("Can't scoop %s during the scan: %s", key, err.Error())
+		}
+		if key == "key0000" {
+			database.Jar("key9999", []byte("ahead"))
+			database.Scoop(fmt.Sprintf("key%04d", scanBatch+1))
+		}
+		database.Jar("a", []byte("behind"))
+	}
+	if seen["a"] || !seen["key9999"] || seen[fmt.Sprintf("key%04d", scanBatch+1)] {
+		t.Error("Changes during the scan didn't show up right")
+	}
+	if len(seen) != scanBatch*2 {
+		t.Errorf("Expected %d keys, got %d", scanBatch*2, len(seen))
+	}
+}
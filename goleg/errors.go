@@ -0,0 +1,47 @@
+package goleg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// KeySize is OlegDB's KEY_SIZE, the longest key it takes. Longer keys would
+// get cut short and land on top of other keys, so they're refused instead.
+const KeySize = 250
+
+var (
+	ErrNotFound   = errors.New("key not found")
+	ErrKeyTooLong = fmt.Errorf("key longer than %d bytes", KeySize)
+	ErrEnd        = errors.New("no more keys")
+	ErrFailed     = errors.New("olegdb failed")
+)
+
+// Error is what Database and MemDatabase return, with the operation and key
+// that failed. Compare the sentinel errors against it with errors.Is.
+type Error struct {
+	Op  string
+	Key string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Key == "" {
+		return "goleg: " + e.Op + ": " + e.Err.Error()
+	}
+	return fmt.Sprintf("goleg: %s %q: %s", e.Op, e.Key, e.Err.Error())
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func opError(op, key string, err error) error {
+	return &Error{Op: op, Key: key, Err: err}
+}
+
+func checkKey(op, key string) error {
+	if len(key) > KeySize {
+		return opError(op, key, ErrKeyTooLong)
+	}
+	return nil
+}
@@ -1,3 +1,6 @@
+//go:build cgo
+// +build cgo
+
 package goleg
 
 import (
@@ -6,6 +9,7 @@ import (
 	"math/rand"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -42,8 +46,6 @@ func TestOpen(t *testing.T) {
 	cleanTemp(dir)
 }
 
-const JARN = 10
-
 func TestJar(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping in short mode")
@@ -55,7 +57,7 @@ func TestJar(t *testing.T) {
 	}
 
 	for i := 0; i < JARN; i++ {
-		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != 0 {
+		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != nil {
 			t.Fatalf("Can't jar value #%d", i)
 		}
 	}
@@ -71,14 +73,14 @@ func TestUnjar(t *testing.T) {
 	}
 
 	for i := 0; i < JARN; i++ {
-		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != 0 {
+		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != nil {
 			t.Fatalf("Can't jar value #%d", i)
 		}
 	}
 
 	for i := 0; i < JARN; i++ {
-		val := database.Unjar("record" + strconv.Itoa(i))
-		if !bytes.Equal(val, []byte("value"+strconv.Itoa(i))) {
+		val, err := database.Unjar("record" + strconv.Itoa(i))
+		if err != nil || !bytes.Equal(val, []byte("value"+strconv.Itoa(i))) {
 			t.Errorf("Value #%d doesn't match", i)
 		}
 	}
@@ -88,21 +90,23 @@ func TestUnjar(t *testing.T) {
 }
 
 func TestFullKeyDump(t *testing.T) {
-	database, _, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+	database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
 	if err != nil {
 		t.Fatalf("Can't open database: %s", err.Error())
 	}
+	defer cleanTemp(dir)
+	defer database.Close()
 
 	for i := 0; i < JARN; i++ {
-		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != 0 {
+		if database.Jar("record"+strconv.Itoa(i), []byte("value"+strconv.Itoa(i))) != nil {
 			t.Fatalf("Can't jar value #%d", i)
 		}
 	}
 
-	gotKeys, keys := database.DumpKeys()
+	keys, err := database.DumpKeys()
 
-	if !gotKeys {
-		t.Fatal("Didn't get keys and should have")
+	if err != nil {
+		t.Fatalf("Didn't get keys and should have: %s", err.Error())
 	}
 
 	var j int
@@ -119,10 +123,12 @@ func TestFullKeyDump(t *testing.T) {
 }
 
 func TestSize(t *testing.T) {
-	database, _, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+	database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
 	if err != nil {
 		t.Fatalf("Can't open database: %s", err.Error())
 	}
+	defer cleanTemp(dir)
+	defer database.Close()
 
 	rand.Seed(0)
 	sizs := make([]int, 100)
@@ -136,9 +142,213 @@ func TestSize(t *testing.T) {
 	}
 
 	for i := range sizs {
-		siz := database.GetSize("test" + strconv.Itoa(i))
-		if siz != sizs[i] {
+		siz, err := database.GetSize("test" + strconv.Itoa(i))
+		if err != nil || siz != sizs[i] {
 			t.Fatal("Size mismatch")
 		}
 	}
 }
+
+func TestCas(t *testing.T) {
+	database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+	if err != nil {
+		t.Fatalf("Can't open database: %s", err.Error())
+	}
+	defer cleanTemp(dir)
+	defer database.Close()
+
+	swapped, err := database.Cas("missing", []byte{}, []byte("value"))
+	if err != nil || swapped {
+		t.Fatal("Swapped a key that doesn't exist")
+	}
+
+	if database.Jar("cas", []byte("old")) != nil {
+		t.Fatal("Can't jar value")
+	}
+	swapped, err = database.Cas("cas", []byte("wrong"), []byte("new"))
+	if err != nil || swapped {
+		t.Fatal("Swapped with the wrong old value")
+	}
+	if value, _ := database.Unjar("cas"); !bytes.Equal(value, []byte("old")) {
+		t.Fatal("Value changed after a failed swap")
+	}
+
+	swapped, err = database.Cas("cas", []byte("old"), []byte("new"))
+	if err != nil {
+		t.Fatalf("Can't swap: %s", err.Error())
+	}
+	if !swapped {
+		t.Fatal("Didn't swap with the right old value")
+	}
+	if value, _ := database.Unjar("cas"); !bytes.Equal(value, []byte("new")) {
+		t.Fatal("Value didn't change after swapping")
+	}
+}
+
+func TestCasContention(t *testing.T) {
+	database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+	if err != nil {
+		t.Fatalf("Can't open database: %s", err.Error())
+	}
+	defer cleanTemp(dir)
+	defer database.Close()
+
+	if database.Jar("counter", []byte("0")) != nil {
+		t.Fatal("Can't jar counter")
+	}
+
+	// Every worker increments the counter, retrying until its swap goes through
+	var wg sync.WaitGroup
+	errs := make(chan error, CASWORKERS)
+	for w := 0; w < CASWORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < CASROUNDS; i++ {
+				for {
+					old, err := database.Unjar("counter")
+					if err != nil {
+						errs <- err
+						return
+					}
+					n, err := strconv.Atoi(string(old))
+					if err != nil {
+						errs <- err
+						return
+					}
+					swapped, err := database.Cas("counter", old, []byte(strconv.Itoa(n+1)))
+					if err != nil {
+						errs <- err
+						return
+					}
+					if swapped {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Worker failed: %s", err.Error())
+	}
+
+	if counter, _ := database.Unjar("counter"); string(counter) != strconv.Itoa(CASWORKERS*CASROUNDS) {
+		t.Fatalf("Lost updates, counter is %s", counter)
+	}
+}
+
+// Readers share the lock with each other, but never see a value being written
+func TestParallelUnjar(t *testing.T) {
+	database, dir, err := openRandomDB(F_APPENDONLY | F_LZ4 | F_SPLAYTREE)
+	if err != nil {
+		t.Fatalf("Can't open database: %s", err.Error())
+	}
+	defer cleanTemp(dir)
+	defer database.Close()
+
+	values := map[string][]byte{
+		"small":      []byte("x"),
+		"repetitive": bytes.Repeat([]byte("0123456789abcdef"), 65536),
+		"random":     make([]byte, 100000),
+	}
+	rand.Read(values["random"])
+	for key, value := range values {
+		if err := database.Jar(key, value); err != nil {
+			t.Fatalf("Can't jar %s: %s", key, err.Error())
+		}
+	}
+	versions := [][]byte{[]byte("first"), bytes.Repeat([]byte("second"), 10000)}
+	if err := database.Jar("changing", versions[0]); err != nil {
+		t.Fatalf("Can't jar changing: %s", err.Error())
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan bool)
+	errs := make(chan string, CASWORKERS+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := database.Jar("changing", versions[i%2]); err != nil {
+				errs <- "Can't jar changing: " + err.Error()
+				return
+			}
+			database.Jar("other"+strconv.Itoa(i), versions[0])
+		}
+	}()
+
+	var readers sync.WaitGroup
+	for w := 0; w < CASWORKERS; w++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < CASROUNDS; i++ {
+				for key, value := range values {
+					got, err := database.Unjar(key)
+					if err != nil || !bytes.Equal(got, value) {
+						errs <- "Read something else for " + key
+						return
+					}
+				}
+				got, err := database.Unjar("changing")
+				if err != nil || !bytes.Equal(got, versions[0]) && !bytes.Equal(got, versions[1]) {
+					errs <- "Read a value that was never written"
+					return
+				}
+			}
+		}()
+	}
+	readers.Wait()
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) (conformer, func()) {
+		database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+		if err != nil {
+			t.Fatalf("Can't open database: %s", err.Error())
+		}
+		return database, func() {
+			database.Close()
+			cleanTemp(dir)
+		}
+	})
+}
+
+func benchOpen(b *testing.B, bench func(*testing.B, benchDB)) {
+	database, dir, err := openRandomDB(F_LZ4 | F_SPLAYTREE)
+	if err != nil {
+		b.Fatalf("Can't open database: %s", err.Error())
+	}
+	defer cleanTemp(dir)
+	defer database.Close()
+	benchLocking(b, database, bench)
+}
+
+func BenchmarkParallelUnjar(b *testing.B) {
+	benchOpen(b, benchParallelUnjar)
+}
+
+func BenchmarkParallelExists(b *testing.B) {
+	benchOpen(b, benchParallelExists)
+}
+
+func BenchmarkReadsDuringBigUnjar(b *testing.B) {
+	benchOpen(b, benchReadsDuringBigUnjar)
+}
+
+func BenchmarkParallelMixed(b *testing.B) {
+	benchOpen(b, benchParallelMixed)
+}
@@ -5,15 +5,28 @@ package goleg
 */
 import "C"
 import (
+	"bytes"
 	"errors"
+	"iter"
+	"math"
 	"sync"
 	"time"
 )
 
+// Fails to compile if KeySize ever drifts from OlegDB's KEY_SIZE
+const _ = uint(KeySize-C.KEY_SIZE) + uint(C.KEY_SIZE-KeySize)
+
+// OlegDB isn't thread safe, and more of it writes than it looks like:
+// ol_unjar, ol_exists and ol_expiration_time scoop the key they look up if
+// it has expired, and finding a node in the splay tree splays it. What can be
+// shared is reading buckets out of the hash table with ol_get_bucket, walking
+// the tree along its pointers, and reading values out of the values file
+// with CBucketValue. Those run under the read lock, everything else under
+// the write lock.
 type Database struct {
 	db          *C.ol_database
 	RecordCount *C.int
-	mutex       *sync.Mutex
+	mutex       *sync.RWMutex
 }
 
 func Open(path, name string, features int) (Database, error) {
@@ -23,124 +36,415 @@ func Open(path, name string, features int) (Database, error) {
 		return Database{}, errors.New("Can't open database (NULL returned)")
 	}
 	database.RecordCount = &database.db.rcrd_cnt
-	database.mutex = &sync.Mutex{}
+	database.mutex = &sync.RWMutex{}
 	return database, nil
 }
 
-func (d Database) Close() int {
+func (d Database) Close() error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	return CClose(d.db)
+	if CClose(d.db) != 0 {
+		return opError("close", "", ErrFailed)
+	}
+	return nil
 }
 
-func (d Database) Unjar(key string) []byte {
+// OlegDB mostly says 1 for both a missing key and a failure, so callers
+// holding the write lock ask first
+func (d Database) exists(key string) bool {
+	return CExists(d.db, key, uintptr(len(key))) == 0
+}
+
+// The bucket of key, nil if it's missing or expired. It changes nothing, so
+// the read lock is enough.
+func (d Database) bucket(key string) *C.ol_bucket {
+	var _key string
+	var _klen uintptr
+	bucket := CGetBucket(d.db, key, uintptr(len(key)), &_key, &_klen)
+	if bucket == nil {
+		return nil
+	}
+	if expiration, ok := CBucketExpiration(bucket); ok && !expiration.After(time.Now()) {
+		return nil
+	}
+	return bucket
+}
+
+func (d Database) Unjar(key string) ([]byte, error) {
+	if err := checkKey("unjar", key); err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	bucket := d.bucket(key)
+	if bucket == nil {
+		d.mutex.RUnlock()
+		return nil, opError("unjar", key, ErrNotFound)
+	}
+	value, ok := CBucketValue(d.db, bucket)
+	d.mutex.RUnlock()
+	if ok {
+		return value, nil
+	}
+
+	// Leave it to OlegDB, which might scoop it
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	value, err := d.unjar(key)
+	if err != nil {
+		return nil, opError("unjar", key, err)
+	}
+	return value, nil
+}
+
+// ol_unjar with the write lock held. It fails for keys that have just
+// expired too, which are scooped by then, and those are ErrNotFound.
+func (d Database) unjar(key string) ([]byte, error) {
 	var dsize uintptr
-	return CUnjar(d.db, key, uintptr(len(key)), &dsize)
+	value := CUnjar(d.db, key, uintptr(len(key)), &dsize)
+	if value != nil {
+		return value, nil
+	}
+	if d.bucket(key) == nil {
+		return nil, ErrNotFound
+	}
+	return nil, ErrFailed
 }
 
-func (d Database) Jar(key string, value []byte) int {
+func (d Database) Jar(key string, value []byte) error {
+	if err := checkKey("jar", key); err != nil {
+		return err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	return CJar(d.db, key, uintptr(len(key)), value, uintptr(len(value)))
+	if CJar(d.db, key, uintptr(len(key)), value, uintptr(len(value))) != 0 {
+		return opError("jar", key, ErrFailed)
+	}
+	return nil
 }
 
-func (d Database) Scoop(key string) int {
+// Cas replaces the value of key with value, but only if it's currently old.
+// A missing key never matches.
+func (d Database) Cas(key string, old, value []byte) (swapped bool, err error) {
+	if err := checkKey("cas", key); err != nil {
+		return false, err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	return CScoop(d.db, key, uintptr(len(key)))
+	if !d.exists(key) {
+		return false, nil
+	}
+	if CCas(d.db, key, uintptr(len(key)), value, uintptr(len(value)), old, uintptr(len(old))) == 0 {
+		return true, nil
+	}
+
+	// ol_cas doesn't tell a mismatch from a failed jar, but we're still holding the lock
+	var dsize uintptr
+	current := CUnjar(d.db, key, uintptr(len(key)), &dsize)
+	if current != nil && bytes.Equal(current, old) {
+		return false, opError("cas", key, ErrFailed)
+	}
+	return false, nil
 }
 
-func (d Database) Uptime() int {
+func (d Database) Scoop(key string) error {
+	if err := checkKey("scoop", key); err != nil {
+		return err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
+	if !d.exists(key) {
+		return opError("scoop", key, ErrNotFound)
+	}
+	if CScoop(d.db, key, uintptr(len(key))) != 0 {
+		return opError("scoop", key, ErrFailed)
+	}
+	return nil
+}
+
+func (d Database) Uptime() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
 	return CUptime(d.db)
 }
 
-func (d Database) Expiration(key string) (time.Time, bool) {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	return CExpirationTime(d.db, key, uintptr(len(key)))
+// Expiration is the zero time for keys that never expire
+func (d Database) Expiration(key string) (time.Time, error) {
+	if err := checkKey("expiration", key); err != nil {
+		return time.Time{}, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	bucket := d.bucket(key)
+	if bucket == nil {
+		return time.Time{}, opError("expiration", key, ErrNotFound)
+	}
+	expiration, ok := CBucketExpiration(bucket)
+	if !ok {
+		return time.Time{}, nil
+	}
+	return expiration, nil
 }
 
-func (d Database) Spoil(key string, expiration time.Time) int {
+// Spoil sets when key expires, the zero time makes it never expire again
+func (d Database) Spoil(key string, expiration time.Time) error {
+	if err := checkKey("spoil", key); err != nil {
+		return err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	return CSpoil(d.db, key, uintptr(len(key)), expiration)
+	if !d.exists(key) {
+		return opError("spoil", key, ErrNotFound)
+	}
+	if expiration.IsZero() {
+		// OlegDB has no way to unset an expiration, but a key jarred from
+		// scratch has none
+		var dsize uintptr
+		value := CUnjar(d.db, key, uintptr(len(key)), &dsize)
+		if value == nil {
+			return opError("spoil", key, ErrFailed)
+		}
+		if CScoop(d.db, key, uintptr(len(key))) != 0 || CJar(d.db, key, uintptr(len(key)), value, uintptr(len(value))) != 0 {
+			return opError("spoil", key, ErrFailed)
+		}
+		return nil
+	}
+	if CSpoil(d.db, key, uintptr(len(key)), expiration) != 0 {
+		return opError("spoil", key, ErrFailed)
+	}
+	return nil
 }
 
-func (d Database) Exists(key string) bool {
-	d.mutex.Lock()
-	defer d.mutex.Unlock()
-	return CExists(d.db, key, uintptr(len(key))) == 0
+func (d Database) Exists(key string) (bool, error) {
+	if err := checkKey("exists", key); err != nil {
+		return false, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.bucket(key) != nil, nil
 }
 
-func (d Database) Squish() bool {
+func (d Database) Squish() error {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	return CSquish(d.db) == 1
+	if CSquish(d.db) != 1 {
+		return opError("squish", "", ErrFailed)
+	}
+	return nil
 }
 
-func (d Database) PrefixMatch(prefix string) (bool, []string) {
+// Keys from the splay tree, binary safe, or from OlegDB as C strings when
+// there's no tree. Expired keys are left out either way.
+func (d Database) keys(prefix string) []string {
+	d.mutex.RLock()
+	if keys, _, ok := CTreeScan(d.db, prefix, true, PrefixEnd(prefix), math.MaxInt); ok {
+		defer d.mutex.RUnlock()
+		return d.liveKeys(keys)
+	}
+	d.mutex.RUnlock()
+
+	// Without the tree to walk, leave it to OlegDB
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	len, out := CPrefixMatch(d.db, prefix, uintptr(len(prefix)))
-	return len >= 0, out
+	var keys []string
+	if prefix == "" {
+		_, keys = CDumpKeys(d.db)
+	} else {
+		_, keys = CPrefixMatch(d.db, prefix, uintptr(len(prefix)))
+	}
+	return d.liveKeys(keys)
+}
+
+func (d Database) liveKeys(keys []string) []string {
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if d.bucket(key) != nil {
+			out = append(out, key)
+		}
+	}
+	return out
+}
+
+// No matches isn't an error, it's an empty slice
+func (d Database) PrefixMatch(prefix string) ([]string, error) {
+	return d.keys(prefix), nil
+}
+
+func (d Database) DumpKeys() ([]string, error) {
+	return d.keys(""), nil
+}
+
+// Range walks the records from start to just before end, or to the last one
+// if end is empty, in key order. The lock is only held while reading a batch
+// of records, so the loop is free to use the database, and to stop early. A
+// value that can't be read comes out as an error, after which the scan stops.
+//
+// Without F_SPLAYTREE every key gets dumped and sorted when the scan starts,
+// and OlegDB dumps them as C strings, so keys with NULs in them are left out.
+func (d Database) Range(start, end string) iter.Seq2[Record, error] {
+	return scanSeq2(d, start, end)
 }
 
-func (d Database) DumpKeys() (bool, []string) {
+// RangeKeys is Range without the values, which never get read
+func (d Database) RangeKeys(start, end string) iter.Seq[string] {
+	return scanSeq(d, start, end)
+}
+
+// Keys walks the keys starting with prefix, in order
+func (d Database) Keys(prefix string) iter.Seq[string] {
+	return scanSeq(d, prefix, PrefixEnd(prefix))
+}
+
+// KeysBefore walks the keys before end backwards, from the last one if end
+// is empty. Like Range, it only holds the lock while reading a batch.
+func (d Database) KeysBefore(end string) iter.Seq[string] {
+	return scanBackSeq(d, end)
+}
+
+func (d Database) scan(from string, inclusive bool, end string, n int, values bool, sorted *sortedKeys) ([]Record, string, bool, error) {
+	d.mutex.RLock()
+	records, last, more, ok, err := d.scanBatch(from, inclusive, end, n, values, sorted, false)
+	d.mutex.RUnlock()
+	if ok {
+		return records, last, more, err
+	}
+
+	// Keys to sort, or values for ol_unjar
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	len, out := CDumpKeys(d.db)
-	return len >= 0, out
+	records, last, more, _, err = d.scanBatch(from, inclusive, end, n, values, sorted, true)
+	return records, last, more, err
 }
 
-func (d Database) First() (bool, string, []byte) {
+// One batch of a scan, ok is false if it needs the write lock and doesn't
+// have it. On an error, the records before the one that failed come with it.
+func (d Database) scanBatch(from string, inclusive bool, end string, n int, values bool, sorted *sortedKeys, writer bool) (records []Record, last string, more, ok bool, err error) {
+	keys, more, ok := CTreeScan(d.db, from, inclusive, end, n)
+	if !ok {
+		if !sorted.ok && !writer {
+			return nil, "", false, false, nil
+		}
+		if !sorted.ok {
+			_, all := CDumpKeys(d.db)
+			sorted.set(all)
+		}
+		keys, more = sorted.batch(from, inclusive, end, n)
+	}
+
+	records = make([]Record, 0, len(keys))
+	for _, key := range keys {
+		bucket := d.bucket(key)
+		if bucket == nil {
+			continue
+		}
+		record := Record{Key: key}
+		if values {
+			var ok bool
+			record.Value, ok = CBucketValue(d.db, bucket)
+			if !ok && !writer {
+				return nil, "", false, false, nil
+			}
+			if !ok {
+				record.Value, err = d.unjar(key)
+			}
+			if err == ErrNotFound {
+				// Expired since, and OlegDB scooped it
+				err = nil
+				continue
+			}
+			if err != nil {
+				return records, "", false, true, opError("range", key, err)
+			}
+		}
+		records = append(records, record)
+	}
+	return records, lastKey(keys, from), more, true, nil
+}
+
+func (d Database) scanBack(before string, n int, sorted *sortedKeys) ([]string, string, bool) {
+	d.mutex.RLock()
+	keys, more, ok := CTreeScanBack(d.db, before, n)
+	if !ok && sorted.ok {
+		keys, more = sorted.batchBack(before, n)
+		ok = true
+	}
+	if ok {
+		defer d.mutex.RUnlock()
+		return d.liveKeys(keys), lastKey(keys, before), more
+	}
+	d.mutex.RUnlock()
+
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	node := CNodeFirst(d.db)
+	_, all := CDumpKeys(d.db)
+	sorted.set(all)
+	keys, more = sorted.batchBack(before, n)
+	return d.liveKeys(keys), lastKey(keys, before), more
+}
+
+func (d Database) nodeGet(op string, node *C.ol_splay_tree_node) (string, []byte, error) {
 	if node == nil {
-		return false, "", nil
+		return "", nil, ErrEnd
 	}
-	return CNodeGet(d.db, node)
+	ok, key, value := CNodeGet(d.db, node)
+	if !ok {
+		return "", nil, opError(op, "", ErrFailed)
+	}
+	return key, value, nil
 }
 
-func (d Database) Last() (bool, string, []byte) {
+// First, Last, Next and Prev walk the keys in order, returning ErrEnd when
+// there are no more. Next and Prev need key to exist.
+func (d Database) First() (string, []byte, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	node := CNodeLast(d.db)
-	if node == nil {
-		return false, "", nil
-	}
-	return CNodeGet(d.db, node)
+	return d.nodeGet("first", CNodeFirst(d.db))
 }
 
-func (d Database) Next(key string) (bool, string, []byte) {
+func (d Database) Last() (string, []byte, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	node := CNodeNext(d.db, key, uintptr(len(key)))
-	if node == nil {
-		return false, "", nil
-	}
-	return CNodeGet(d.db, node)
+	return d.nodeGet("last", CNodeLast(d.db))
 }
 
-func (d Database) Prev(key string) (bool, string, []byte) {
+func (d Database) Next(key string) (string, []byte, error) {
+	if err := checkKey("next", key); err != nil {
+		return "", nil, err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	node := CNodePrev(d.db, key, uintptr(len(key)))
-	if node == nil {
-		return false, "", nil
+	if !d.exists(key) {
+		return "", nil, opError("next", key, ErrNotFound)
 	}
-	return CNodeGet(d.db, node)
+	return d.nodeGet("next", CNodeNext(d.db, key, uintptr(len(key))))
 }
 
-func (d Database) GetSize(key string) int {
+func (d Database) Prev(key string) (string, []byte, error) {
+	if err := checkKey("prev", key); err != nil {
+		return "", nil, err
+	}
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
-	var _key string
-	var _klen uintptr
-	bucket := CGetBucket(d.db, key, uintptr(len(key)), &_key, &_klen)
-	return int(bucket.original_size)
+	if !d.exists(key) {
+		return "", nil, opError("prev", key, ErrNotFound)
+	}
+	return d.nodeGet("prev", CNodePrev(d.db, key, uintptr(len(key))))
+}
+
+func (d Database) GetSize(key string) (int, error) {
+	if err := checkKey("size", key); err != nil {
+		return 0, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	bucket := d.bucket(key)
+	if bucket == nil {
+		return 0, opError("size", key, ErrNotFound)
+	}
+	return int(bucket.original_size), nil
+}
+
+func (d Database) Records() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return int(*d.RecordCount)
 }
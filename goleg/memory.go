@@ -0,0 +1,354 @@
+package goleg
+
+import (
+	"bytes"
+	"iter"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemDatabase is a pure Go, in-memory stand-in for Database, with the same
+// methods and semantics. It needs no liboleg, so it's handy for tests.
+// Nothing is ever written to disk. Values are replaced, never changed in
+// place, so readers copy them after letting go of the lock.
+type MemDatabase struct {
+	values      map[string][]byte
+	expirations map[string]time.Time
+	keys        []string // Sorted, like the splay tree
+	opened      time.Time
+	mutex       *sync.RWMutex // Readers leave expired keys for writers to drop
+}
+
+func OpenMemory() *MemDatabase {
+	return &MemDatabase{
+		values:      make(map[string][]byte),
+		expirations: make(map[string]time.Time),
+		keys:        make([]string, 0),
+		opened:      time.Now(),
+		mutex:       &sync.RWMutex{},
+	}
+}
+
+// Expired keys are dropped the first time a writer looks at them, like OlegDB does
+func (d *MemDatabase) live(key string) bool {
+	if d.has(key) {
+		return true
+	}
+	if _, ok := d.values[key]; ok {
+		d.remove(key)
+	}
+	return false
+}
+
+// Readers only need to know, they hold the read lock and can't drop anything
+func (d *MemDatabase) has(key string) bool {
+	if _, ok := d.values[key]; !ok {
+		return false
+	}
+	expiration, ok := d.expirations[key]
+	return !ok || expiration.After(time.Now())
+}
+
+func (d *MemDatabase) remove(key string) {
+	delete(d.values, key)
+	delete(d.expirations, key)
+	i := sort.SearchStrings(d.keys, key)
+	if i < len(d.keys) && d.keys[i] == key {
+		d.keys = append(d.keys[:i], d.keys[i+1:]...)
+	}
+}
+
+func (d *MemDatabase) jar(key string, value []byte) {
+	if _, ok := d.values[key]; !ok {
+		i := sort.SearchStrings(d.keys, key)
+		d.keys = append(d.keys, "")
+		copy(d.keys[i+1:], d.keys[i:])
+		d.keys[i] = key
+	}
+	delete(d.expirations, key)
+	d.values[key] = append([]byte{}, value...)
+}
+
+// The first live key from index i on, going forward or backward
+func (d *MemDatabase) step(i int, forward bool) (string, []byte, error) {
+	for i >= 0 && i < len(d.keys) {
+		key := d.keys[i]
+		if d.live(key) {
+			return key, append([]byte{}, d.values[key]...), nil
+		}
+		// live() removed it, so the next key moved to i
+		if !forward {
+			i--
+		}
+	}
+	return "", nil, ErrEnd
+}
+
+func (d *MemDatabase) Close() error {
+	return nil
+}
+
+func (d *MemDatabase) Unjar(key string) ([]byte, error) {
+	if err := checkKey("unjar", key); err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	value, ok := d.values[key]
+	ok = ok && d.has(key)
+	d.mutex.RUnlock()
+	if !ok {
+		return nil, opError("unjar", key, ErrNotFound)
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (d *MemDatabase) Jar(key string, value []byte) error {
+	if err := checkKey("jar", key); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.jar(key, value)
+	return nil
+}
+
+func (d *MemDatabase) Cas(key string, old, value []byte) (swapped bool, err error) {
+	if err := checkKey("cas", key); err != nil {
+		return false, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.live(key) || !bytes.Equal(d.values[key], old) {
+		return false, nil
+	}
+	d.jar(key, value)
+	return true, nil
+}
+
+func (d *MemDatabase) Scoop(key string) error {
+	if err := checkKey("scoop", key); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.live(key) {
+		return opError("scoop", key, ErrNotFound)
+	}
+	d.remove(key)
+	return nil
+}
+
+func (d *MemDatabase) Uptime() int {
+	return int(time.Since(d.opened).Seconds())
+}
+
+func (d *MemDatabase) Expiration(key string) (time.Time, error) {
+	if err := checkKey("expiration", key); err != nil {
+		return time.Time{}, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if !d.has(key) {
+		return time.Time{}, opError("expiration", key, ErrNotFound)
+	}
+	return d.expirations[key], nil
+}
+
+func (d *MemDatabase) Spoil(key string, expiration time.Time) error {
+	if err := checkKey("spoil", key); err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.live(key) {
+		return opError("spoil", key, ErrNotFound)
+	}
+	if expiration.IsZero() {
+		delete(d.expirations, key)
+		return nil
+	}
+	// OlegDB keeps expirations to the second
+	d.expirations[key] = expiration.Truncate(time.Second).Local()
+	return nil
+}
+
+func (d *MemDatabase) Exists(key string) (bool, error) {
+	if err := checkKey("exists", key); err != nil {
+		return false, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.has(key), nil
+}
+
+func (d *MemDatabase) Squish() error {
+	return nil
+}
+
+func (d *MemDatabase) PrefixMatch(prefix string) ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := make([]string, 0)
+	for _, key := range d.matching(prefix) {
+		if d.has(key) {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+func (d *MemDatabase) matching(prefix string) []string {
+	i := sort.SearchStrings(d.keys, prefix)
+	j := i
+	for j < len(d.keys) && strings.HasPrefix(d.keys[j], prefix) {
+		j++
+	}
+	return append([]string{}, d.keys[i:j]...)
+}
+
+func (d *MemDatabase) DumpKeys() ([]string, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	out := make([]string, 0)
+	for _, key := range d.keys {
+		if d.has(key) {
+			out = append(out, key)
+		}
+	}
+	return out, nil
+}
+
+func (d *MemDatabase) First() (string, []byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.step(0, true)
+}
+
+func (d *MemDatabase) Last() (string, []byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.step(len(d.keys)-1, false)
+}
+
+func (d *MemDatabase) Next(key string) (string, []byte, error) {
+	if err := checkKey("next", key); err != nil {
+		return "", nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.live(key) {
+		return "", nil, opError("next", key, ErrNotFound)
+	}
+	return d.step(sort.SearchStrings(d.keys, key)+1, true)
+}
+
+func (d *MemDatabase) Prev(key string) (string, []byte, error) {
+	if err := checkKey("prev", key); err != nil {
+		return "", nil, err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if !d.live(key) {
+		return "", nil, opError("prev", key, ErrNotFound)
+	}
+	return d.step(sort.SearchStrings(d.keys, key)-1, false)
+}
+
+func (d *MemDatabase) GetSize(key string) (int, error) {
+	if err := checkKey("size", key); err != nil {
+		return 0, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if !d.has(key) {
+		return 0, opError("size", key, ErrNotFound)
+	}
+	return len(d.values[key]), nil
+}
+
+func (d *MemDatabase) Records() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	count := 0
+	for _, key := range d.keys {
+		if d.has(key) {
+			count++
+		}
+	}
+	return count
+}
+
+func (d *MemDatabase) Range(start, end string) iter.Seq2[Record, error] {
+	return scanSeq2(d, start, end)
+}
+
+func (d *MemDatabase) RangeKeys(start, end string) iter.Seq[string] {
+	return scanSeq(d, start, end)
+}
+
+func (d *MemDatabase) Keys(prefix string) iter.Seq[string] {
+	return scanSeq(d, prefix, PrefixEnd(prefix))
+}
+
+func (d *MemDatabase) KeysBefore(end string) iter.Seq[string] {
+	return scanBackSeq(d, end)
+}
+
+// Keys are always sorted, so scans never need sorted
+func (d *MemDatabase) scanBack(before string, n int, _ *sortedKeys) ([]string, string, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	j := len(d.keys)
+	if before != "" {
+		j = sort.SearchStrings(d.keys, before)
+	}
+	i := max(j-n, 0)
+	keys := make([]string, 0, j-i)
+	for k := j - 1; k >= i; k-- {
+		if d.has(d.keys[k]) {
+			keys = append(keys, d.keys[k])
+		}
+	}
+	last := before
+	if j > i {
+		last = d.keys[i]
+	}
+	return keys, last, i > 0
+}
+
+func (d *MemDatabase) scan(from string, inclusive bool, end string, n int, values bool, _ *sortedKeys) ([]Record, string, bool, error) {
+	d.mutex.RLock()
+	i := sort.SearchStrings(d.keys, from)
+	if !inclusive && i < len(d.keys) && d.keys[i] == from {
+		i++
+	}
+	j := i
+	for j < len(d.keys) && j-i < n && (end == "" || d.keys[j] < end) {
+		j++
+	}
+	more := j < len(d.keys) && (end == "" || d.keys[j] < end)
+
+	keys := d.keys[i:j]
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		if !d.has(key) {
+			continue
+		}
+		record := Record{Key: key}
+		if values {
+			record.Value = d.values[key]
+		}
+		records = append(records, record)
+	}
+	last := lastKey(keys, from)
+	d.mutex.RUnlock()
+
+	if values {
+		for i := range records {
+			records[i].Value = append([]byte{}, records[i].Value...)
+		}
+	}
+	return records, last, more, nil
+}
@@ -0,0 +1,27 @@
+package goleg
+
+import (
+	"testing"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	testConformance(t, func(t *testing.T) (conformer, func()) {
+		return OpenMemory(), func() {}
+	})
+}
+
+func BenchmarkMemoryParallelUnjar(b *testing.B) {
+	benchLocking(b, OpenMemory(), benchParallelUnjar)
+}
+
+func BenchmarkMemoryParallelExists(b *testing.B) {
+	benchLocking(b, OpenMemory(), benchParallelExists)
+}
+
+func BenchmarkMemoryReadsDuringBigUnjar(b *testing.B) {
+	benchLocking(b, OpenMemory(), benchReadsDuringBigUnjar)
+}
+
+func BenchmarkMemoryParallelMixed(b *testing.B) {
+	benchLocking(b, OpenMemory(), benchParallelMixed)
+}
@@ -0,0 +1,159 @@
+package goleg
+
+import (
+	"iter"
+	"slices"
+	"sort"
+)
+
+// Scans read this many records each time they take the lock, and give it back
+// before handing them out, so the loop body is free to use the database.
+const scanBatch = 64
+
+// Record is what Range hands out for every key
+type Record struct {
+	Key   string
+	Value []byte
+}
+
+// Database and MemDatabase scan in batches: with their lock held, they read
+// up to n keys in order, from the first key after from (or from itself, when
+// inclusive) and stopping before end, which is unbounded when empty. They
+// hand back the live records among them, the last key they read to carry on
+// from, and whether there might be more. A value that can't be read is an
+// error, records are never just left out. scanBack does the same the other
+// way, keys only, last first, from the last key before before (from the
+// last one of all when it's empty).
+//
+// Both get the sortedKeys of the scan they're part of, for when they can't
+// seek and have to sort the keys themselves.
+type scanner interface {
+	scan(from string, inclusive bool, end string, n int, values bool, sorted *sortedKeys) ([]Record, string, bool, error)
+	scanBack(before string, n int, sorted *sortedKeys) ([]string, string, bool)
+}
+
+// Every key, sorted once for a whole scan. Keys jarred after that don't show
+// up, and scooped ones are skipped, since they're looked up before they're
+// handed out.
+type sortedKeys struct {
+	keys []string
+	ok   bool // Sorted already
+}
+
+// Duplicates are dropped, since keys with NULs in them can come back cut
+// short to a key that's there too
+func (s *sortedKeys) set(keys []string) {
+	sort.Strings(keys)
+	s.keys = slices.Compact(keys)
+	s.ok = true
+}
+
+// The batch of up to n keys a scan asks for, and whether there are more
+func (s *sortedKeys) batch(from string, inclusive bool, end string, n int) ([]string, bool) {
+	i := sort.SearchStrings(s.keys, from)
+	if !inclusive && i < len(s.keys) && s.keys[i] == from {
+		i++
+	}
+	j := i
+	for j < len(s.keys) && (end == "" || s.keys[j] < end) {
+		if j-i == n {
+			return s.keys[i:j], true
+		}
+		j++
+	}
+	return s.keys[i:j], false
+}
+
+// Up to n keys before before, last first, and whether there are more
+func (s *sortedKeys) batchBack(before string, n int) ([]string, bool) {
+	j := len(s.keys)
+	if before != "" {
+		j = sort.SearchStrings(s.keys, before)
+	}
+	i := max(j-n, 0)
+	keys := make([]string, 0, j-i)
+	for k := j - 1; k >= i; k-- {
+		keys = append(keys, s.keys[k])
+	}
+	return keys, i > 0
+}
+
+// Every batch starts from where the last one ended, so records jarred or
+// scooped during a scan show up or not depending on whether their batch was
+// read yet, but it never goes back or hands out a key twice. An error is
+// handed out on its own, and ends the scan.
+func scanAll(s scanner, start, end string, values bool, yield func(Record, error) bool) {
+	var sorted sortedKeys
+	from, inclusive := start, true
+	for {
+		records, last, more, err := s.scan(from, inclusive, end, scanBatch, values, &sorted)
+		for _, record := range records {
+			if !yield(record, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(Record{}, err)
+			return
+		}
+		if !more {
+			return
+		}
+		from, inclusive = last, false
+	}
+}
+
+func scanSeq2(s scanner, start, end string) iter.Seq2[Record, error] {
+	return func(yield func(Record, error) bool) {
+		scanAll(s, start, end, true, yield)
+	}
+}
+
+// Without values to read, there's nothing to fail
+func scanSeq(s scanner, start, end string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		scanAll(s, start, end, false, func(record Record, err error) bool {
+			return err == nil && yield(record.Key)
+		})
+	}
+}
+
+// Where a batch of keys ended, or from if it was empty
+func lastKey(keys []string, from string) string {
+	if len(keys) == 0 {
+		return from
+	}
+	return keys[len(keys)-1]
+}
+
+func scanBackSeq(s scanner, end string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		var sorted sortedKeys
+		before := end
+		for {
+			keys, last, more := s.scanBack(before, scanBatch, &sorted)
+			for _, key := range keys {
+				if !yield(key) {
+					return
+				}
+			}
+			if !more {
+				return
+			}
+			before = last
+		}
+	}
+}
+
+// PrefixEnd is the first key after every key starting with prefix, for use
+// as the end of a range. It's empty, so unbounded, when there's no such key.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
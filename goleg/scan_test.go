@@ -0,0 +1,100 @@
+package goleg
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSortedKeys(t *testing.T) {
+	var sorted sortedKeys
+	// "b\x00c" dumped as a C string is just "b"
+	sorted.set([]string{"d", "b", "a", "b", "c", "e"})
+
+	tests := []struct {
+		from      string
+		inclusive bool
+		end       string
+		n         int
+		want      string
+		more      bool
+	}{
+		{"", true, "", 10, "a b c d e", false},
+		{"", true, "", 2, "a b", true},
+		{"b", false, "", 2, "c d", true},
+		{"b", true, "d", 2, "b c", false},
+		{"c", false, "d", 5, "", false},
+		{"z", true, "", 5, "", false},
+	}
+	for _, test := range tests {
+		keys, more := sorted.batch(test.from, test.inclusive, test.end, test.n)
+		if strings.Join(keys, " ") != test.want || more != test.more {
+			t.Errorf("%+v gave %v, %v", test, keys, more)
+		}
+	}
+
+	if keys, more := sorted.batchBack("", 2); strings.Join(keys, " ") != "e d" || !more {
+		t.Errorf("Last 2 are %v, %v", keys, more)
+	}
+	if keys, more := sorted.batchBack("c", 5); strings.Join(keys, " ") != "b a" || more {
+		t.Errorf("Before c are %v, %v", keys, more)
+	}
+}
+
+// Has records up to fail, then can't read its value
+type failingScanner struct {
+	keys []string
+	fail string
+}
+
+func (s failingScanner) scan(from string, inclusive bool, end string, n int, values bool, sorted *sortedKeys) ([]Record, string, bool, error) {
+	if !sorted.ok {
+		sorted.set(s.keys)
+	}
+	keys, more := sorted.batch(from, inclusive, end, n)
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		if values && key == s.fail {
+			return records, "", false, opError("range", key, ErrFailed)
+		}
+		records = append(records, Record{Key: key})
+	}
+	return records, lastKey(keys, from), more, nil
+}
+
+func (s failingScanner) scanBack(before string, n int, sorted *sortedKeys) ([]string, string, bool) {
+	return nil, before, false
+}
+
+func TestScanErrors(t *testing.T) {
+	var keys []string
+	for i := 0; i < scanBatch*2; i++ {
+		keys = append(keys, string(rune('a'+i/26))+string(rune('a'+i%26)))
+	}
+	s := failingScanner{keys, keys[scanBatch+3]}
+
+	got := 0
+	var failed error
+	for record, err := range scanSeq2(s, "", "") {
+		if err != nil {
+			failed = err
+			break
+		}
+		if record.Key != keys[got] {
+			t.Fatalf("Got %s, expected %s", record.Key, keys[got])
+		}
+		got++
+	}
+	if got != scanBatch+3 || !errors.Is(failed, ErrFailed) {
+		t.Errorf("Got %d records, then %v", got, failed)
+	}
+
+	// Keys alone can't fail
+	got = 0
+	for range scanSeq(s, "", "") {
+		got++
+	}
+	if got != len(keys) {
+		t.Errorf("Got %d keys out of %d", got, len(keys))
+	}
+}
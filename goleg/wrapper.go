@@ -6,6 +6,9 @@ package goleg
 #include <stdlib.h>
 #include <olegdb/oleg.h>
 #include <olegdb/cursor.h>
+
+// Built into liboleg, which has no header of its own for it
+int LZ4_decompress_safe(const char *source, char *dest, int compressedSize, int maxDecompressedSize);
 */
 import "C"
 import (
@@ -19,6 +22,25 @@ const F_LZ4 = C.OL_F_LZ4
 const F_SPLAYTREE = C.OL_F_SPLAYTREE
 const F_AOL_FFLUSH = C.OL_F_AOL_FFLUSH
 
+// Keys go to OlegDB as a pointer and a length rather than as C strings, so
+// any byte survives, NUL included. OlegDB copies them before keeping them.
+// They're still NUL terminated, for anything in OlegDB that prints them.
+func cKey(key string) *C.char {
+	buf := make([]byte, len(key)+1)
+	copy(buf, key)
+	return (*C.char)(unsafe.Pointer(&buf[0]))
+}
+
+// Empty values still point somewhere, OlegDB doesn't expect NULL
+var emptyValue [1]byte
+
+func cValue(value []byte) *C.uchar {
+	if len(value) == 0 {
+		return (*C.uchar)(unsafe.Pointer(&emptyValue[0]))
+	}
+	return (*C.uchar)(unsafe.Pointer(&value[0]))
+}
+
 func COpen(path, name string, features int) *C.ol_database {
 	// Turn parameters into their C counterparts
 	cpath := C.CString(path)
@@ -39,8 +61,7 @@ func CClose(database *C.ol_database) int {
 
 func CUnjar(db *C.ol_database, key string, klen uintptr, dsize *uintptr) []byte {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 	cdsize := (*C.size_t)(unsafe.Pointer(dsize))
@@ -62,13 +83,12 @@ func CUnjar(db *C.ol_database, key string, klen uintptr, dsize *uintptr) []byte
 
 func CJar(db *C.ol_database, key string, klen uintptr, value []byte, vsize uintptr) int {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 	cvsize := (C.size_t)(vsize)
 
-	cvalue := (*C.uchar)(unsafe.Pointer(&value[0]))
+	cvalue := cValue(value)
 
 	// Pass them to ol_jar
 	return int(C.ol_jar(db, ckey, cklen, cvalue, cvsize))
@@ -76,8 +96,7 @@ func CJar(db *C.ol_database, key string, klen uintptr, value []byte, vsize uintp
 
 func CScoop(db *C.ol_database, key string, klen uintptr) int {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 
@@ -91,8 +110,7 @@ func CUptime(db *C.ol_database) int {
 
 func CExpirationTime(db *C.ol_database, key string, klen uintptr) (time.Time, bool) {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 
@@ -103,26 +121,61 @@ func CExpirationTime(db *C.ol_database, key string, klen uintptr) (time.Time, bo
 	if ctime == nil {
 		return time.Now(), false
 	}
+	return goTime(ctime), true
+}
+
+// CBucketExpiration reads the expiration straight off a bucket, unlike
+// ol_expiration_time which scoops the key if it's expired
+func CBucketExpiration(bucket *C.ol_bucket) (time.Time, bool) {
+	if bucket.expiration == nil {
+		return time.Time{}, false
+	}
+	return goTime(bucket.expiration), true
+}
+
+// CBucketValue reads the value of a bucket straight out of the values file,
+// the way ol_unjar does, but without looking at the expiration, so nothing
+// gets scooped and readers can share it. ok is false when the value isn't
+// where the bucket says, and it's up to ol_unjar.
+func CBucketValue(db *C.ol_database, bucket *C.ol_bucket) (value []byte, ok bool) {
+	if bucket.original_size == 0 {
+		return []byte{}, true
+	}
+	if db.values == nil || bucket.data_offset+bucket.data_size > db.val_size {
+		return nil, false
+	}
+	data := unsafe.Add(unsafe.Pointer(db.values), bucket.data_offset)
+	if db.feature_set&C.OL_F_LZ4 == 0 {
+		return C.GoBytes(data, C.int(bucket.data_size)), true
+	}
 
-	// Turn ctime into a Go datatype
-	gotime := time.Date(int(ctime.tm_year)+1900,
+	value = make([]byte, bucket.original_size)
+	n := C.LZ4_decompress_safe((*C.char)(data), (*C.char)(unsafe.Pointer(&value[0])),
+		C.int(bucket.data_size), C.int(bucket.original_size))
+	if n != C.int(bucket.original_size) {
+		return nil, false
+	}
+	return value, true
+}
+
+func goTime(ctime *C.struct_tm) time.Time {
+	return time.Date(int(ctime.tm_year)+1900,
 		time.Month(int(ctime.tm_mon)+1),
 		int(ctime.tm_mday),
 		int(ctime.tm_hour),
 		int(ctime.tm_min),
 		int(ctime.tm_sec),
 		0, time.Local)
-	return gotime, true
 }
 
 func CSpoil(db *C.ol_database, key string, klen uintptr, expiration time.Time) int {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 
-	exp := expiration
+	// OlegDB works with local time, same as CExpirationTime
+	exp := expiration.Local()
 
 	var ctime C.struct_tm
 	ctime.tm_year = C.int(exp.Year() - 1900)
@@ -139,8 +192,7 @@ func CSpoil(db *C.ol_database, key string, klen uintptr, expiration time.Time) i
 
 func CExists(db *C.ol_database, key string, klen uintptr) int {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 
@@ -151,26 +203,25 @@ func CSquish(db *C.ol_database) int {
 	return int(C.ol_squish(db))
 }
 
-func CCas(db *C.ol_database, key string, klen uintptr, value []byte, vsize uintptr, ovalue *[]byte, ovsize *uintptr) int {
+func CCas(db *C.ol_database, key string, klen uintptr, value []byte, vsize uintptr, ovalue []byte, ovsize uintptr) int {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	cklen := (C.size_t)(klen)
 	cvsize := (C.size_t)(vsize)
-	covsize := (C.size_t)(*ovsize)
+	covsize := (C.size_t)(ovsize)
 
-	cvalue := (*C.uchar)(unsafe.Pointer(&value[0]))
-	covalue := (*C.uchar)(unsafe.Pointer(ovalue))
+	// Point at the slice contents, not at the slice header
+	cvalue := cValue(value)
+	covalue := cValue(ovalue)
 
-	// Pass them to ol_jar
+	// Pass them to ol_cas
 	return int(C.ol_cas(db, ckey, cklen, cvalue, cvsize, covalue, covsize))
 }
 
 func CPrefixMatch(db *C.ol_database, prefix string, plen uintptr) (int, []string) {
 	// Turn parameters into their C counterparts
-	cprefix := C.CString(prefix)
-	defer C.free(unsafe.Pointer(cprefix))
+	cprefix := cKey(prefix)
 
 	cplen := (C.size_t)(plen)
 
@@ -226,10 +277,97 @@ func CDumpKeys(db *C.ol_database) (int, []string) {
 	return length, out
 }
 
+func nodeKey(node *C.ol_splay_tree_node) string {
+	bucket := (*C.ol_bucket)(node.ref_obj)
+	return C.GoStringN((*C.char)(unsafe.Pointer(&bucket.key)), C.int(bucket.klen))
+}
+
+// CTreeScan reads up to n keys in order from the splay tree, starting with
+// the first one after from, or at from when inclusive, and stopping before
+// end, unless it's empty. It only reads the tree, nothing gets splayed. more
+// is whether it stopped because of n. Without F_SPLAYTREE, ok is false.
+// Unlike ol_prefix_match and ol_key_dump, keys are read with their length,
+// so keys holding NULs come back whole.
+//
+// Seeking compares keys like Go does, which is the tree's order as long as
+// keys have no NULs in them.
+func CTreeScan(db *C.ol_database, from string, inclusive bool, end string, n int) (keys []string, more bool, ok bool) {
+	if db.tree == nil {
+		return nil, false, false
+	}
+	keys = make([]string, 0, min(n, scanBatch))
+	if db.tree.root == nil {
+		return keys, false, true
+	}
+
+	// The first node at or after from
+	var node *C.ol_splay_tree_node
+	for next := db.tree.root; next != nil; {
+		key := nodeKey(next)
+		if key > from || (inclusive && key == from) {
+			node = next
+			next = next.left
+		} else {
+			next = next.right
+		}
+	}
+
+	maximum := C.ols_subtree_maximum(db.tree.root)
+	for node != nil {
+		key := nodeKey(node)
+		if end != "" && key >= end {
+			break
+		}
+		if len(keys) == n {
+			return keys, true, true
+		}
+		keys = append(keys, key)
+		if node == maximum || C._olc_next(&node, maximum) == 0 {
+			break
+		}
+	}
+	return keys, false, true
+}
+
+// CTreeScanBack is CTreeScan going backwards: up to n keys in reverse order,
+// starting with the last one before before, or with the last one of all when
+// before is empty.
+func CTreeScanBack(db *C.ol_database, before string, n int) (keys []string, more bool, ok bool) {
+	if db.tree == nil {
+		return nil, false, false
+	}
+	keys = make([]string, 0, min(n, scanBatch))
+	if db.tree.root == nil {
+		return keys, false, true
+	}
+
+	// The last node before before
+	var node *C.ol_splay_tree_node
+	for next := db.tree.root; next != nil; {
+		if before == "" || nodeKey(next) < before {
+			node = next
+			next = next.right
+		} else {
+			next = next.left
+		}
+	}
+
+	minimum := C.ols_subtree_minimum(db.tree.root)
+	for node != nil {
+		if len(keys) == n {
+			return keys, true, true
+		}
+		keys = append(keys, nodeKey(node))
+		if node == minimum || C._olc_prev(&node, minimum) == 0 {
+			break
+		}
+	}
+	return keys, false, true
+}
+
 func CGetBucket(db *C.ol_database, key string, klen uintptr, _key *string, _klen *uintptr) *C.ol_bucket {
 	// Turn parameters into their C counterparts
-	ckey := C.CString(key)
-	defer C.free(unsafe.Pointer(ckey))
+	ckey := cKey(key)
 
 	var c_key [C.KEY_SIZE]C.char
 
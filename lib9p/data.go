@@ -34,6 +34,14 @@ const (
 	ErrUnknownFid   = "unknown fid"
 	ErrBadDirectory = "bad directory in wstat"
 	ErrNotOpen      = "file not open"
+	ErrExists       = "file already exists"
+	ErrNotDirectory = "not a directory"
+	ErrIO           = "i/o error"
+	ErrNotEmpty     = "directory not empty"
+	ErrInUse        = "file in use"
+	ErrNameTooLong  = "file name too long"
+	ErrTooBig       = "file too big"
+	ErrFlushed      = "request flushed" // Handlers return it for flushed requests, nothing gets sent
 )
 
 /* Fcall types */
@@ -121,6 +129,9 @@ const (
 	DmAppend = 0x40000000
 	DmExcl   = 0x20000000
 	DmTmp    = 0x04000000
+	DmRead   = 0x4
+	DmWrite  = 0x2
+	DmExec   = 0x1
 )
 
 /* Messages */
@@ -194,9 +205,24 @@ type CreateResponse struct {
 }
 
 type ReadRequest struct {
+	Fid     uint32
+	Offset  uint64
+	Count   uint32
+	Flushed func() bool // Whether a Tflush came for it, for reads that block
+}
+
+type WriteRequest struct {
 	Fid    uint32
 	Offset uint64
-	Count  uint32
+	Data   []byte
+}
+
+type WriteResponse struct {
+	Count uint32
+}
+
+type RemoveRequest struct {
+	Fid uint32
 }
 
 type StatRequest struct {
@@ -1,14 +1,25 @@
 package lib9p
 
-import "fmt"
+import (
+	"fmt"
+	"sync/atomic"
+)
 
-const (
-	DebugReq   = true
-	DebugSend  = true
-	DebugBytes = true
-	DebugANSI  = true
+/* Switched at runtime (ctl's "debug") while requests are being handled */
+var (
+	DebugReq   atomic.Bool
+	DebugSend  atomic.Bool
+	DebugBytes atomic.Bool
+	DebugANSI  atomic.Bool
 )
 
+func init() {
+	DebugReq.Store(true)
+	DebugSend.Store(true)
+	DebugBytes.Store(true)
+	DebugANSI.Store(true)
+}
+
 const (
 	CSend  = "33"
 	CRecv  = "32"
@@ -29,23 +40,32 @@ func debugWrt(msgType uint8, msgTag uint16, data interface{}) {
 	case Ropen:
 		open := data.(OpenResponse)
 		fmt.Printf(col(CSend, "R(OPEN) Qid %v IoUnit %d\n"), open.Qid, open.IoUnit)
+	case Rcreate:
+		create := data.(CreateResponse)
+		fmt.Printf(col(CSend, "R(CREATE) Qid %v IoUnit %d\n"), create.Qid, create.IoUnit)
 	case Rstat:
 		fmt.Printf(col(CSend, "R(STAT) Stat %v\n"), data.(StatResponse).Stat)
 	case Rerror:
 		fmt.Printf(col(CSend, "R(ERROR) %s\n"), data.(ErrorData).Message)
 	case Rread:
 		fmt.Printf(col(CSend, "R(READ) - Data (%d bytes) -\n"), dle(data.([]byte)[0:4]))
+	case Rwrite:
+		fmt.Printf(col(CSend, "R(WRITE) Count %d\n"), data.(WriteResponse).Count)
+	case Rwstat:
+		fmt.Print(col(CSend, "R(WSTAT)\n"))
+	case Rremove:
+		fmt.Print(col(CSend, "R(REMOVE)\n"))
 	case Rclunk:
-		fmt.Printf(col(CSend, "R(CLUNK)\n"))
+		fmt.Print(col(CSend, "R(CLUNK)\n"))
 	case Rflush:
-		fmt.Printf(col(CSend, "R(FLUSH)\n"))
+		fmt.Print(col(CSend, "R(FLUSH)\n"))
 	default:
 		fmt.Printf(col(CSend, "R(UNKNOWN) %v\n"), data)
 	}
 }
 
 func col(color string, str string) string {
-	if !DebugANSI {
+	if !DebugANSI.Load() {
 		return str
 	}
 
@@ -59,12 +59,62 @@ func dle(value []byte) (out uint64) {
 	return
 }
 
-func dstr(value []byte) string {
-	length := uint16(dle(value[0:2]))
-	if length == 0 {
+/*
+   Messages come from the network, so nothing in them can be trusted to fit.
+   A decoder reads fields one after the other, and once one of them would go
+   past the end it stops, with every field after that left zero.
+*/
+
+type decoder struct {
+	b     []byte
+	pos   int
+	short bool
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.short || n > len(d.b)-d.pos {
+		d.short = true
+		return make([]byte, n)
+	}
+	out := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return out
+}
+
+func (d *decoder) num(n int) uint64 {
+	return dle(d.next(n))
+}
+
+func (d *decoder) str() string {
+	length := int(d.num(2))
+	if d.short {
 		return ""
 	}
-	return string(value[2 : 2+length])
+	return string(d.next(length))
+}
+
+func (d *decoder) qid() Qid {
+	return Qid{
+		Type:    uint8(d.num(1)),
+		Version: uint32(d.num(4)),
+		PathId:  d.num(8),
+	}
+}
+
+func (d *decoder) stat() (stat Stat) {
+	d.num(2) // Size, which the fields tell anyway
+	stat.Type = uint16(d.num(2))
+	stat.Dev = uint32(d.num(4))
+	stat.Qid = d.qid()
+	stat.Mode = uint32(d.num(4))
+	stat.Atime = uint32(d.num(4))
+	stat.Mtime = uint32(d.num(4))
+	stat.Length = d.num(8)
+	stat.Name = d.str()
+	stat.Uid = d.str()
+	stat.Gid = d.str()
+	stat.Muid = d.str()
+	return
 }
 
 func pstr(str string) []byte {
@@ -108,3 +158,27 @@ func pstat(stat Stat) []byte {
 	copy(sbytes[s:e], pstr(stat.Muid))
 	return sbytes
 }
+
+/*
+   Directory reads return a sequence of packed Stat entries, and a single
+   read must never split an entry in half. The offset is the byte position in
+   the full listing, so we skip whole entries until we reach it.
+*/
+
+func PackDir(stats []Stat, offset uint64, count uint32) []byte {
+	out := make([]byte, 0)
+	var pos uint64
+	for _, stat := range stats {
+		entry := pstat(stat)
+		start := pos
+		pos += uint64(len(entry))
+		if start < offset {
+			continue
+		}
+		if len(out)+len(entry) > int(count) {
+			break
+		}
+		out = append(out[:], entry[:]...)
+	}
+	return out
+}
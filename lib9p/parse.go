@@ -1,80 +1,113 @@
 package lib9p
 
-func parseMsg(b []byte) (msg MessageInfo, data interface{}) {
-	msg.Length = uint32(dle(b[0:4]))
-	msg.Type = uint8(b[4])
-	msg.Tag = uint16(dle(b[5:7]))
+import "errors"
+
+func parseMsg(b []byte) (msg MessageInfo, data interface{}, err error) {
+	d := &decoder{b: b}
+	msg.Length = uint32(d.num(4))
+	msg.Type = uint8(d.num(1))
+	msg.Tag = uint16(d.num(2))
 
 	switch msg.Type {
 	case Tversion, Rversion:
 		data = VersionData{
-			MaxSize: uint32(dle(b[7:11])),
-			Version: dstr(b[11:]),
+			MaxSize: uint32(d.num(4)),
+			Version: d.str(),
 		}
 	case Tauth:
-		uname := dstr(b[11:])
-		aname := dstr(b[13+len(uname):])
 		data = AuthRequest{
-			Afid:  uint32(dle(b[7:11])),
-			Uname: uname,
-			Aname: aname,
+			Afid:  uint32(d.num(4)),
+			Uname: d.str(),
+			Aname: d.str(),
 		}
 	case Tattach:
-		uname := dstr(b[15:])
-		aname := dstr(b[17+len(uname):])
 		data = AttachRequest{
-			Fid:   uint32(dle(b[7:11])),
-			Afid:  uint32(dle(b[11:15])),
-			Uname: uname,
-			Aname: aname,
+			Fid:   uint32(d.num(4)),
+			Afid:  uint32(d.num(4)),
+			Uname: d.str(),
+			Aname: d.str(),
 		}
 	case Twalk:
-		nopaths := uint16(dle(b[15:17]))
-		paths := make([]string, nopaths)
-		offset := 17
-		for i := range paths {
-			paths[i] = dstr(b[offset:])
-			offset += 2 + len(paths[i])
-		}
-		data = WalkRequest{
-			Fid:    uint32(dle(b[7:11])),
-			NewFid: uint32(dle(b[11:15])),
-			Paths:  paths,
+		walk := WalkRequest{
+			Fid:    uint32(d.num(4)),
+			NewFid: uint32(d.num(4)),
+		}
+		nopaths := int(d.num(2))
+		/* Every path takes at least its two length bytes */
+		if nopaths > (len(b)-d.pos)/2 {
+			return msg, nil, errors.New(ErrBotch)
+		}
+		walk.Paths = make([]string, nopaths)
+		for i := range walk.Paths {
+			walk.Paths[i] = d.str()
 		}
+		data = walk
 	case Tclunk:
 		data = ClunkRequest{
-			Fid: uint32(dle(b[7:11])),
+			Fid: uint32(d.num(4)),
 		}
 	case Topen:
 		data = OpenRequest{
-			Fid:  uint32(dle(b[7:11])),
-			Mode: uint8(b[11]),
+			Fid:  uint32(d.num(4)),
+			Mode: uint8(d.num(1)),
+		}
+	case Tcreate:
+		data = CreateRequest{
+			Fid:        uint32(d.num(4)),
+			Name:       d.str(),
+			Permission: uint32(d.num(4)),
+			Mode:       uint8(d.num(1)),
 		}
 	case Tread:
 		data = ReadRequest{
-			Fid:    uint32(dle(b[7:11])),
-			Offset: uint64(dle(b[11:19])),
-			Count:  uint32(dle(b[19:23])),
+			Fid:    uint32(d.num(4)),
+			Offset: d.num(8),
+			Count:  uint32(d.num(4)),
+		}
+	case Twrite:
+		write := WriteRequest{
+			Fid:    uint32(d.num(4)),
+			Offset: d.num(8),
+		}
+		count := d.num(4)
+		if count > uint64(len(b)-d.pos) {
+			return msg, nil, errors.New(ErrBotch)
+		}
+		write.Data = d.next(int(count))
+		data = write
+	case Twstat:
+		wstat := WstatRequest{
+			Fid: uint32(d.num(4)),
+		}
+		d.num(2) // Length of the stat that follows
+		wstat.Stat = d.stat()
+		data = wstat
+	case Tremove:
+		data = RemoveRequest{
+			Fid: uint32(d.num(4)),
 		}
 	case Tstat:
 		data = StatRequest{
-			Fid: uint32(dle(b[7:11])),
+			Fid: uint32(d.num(4)),
 		}
 	case Tflush:
 		data = FlushRequest{
-			OldTag: uint32(dle(b[7:11])),
+			OldTag: uint32(d.num(2)),
 		}
 	default:
 		data = UnknownData{
-			Raw: b[7:],
+			Raw: d.next(len(b) - d.pos),
 		}
 	}
+	if d.short {
+		return msg, nil, errors.New(ErrBotch)
+	}
 	return
 }
 
 func makeMsg(msgType uint8, msgTag uint16, data interface{}) []byte {
 	var bytes []byte
-	if DebugSend {
+	if DebugSend.Load() {
 		debugWrt(msgType, msgTag, data)
 	}
 	switch data.(type) {
@@ -95,6 +128,12 @@ func makeMsg(msgType uint8, msgTag uint16, data interface{}) []byte {
 		open := data.(OpenResponse)
 		bytes = pqid(open.Qid)
 		bytes = append(bytes[:], le(open.IoUnit)[:]...)
+	case CreateResponse:
+		create := data.(CreateResponse)
+		bytes = pqid(create.Qid)
+		bytes = append(bytes[:], le(create.IoUnit)[:]...)
+	case WriteResponse:
+		bytes = le(data.(WriteResponse).Count)
 	case StatResponse:
 		bytes = pack(pstat(data.(StatResponse).Stat), 2)
 	case ErrorData:
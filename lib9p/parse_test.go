@@ -0,0 +1,64 @@
+package lib9p
+
+import (
+	"testing"
+)
+
+func body(fields ...[]byte) (out []byte) {
+	for _, field := range fields {
+		out = append(out, field...)
+	}
+	return
+}
+
+func TestParseTruncated(t *testing.T) {
+	messages := [][]byte{
+		makeMsg(Tversion, 1, body(le(uint32(8192)), pstr("9P2000"))),
+		makeMsg(Tattach, 1, body(le(uint32(0)), le(uint32(NoFid)), pstr("glenda"), pstr("db"))),
+		makeMsg(Twalk, 1, body(le(uint32(0)), le(uint32(1)), le(uint16(2)), pstr("a"), pstr("b"))),
+		makeMsg(Tcreate, 1, body(le(uint32(0)), pstr("file"), le(uint32(0644)), []byte{MWrite})),
+		makeMsg(Twrite, 1, body(le(uint32(0)), le(uint64(0)), le(uint32(5)), []byte("hello"))),
+		makeMsg(Twstat, 1, body(le(uint32(0)), pack(pstat(Stat{Name: "file"}), 2))),
+		makeMsg(Tflush, 1, le(uint16(7))),
+	}
+	for _, msg := range messages {
+		_, _, err := parseMsg(msg)
+		if err != nil {
+			t.Fatalf("Type %d: can't parse the whole message: %s", msg[4], err.Error())
+		}
+		for end := 7; end < len(msg); end++ {
+			_, _, err := parseMsg(msg[:end])
+			if err == nil {
+				t.Fatalf("Type %d: parsed %d of %d bytes without an error", msg[4], end, len(msg))
+			}
+		}
+	}
+}
+
+func TestParseWriteCount(t *testing.T) {
+	// The count says more than the message holds
+	msg := makeMsg(Twrite, 1, body(le(uint32(0)), le(uint64(0)), le(uint32(1<<30)), []byte("hello")))
+	_, _, err := parseMsg(msg)
+	if err == nil || err.Error() != ErrBotch {
+		t.Fatalf("Expected %q, got %v", ErrBotch, err)
+	}
+
+	msg = makeMsg(Twrite, 1, body(le(uint32(0)), le(uint64(0)), le(uint32(5)), []byte("hello")))
+	_, data, err := parseMsg(msg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if string(data.(WriteRequest).Data) != "hello" {
+		t.Fatalf("Expected %q, got %q", "hello", data.(WriteRequest).Data)
+	}
+}
+
+func TestParseFlush(t *testing.T) {
+	_, data, err := parseMsg(makeMsg(Tflush, 1, le(uint16(7))))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if data.(FlushRequest).OldTag != 7 {
+		t.Fatalf("Expected old tag 7, got %d", data.(FlushRequest).OldTag)
+	}
+}
@@ -12,17 +12,26 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 type Server struct {
-	OnConnError func(net.Conn, error) /* "On connection error" Handler */
-	OnAuth      func(net.Conn, AuthRequest) (AuthResponse, error)
-	OnAttach    func(net.Conn, AttachRequest) (AttachResponse, error)
-	OnWalk      func(net.Conn, WalkRequest) (WalkResponse, error)
-	OnOpen      func(net.Conn, OpenRequest) (OpenResponse, error)
-	OnRead      func(net.Conn, ReadRequest) ([]byte, error)
-	OnStat      func(net.Conn, StatRequest) (StatResponse, error)
-	OnClunk     func(net.Conn, ClunkRequest) error
+	MaxSize      uint32                /* Largest message accepted, 0 for whatever the client asks */
+	OnConnError  func(net.Conn, error) /* "On connection error" Handler */
+	OnDisconnect func(net.Conn)        /* Called once the client has gone away */
+	OnAuth       func(net.Conn, AuthRequest) (AuthResponse, error)
+	OnAttach     func(net.Conn, AttachRequest) (AttachResponse, error)
+	OnWalk       func(net.Conn, WalkRequest) (WalkResponse, error)
+	OnOpen       func(net.Conn, OpenRequest) (OpenResponse, error)
+	OnCreate     func(net.Conn, CreateRequest) (CreateResponse, error)
+	OnRead       func(net.Conn, ReadRequest) ([]byte, error)
+	OnWrite      func(net.Conn, WriteRequest) (WriteResponse, error)
+	OnRemove     func(net.Conn, RemoveRequest) error
+	OnStat       func(net.Conn, StatRequest) (StatResponse, error)
+	OnWstat      func(net.Conn, WstatRequest) error
+	OnClunk      func(net.Conn, ClunkRequest) error
+	OnFlush      func(net.Conn, FlushRequest) /* Called on a Tflush of a request in progress, marked flushed already, which the Rflush then waits for */
 }
 
 func (s *Server) Listen(address string) error {
@@ -44,8 +53,57 @@ func (s *Server) Listen(address string) error {
 	}
 }
 
+/*
+   Every message gets handled on its own goroutine, so a Tflush can get
+   handled before the request it flushes. Requests are registered here, in
+   the order they come in, before their handler even starts. The Rflush
+   waits until the flushed request is done, so whatever reply it still
+   sends comes first, as the protocol wants.
+*/
+
+type tagSet struct {
+	mutex  sync.Mutex
+	active map[uint16]*request /* Requests not answered yet, by tag */
+}
+
+type request struct {
+	tag      uint16
+	flushed  atomic.Bool
+	finished chan struct{} /* Closed once the handler is done, replied or not */
+}
+
+func (t *tagSet) start(tag uint16) *request {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	req := &request{tag: tag, finished: make(chan struct{})}
+	t.active[tag] = req
+	return req
+}
+
+func (t *tagSet) done(req *request) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	close(req.finished)
+	/* Flushed tags can be in use by a newer request already */
+	if t.active[req.tag] == req {
+		delete(t.active, req.tag)
+	}
+}
+
+/* Marks the request with the tag as flushed, nil if there's none */
+func (t *tagSet) flush(tag uint16) *request {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	req, ok := t.active[tag]
+	if ok {
+		req.flushed.Store(true)
+	}
+	return req
+}
+
 func readClient(s *Server, con net.Conn) {
 	b := bufio.NewReader(con)
+	tags := &tagSet{active: make(map[uint16]*request)}
 	for {
 		/* Read the total message length */
 		bytes, err := b.Peek(4)
@@ -56,6 +114,14 @@ func readClient(s *Server, con net.Conn) {
 			break
 		}
 		length := uint32(dle(bytes))
+		if length < 7 {
+			s.OnConnError(con, fmt.Errorf("message of %d bytes is too short", length))
+			break
+		}
+		if s.MaxSize != 0 && length > s.MaxSize {
+			s.OnConnError(con, fmt.Errorf("message of %d bytes is over msize", length))
+			break
+		}
 
 		/* Read the whole message */
 		remaining := length
@@ -71,21 +137,41 @@ func readClient(s *Server, con net.Conn) {
 			remaining -= uint32(n)
 		}
 
-		go handle(s, con, rawmsg)
+		if uint32(len(rawmsg)) < length {
+			break
+		}
+		req := tags.start(uint16(dle(rawmsg[5:7])))
+		go handle(s, con, rawmsg, tags, req)
+	}
+
+	con.Close()
+	if s.OnDisconnect != nil {
+		s.OnDisconnect(con)
 	}
 }
 
-func handle(s *Server, con net.Conn, rawmsg []byte) {
-	if DebugBytes {
+func handle(s *Server, con net.Conn, rawmsg []byte, tags *tagSet, req *request) {
+	defer tags.done(req)
+	if DebugBytes.Load() {
 		fmt.Printf(col(CBytes, "\nRECV > %0#x\n"), rawmsg)
 	}
-	msg, data := parseMsg(rawmsg)
+	msg, data, err := parseMsg(rawmsg)
+	if err != nil {
+		if DebugReq.Load() {
+			fmt.Printf(col(CRecv, "(MALFORMED) Type %d\n"), msg.Type)
+		}
+		sendErr(con, msg.Tag, err.Error())
+		return
+	}
 	switch data.(type) {
 	case VersionData:
 		ver := data.(VersionData)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(VERSION) MaxSize %d Version \"%s\"\n"), ver.MaxSize, ver.Version)
 		}
+		if s.MaxSize != 0 && ver.MaxSize > s.MaxSize {
+			ver.MaxSize = s.MaxSize
+		}
 		err := write(con, makeMsg(Rversion, msg.Tag, ver))
 		if err != nil {
 			s.OnConnError(con, err)
@@ -94,7 +180,7 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 
 	case AuthRequest:
 		auth := data.(AuthRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(AUTH) Afid %0#8x Uname \"%s\" Aname \"%s\"\n"), auth.Afid, auth.Uname, auth.Aname)
 		}
 		if s.OnAuth != nil {
@@ -116,7 +202,7 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 
 	case AttachRequest:
 		att := data.(AttachRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(ATTACH) Fid %0#8x Afid %0#8x Uname \"%s\" Aname \"%s\"\n"), att.Fid, att.Afid, att.Uname, att.Aname)
 		}
 		if s.OnAttach != nil {
@@ -135,7 +221,7 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 
 	case WalkRequest:
 		walk := data.(WalkRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(WALK) Fid %0#8x NewFid %0#8x Paths %v\n"), walk.Fid, walk.NewFid, walk.Paths)
 		}
 		if s.OnWalk != nil {
@@ -153,7 +239,7 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 		sendErr(con, msg.Tag, "not implemented")
 
 	case ClunkRequest:
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(CLUNK) Fid %0#8x\n"), data.(ClunkRequest).Fid)
 		}
 		if s.OnClunk != nil {
@@ -172,7 +258,7 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 
 	case OpenRequest:
 		open := data.(OpenRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(OPEN) Fid %0#8x Mode %0#2x\n"), open.Fid, open.Mode)
 		}
 		if s.OnOpen != nil {
@@ -189,14 +275,37 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 		}
 		sendErr(con, msg.Tag, "not implemented")
 
+	case CreateRequest:
+		create := data.(CreateRequest)
+		if DebugReq.Load() {
+			fmt.Printf(col(CRecv, "(CREATE) Fid %0#8x Name \"%s\" Permission %0#8x Mode %0#2x\n"), create.Fid, create.Name, create.Permission, create.Mode)
+		}
+		if s.OnCreate != nil {
+			resp, err := s.OnCreate(con, create)
+			if err != nil {
+				sendErr(con, msg.Tag, err.Error())
+				break
+			}
+			err = write(con, makeMsg(Rcreate, msg.Tag, resp))
+			if err != nil {
+				s.OnConnError(con, err)
+			}
+			break
+		}
+		sendErr(con, msg.Tag, "not implemented")
+
 	case ReadRequest:
 		read := data.(ReadRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(READ) Fid %0#8x Offset %0#16x Count %0#8x\n"), read.Fid, read.Offset, read.Count)
 		}
 		if s.OnRead != nil {
+			read.Flushed = req.flushed.Load
 			resp, err := s.OnRead(con, read)
 			resp = append(le(uint32(len(resp)))[:], resp[:]...)
+			if err != nil && err.Error() == ErrFlushed {
+				break
+			}
 			if err != nil {
 				sendErr(con, msg.Tag, err.Error())
 				break
@@ -209,8 +318,45 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 		}
 		sendErr(con, msg.Tag, "not implemented")
 
+	case WriteRequest:
+		wrt := data.(WriteRequest)
+		if DebugReq.Load() {
+			fmt.Printf(col(CRecv, "(WRITE) Fid %0#8x Offset %0#16x Count %0#8x\n"), wrt.Fid, wrt.Offset, len(wrt.Data))
+		}
+		if s.OnWrite != nil {
+			resp, err := s.OnWrite(con, wrt)
+			if err != nil {
+				sendErr(con, msg.Tag, err.Error())
+				break
+			}
+			err = write(con, makeMsg(Rwrite, msg.Tag, resp))
+			if err != nil {
+				s.OnConnError(con, err)
+			}
+			break
+		}
+		sendErr(con, msg.Tag, "not implemented")
+
+	case RemoveRequest:
+		if DebugReq.Load() {
+			fmt.Printf(col(CRecv, "(REMOVE) Fid %0#8x\n"), data.(RemoveRequest).Fid)
+		}
+		if s.OnRemove != nil {
+			err := s.OnRemove(con, data.(RemoveRequest))
+			if err != nil {
+				sendErr(con, msg.Tag, err.Error())
+				break
+			}
+			err = write(con, makeMsg(Rremove, msg.Tag, nil))
+			if err != nil {
+				s.OnConnError(con, err)
+			}
+			break
+		}
+		sendErr(con, msg.Tag, "not implemented")
+
 	case StatRequest:
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(STAT) Fid %0#8x\n"), data.(StatRequest).Fid)
 		}
 		if s.OnStat != nil {
@@ -227,19 +373,45 @@ func handle(s *Server, con net.Conn, rawmsg []byte) {
 		}
 		sendErr(con, msg.Tag, "not implemented")
 
+	case WstatRequest:
+		wstat := data.(WstatRequest)
+		if DebugReq.Load() {
+			fmt.Printf(col(CRecv, "(WSTAT) Fid %0#8x Stat %v\n"), wstat.Fid, wstat.Stat)
+		}
+		if s.OnWstat != nil {
+			err := s.OnWstat(con, wstat)
+			if err != nil {
+				sendErr(con, msg.Tag, err.Error())
+				break
+			}
+			err = write(con, makeMsg(Rwstat, msg.Tag, nil))
+			if err != nil {
+				s.OnConnError(con, err)
+			}
+			break
+		}
+		sendErr(con, msg.Tag, "not implemented")
+
 	case FlushRequest:
 		flu := data.(FlushRequest)
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(FLUSH) Tag %0#8x OldTag %0#8x\n"), msg.Tag, flu.OldTag)
 		}
-		//TODO abort operation with specified tag
+		/* A Tflush of its own tag has nothing to wait for */
+		old := tags.flush(uint16(flu.OldTag))
+		if old != nil && old != req {
+			if s.OnFlush != nil {
+				s.OnFlush(con, flu)
+			}
+			<-old.finished
+		}
 		err := write(con, makeMsg(Rflush, msg.Tag, nil))
 		if err != nil {
 			s.OnConnError(con, err)
 		}
 
 	case UnknownData:
-		if DebugReq {
+		if DebugReq.Load() {
 			fmt.Printf(col(CRecv, "(UNKNOWN) Type %d Tag %0#8x Data %x\n"), msg.Type, msg.Tag, data.(UnknownData).Raw)
 		}
 		sendErr(con, msg.Tag, "unknown command")
@@ -257,7 +429,7 @@ func parseAddr(addr string) string {
 }
 
 func write(con net.Conn, data []byte) error {
-	if DebugBytes {
+	if DebugBytes.Load() {
 		fmt.Printf(col(CBytes, "SEND < %0#x\n"), data)
 	}
 	remaining := len(data)
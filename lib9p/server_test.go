@@ -0,0 +1,142 @@
+package lib9p
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func readMsg(t *testing.T, con net.Conn) []byte {
+	t.Helper()
+	size := make([]byte, 4)
+	_, err := io.ReadFull(con, size)
+	if err != nil {
+		t.Fatalf("Can't read a reply: %s", err.Error())
+	}
+	msg := make([]byte, dle(size)-4)
+	_, err = io.ReadFull(con, msg)
+	if err != nil {
+		t.Fatalf("Can't read a reply: %s", err.Error())
+	}
+	return append(size, msg...)
+}
+
+func TestFlushBeforeRead(t *testing.T) {
+	// The read only gets going once the Tflush has been handled
+	flushed := make(chan bool)
+	s := &Server{
+		OnConnError: func(net.Conn, error) {},
+		OnRead: func(con net.Conn, req ReadRequest) ([]byte, error) {
+			<-flushed
+			if req.Flushed() {
+				return nil, errors.New(ErrFlushed)
+			}
+			return []byte("too late"), nil
+		},
+		OnFlush: func(net.Conn, FlushRequest) {
+			close(flushed)
+		},
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go readClient(s, server)
+
+	msgs := body(
+		makeMsg(Tread, 1, body(le(uint32(0)), le(uint64(0)), le(uint32(100)))),
+		makeMsg(Tflush, 2, le(uint16(1))),
+	)
+	err := write(client, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := readMsg(t, client)
+	if reply[4] != Rflush || dle(reply[5:7]) != 2 {
+		t.Fatalf("Expected Rflush for tag 2, got %x", reply)
+	}
+
+	// Nothing else, the read was flushed
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Got a reply to the flushed read")
+	}
+}
+
+func TestFlushAfterReply(t *testing.T) {
+	// A request that still answers once it's flushed does so before the Rflush
+	flushed := make(chan bool)
+	s := &Server{
+		OnConnError: func(net.Conn, error) {},
+		OnWalk: func(con net.Conn, req WalkRequest) (WalkResponse, error) {
+			<-flushed
+			return WalkResponse{}, nil
+		},
+		OnFlush: func(net.Conn, FlushRequest) {
+			close(flushed)
+		},
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go readClient(s, server)
+
+	msgs := body(
+		makeMsg(Twalk, 1, body(le(uint32(0)), le(uint32(1)), le(uint16(0)))),
+		makeMsg(Tflush, 2, le(uint16(1))),
+	)
+	err := write(client, msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := readMsg(t, client)
+	if reply[4] != Rwalk || dle(reply[5:7]) != 1 {
+		t.Fatalf("Expected Rwalk for tag 1, got %x", reply)
+	}
+	reply = readMsg(t, client)
+	if reply[4] != Rflush || dle(reply[5:7]) != 2 {
+		t.Fatalf("Expected Rflush for tag 2, got %x", reply)
+	}
+}
+
+func TestFlushItself(t *testing.T) {
+	s := &Server{OnConnError: func(net.Conn, error) {}}
+	server, client := net.Pipe()
+	defer client.Close()
+	go readClient(s, server)
+
+	err := write(client, makeMsg(Tflush, 1, le(uint16(1))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := readMsg(t, client)
+	if reply[4] != Rflush || dle(reply[5:7]) != 1 {
+		t.Fatalf("Expected Rflush for tag 1, got %x", reply)
+	}
+}
+
+func TestFlushDone(t *testing.T) {
+	// Flushing a tag that's been answered already doesn't flush its next use
+	var reads []bool
+	s := &Server{
+		OnConnError: func(net.Conn, error) {},
+		OnRead: func(con net.Conn, req ReadRequest) ([]byte, error) {
+			reads = append(reads, req.Flushed())
+			return []byte("data"), nil
+		},
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	go readClient(s, server)
+
+	read := makeMsg(Tread, 1, body(le(uint32(0)), le(uint64(0)), le(uint32(100))))
+	for _, msg := range [][]byte{read, makeMsg(Tflush, 2, le(uint16(1))), read} {
+		err := write(client, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readMsg(t, client)
+	}
+	if len(reads) != 2 || reads[0] || reads[1] {
+		t.Fatalf("Reads saw themselves flushed: %v", reads)
+	}
+}
@@ -1,18 +1,41 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
+	"strings"
 )
 
-const listenaddr = "*"
-
 func main() {
-	ofs := makeFs("data", "oleg")
-	defer ofs.db.Close()
+	config, err := parseArgs(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "9oleg: "+err.Error())
+		os.Exit(2)
+	}
+	config.apply()
 
-	fmt.Println("Listening on " + listenaddr)
-	err := ofs.vfs.Listen(listenaddr)
+	srv, err := makeServer(config)
 	if err != nil {
-		panic(err.Error())
+		fmt.Fprintln(os.Stderr, "9oleg: "+err.Error())
+		os.Exit(1)
 	}
+
+	// Any listener failing takes everything down
+	errs := make(chan error)
+	for _, addr := range config.Listen {
+		go func(addr string) {
+			err := srv.vfs.Listen(addr)
+			errs <- fmt.Errorf("listen on %s: %s", addr, err.Error())
+		}(addr)
+	}
+	logf(LogInfo, "Listening on %s", strings.Join(config.Listen, " "))
+
+	err = <-errs
+	srv.closeAll()
+	fmt.Fprintln(os.Stderr, "9oleg: "+err.Error())
+	os.Exit(1)
 }
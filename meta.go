@@ -0,0 +1,348 @@
+/*
+   Metadata store
+
+   Everything OlegFs keeps about a key (its Stat, its qid path, empty
+   directory markers) lives in the same database, under keys starting with
+   reservedPrefix. User keys that start with it too are stored with the
+   prefix doubled, so the two can never be mistaken for each other.
+
+   Metadata is always indexed by database key (see dataKey), it is updated
+   in the same commit as the data and removed together with it.
+*/
+
+package main
+
+import (
+	"./goleg"
+	"./lib9p"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const reservedPrefix = "_ofs"
+
+const (
+	metaPrefix = reservedPrefix + "meta_"    // JSON encoded Stat of a key
+	dirMarker  = reservedPrefix + "dir_"     // Empty directory made with mkdir
+	qidPrefix  = reservedPrefix + "qid_"     // Qid path of a key
+	qidCounter = reservedPrefix + "nextqid_" // Next free qid path
+	formatKey  = reservedPrefix + "format_"  // Set once the database is laid out like this, see Migrate
+)
+
+/*
+   Clients use the qid path as the inode number, so every key and directory
+   gets its own, taken from a counter when OlegFs creates it. The lowest ids
+   are reserved for the root and synthetic files.
+
+   Keys that got into the database some other way have no id stored, and
+   looking at them mustn't write one, so theirs is a hash of the key with
+   hashedQid set. The counter never gets anywhere near it. Two keys can hash
+   to the same id, so the ids handed out are remembered, along with hashed
+   ids stored before, and a key whose id is taken gets the next free one.
+   The first time OlegFs saves metadata for such a key, the id it has been
+   going by is stored, so it keeps it from then on.
+*/
+
+const firstKeyQid = 256
+
+const hashedQid = 1 << 47
+
+/* Set on the qid path of a companion file, see expiresFile */
+const companionQid = 1 << 63
+
+type MetaStore struct {
+	db     Store
+	hashed *hashedIds
+}
+
+/* Ids handed out to keys without one stored, both ways */
+type hashedIds struct {
+	mutex  sync.Mutex
+	keys   map[uint64]string
+	ids    map[string]uint64
+	loaded bool // Hashed ids stored in the database are in keys
+}
+
+func makeMetaStore(db Store) MetaStore {
+	return MetaStore{db: db, hashed: &hashedIds{
+		keys: make(map[uint64]string),
+		ids:  make(map[string]uint64),
+	}}
+}
+
+func dataKey(key string) string {
+	if strings.HasPrefix(key, reservedPrefix) {
+		return reservedPrefix + key
+	}
+	return key
+}
+
+func userKey(key string) (string, bool) {
+	if strings.HasPrefix(key, reservedPrefix+reservedPrefix) {
+		return key[len(reservedPrefix):], true
+	}
+	if strings.HasPrefix(key, reservedPrefix) {
+		return "", false
+	}
+	return key, true
+}
+
+/*
+   Keys OlegFs derives from a key are longer than the key itself, and the
+   longest must still fit in goleg.KeySize, or a file would be created that
+   can't have metadata or grow into chunks. Directories keep theirs under
+   key + "/", and chunk keys get as long as the last chunk of the biggest
+   file at the highest generation.
+*/
+
+/* ErrNameTooLong if any key derived from key wouldn't fit */
+func (ofs *OlegFs) checkKeyLength(key string) error {
+	longest := max(len(manifestPrefix+key), len(metaPrefix+key+"/"), len(qidPrefix+key+"/"),
+		len(dirMarker+key), len(chunkKey(key, ofs.maxSize/chunkSize, math.MaxUint64)))
+	if longest > goleg.KeySize {
+		return errors.New(lib9p.ErrNameTooLong)
+	}
+	return nil
+}
+
+/*
+   Before the reserved namespace, user keys starting with reservedPrefix
+   were stored as they are. Migrate moves them (and their metadata) to
+   where dataKey expects them now, the first time a database is opened
+   writable. Those that look exactly like a reserved key can't be told
+   apart from one, and stay what they look like.
+*/
+
+const currentFormat = "1"
+
+/* Where key belongs now, if it's left from before the namespace */
+func migratedKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, reservedPrefix) || strings.HasPrefix(key, reservedPrefix+reservedPrefix) {
+		return "", false
+	}
+	// Records about a key with the prefix, and the key has moved
+	for _, prefix := range []string{metaPrefix, qidPrefix, dirMarker} {
+		if strings.HasPrefix(key, prefix) {
+			rest := key[len(prefix):]
+			if strings.HasPrefix(rest, reservedPrefix) && !strings.HasPrefix(rest, reservedPrefix+reservedPrefix) {
+				return prefix + reservedPrefix + rest, true
+			}
+			return "", false
+		}
+	}
+	for _, prefix := range []string{qidCounter, formatKey, groupsKey, manifestPrefix, chunkPrefix, generationCounter} {
+		if strings.HasPrefix(key, prefix) {
+			return "", false
+		}
+	}
+	return reservedPrefix + key, true
+}
+
+func (m MetaStore) Migrate(readOnly bool) (moved int, err error) {
+	if exists(m.db, formatKey) {
+		return 0, nil
+	}
+	keys, err := m.db.PrefixMatch(reservedPrefix)
+	if err != nil {
+		return 0, err
+	}
+	moves := make(map[string]string)
+	for _, key := range keys {
+		if target, ok := migratedKey(key); ok {
+			if exists(m.db, target) {
+				return 0, fmt.Errorf("can't move %q to %q, it's taken", key, target)
+			}
+			moves[key] = target
+		}
+	}
+	if readOnly {
+		if len(moves) > 0 {
+			return 0, fmt.Errorf("%d keys need moving, open it writable once", len(moves))
+		}
+		return 0, nil
+	}
+
+	for key, target := range moves {
+		value, err := m.db.Unjar(key)
+		if err != nil {
+			return moved, err
+		}
+		expiration, err := m.db.Expiration(key)
+		if err != nil {
+			return moved, err
+		}
+		err = m.db.Jar(target, value)
+		if err == nil && !expiration.IsZero() {
+			err = m.db.Spoil(target, expiration)
+		}
+		if err == nil {
+			err = m.db.Scoop(key)
+		}
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, m.db.Jar(formatKey, []byte(currentFormat))
+}
+
+func (m MetaStore) Load(key string) (stat lib9p.Stat, ok bool) {
+	data, err := m.db.Unjar(metaPrefix + key)
+	if err != nil {
+		return
+	}
+	ok = json.Unmarshal(data, &stat) == nil
+	return
+}
+
+func (m MetaStore) Save(key string, stat lib9p.Stat) error {
+	// Expiration always comes from the database, never from metadata
+	stat.Mode &^= lib9p.DmTmp
+	stat.Qid.Type &^= lib9p.QtTmp
+
+	data, err := json.Marshal(stat)
+	if err != nil {
+		return err
+	}
+	// Keys OlegFs didn't create keep the id they've been going by
+	if _, ok := m.loadCounter(qidPrefix + key); !ok {
+		id := strconv.FormatUint(m.hashedId(key), 10)
+		err = m.db.Jar(qidPrefix+key, []byte(id))
+		if err != nil {
+			return storeError(err)
+		}
+	}
+	return storeError(m.db.Jar(metaPrefix+key, data))
+}
+
+func (m MetaStore) Delete(key string) {
+	m.db.Scoop(metaPrefix + key)
+	// A new key with the same name must not look like the old one
+	m.db.Scoop(qidPrefix + key)
+	m.hashed.mutex.Lock()
+	delete(m.hashed.ids, key)
+	m.hashed.mutex.Unlock()
+}
+
+func (m MetaStore) PathId(key string) uint64 {
+	if id, ok := m.loadCounter(qidPrefix + key); ok {
+		return id
+	}
+	return m.hashedId(key)
+}
+
+func (m MetaStore) hashedId(key string) uint64 {
+	h := m.hashed
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if id, ok := h.ids[key]; ok {
+		return id
+	}
+	if !h.loaded {
+		for record := range m.db.Keys(qidPrefix) {
+			if id, ok := m.loadCounter(record); ok && id&hashedQid != 0 {
+				h.keys[id] = record[len(qidPrefix):]
+			}
+		}
+		h.loaded = true
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	id := hash.Sum64()
+	for {
+		id = hashedQid | id&(hashedQid-1)
+		if _, taken := h.keys[id]; !taken {
+			break
+		}
+		id++
+	}
+	h.keys[id] = key
+	h.ids[key] = id
+	return id
+}
+
+func (m MetaStore) DirPathId(key string) uint64 {
+	// Don't share ids with a file that has the same key
+	return m.PathId(key + "/")
+}
+
+/* Gives key, which is being created, an id of its own */
+func (m MetaStore) NewPathId(key string) (uint64, error) {
+	next, ok := m.loadCounter(qidCounter)
+	if !ok || next < firstKeyQid {
+		next = firstKeyQid
+	}
+	err := m.db.Jar(qidCounter, []byte(strconv.FormatUint(next+1, 10)))
+	if err == nil {
+		err = m.db.Jar(qidPrefix+key, []byte(strconv.FormatUint(next, 10)))
+	}
+	if err != nil {
+		return 0, storeError(err)
+	}
+	return next, nil
+}
+
+func (m MetaStore) loadCounter(key string) (uint64, bool) {
+	data, err := m.db.Unjar(key)
+	if err != nil {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(string(data), 10, 64)
+	return value, err == nil
+}
+
+func (m MetaStore) MarkDir(key string) error {
+	return storeError(m.db.Jar(dirMarker+key, []byte("dir")))
+}
+
+func (m MetaStore) IsMarkedDir(key string) bool {
+	return exists(m.db, dirMarker+key)
+}
+
+func (m MetaStore) UnmarkDir(key string) {
+	m.db.Scoop(dirMarker + key)
+	m.Delete(key + "/")
+}
+
+func (m MetaStore) MarkedDirs(prefix string) []string {
+	markers, _ := m.db.PrefixMatch(dirMarker + prefix)
+	keys := make([]string, len(markers))
+	for i, marker := range markers {
+		keys[i] = marker[len(dirMarker):]
+	}
+	return keys
+}
+
+/*
+   Metadata can outlive its key, for example when the key expires or gets
+   removed by something that isn't OlegFs. Collect removes all of it, given
+   a way to tell which keys and directories still exist.
+*/
+
+func (m MetaStore) Collect(isFile, isDir func(key string) bool) (removed int) {
+	// Directories have their records under their key plus a trailing slash
+	exists := func(key string) bool {
+		if strings.HasSuffix(key, "/") {
+			return isDir(strings.TrimSuffix(key, "/"))
+		}
+		return isFile(key)
+	}
+
+	for _, prefix := range []string{metaPrefix, qidPrefix} {
+		records, _ := m.db.PrefixMatch(prefix)
+		for _, record := range records {
+			if !exists(record[len(prefix):]) {
+				m.db.Scoop(record)
+				removed++
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,44 @@
+/*
+   Append-only and exclusive-use files
+
+   Files with DmAppend ignore write offsets. Fids open for writing on them
+   only buffer what was written, which gets appended to the value as it is
+   when the fid is committed, so concurrent writers don't overwrite each
+   other. Truncating on open is ignored, but wstat can still set the length.
+
+   Files with DmExcl can only be open through one fid at a time, across all
+   connections, which makes them usable as locks.
+*/
+
+package main
+
+import (
+	"./lib9p"
+)
+
+const modeBits = lib9p.DmAppend | lib9p.DmExcl
+
+/* Qid type bits matching the mode, like Plan 9 does */
+func modeQidType(mode uint32) uint8 {
+	return uint8(mode>>24) & (lib9p.QtAppend | lib9p.QtExcl)
+}
+
+func (ofs *OlegFs) inUse(path []string) bool {
+	key := pathKey(path)
+	for _, client := range ofs.clients {
+		for _, fid := range client.Fids {
+			if fid.Fs == ofs && fid.Open && pathKey(fid.Path) == key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Stored value with the pending writes of an append-only fid at the end */
+func (ofs *OlegFs) appendBuffer(pending *WriteBuffer) *WriteBuffer {
+	buffer := ofs.openBuffer(pending.Key, false)
+	data := ofs.readBuffer(pending, 0, pending.Length)
+	ofs.writeBuffer(buffer, buffer.Length, data)
+	return buffer
+}
@@ -0,0 +1,73 @@
+//go:build cgo
+// +build cgo
+
+package olegfile
+
+import (
+	"../goleg"
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+// What OlegDB writes has to read back the same through olegfile
+func TestGoleg(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Skipping in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "olegfile")
+	if err != nil {
+		t.Fatalf("Can't make a temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	database, err := goleg.Open(dir, "test", goleg.F_APPENDONLY|goleg.F_AOL_FFLUSH|goleg.F_LZ4|goleg.F_SPLAYTREE)
+	if err != nil {
+		t.Fatalf("Can't open database: %s", err.Error())
+	}
+
+	values := map[string][]byte{
+		"small":      []byte("x"),
+		"text":       []byte("value"),
+		"repetitive": bytes.Repeat([]byte("0123456789abcdef"), 4096),
+		"random":     make([]byte, 10000),
+		"empty":      {},
+	}
+	rand.Read(values["random"])
+	for key, value := range values {
+		if err := database.Jar(key, value); err != nil {
+			t.Fatalf("Can't jar %s: %s", key, err.Error())
+		}
+	}
+	database.Jar("scooped", []byte("gone"))
+	database.Scoop("scooped")
+	database.Jar("text", []byte("replaced"))
+	values["text"] = []byte("replaced")
+	expiration := time.Now().Add(time.Hour).Truncate(time.Second)
+	database.Spoil("small", expiration)
+	database.Close()
+
+	db, err := Open(dir, "test")
+	if err != nil {
+		t.Fatalf("olegfile can't open it: %s", err.Error())
+	}
+	defer db.Close()
+	if db.Len() != len(values) {
+		t.Errorf("olegfile has %v, expected %d keys", db.Keys(), len(values))
+	}
+	for key, value := range values {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("olegfile can't get %s: %s", key, err.Error())
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("olegfile has %d bytes for %s, expected %d", len(got), key, len(value))
+		}
+	}
+	if record, _ := db.Lookup("small"); !record.Expiration.Equal(expiration) {
+		t.Errorf("Expiration of small is %s, expected %s", record.Expiration, expiration)
+	}
+}
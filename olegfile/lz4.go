@@ -0,0 +1,82 @@
+/*
+   LZ4 block decompression
+
+   OlegDB compresses values with LZ4_compress_default, which makes raw
+   blocks without the frame format around them, so this is all it takes to
+   read them back.
+*/
+
+package olegfile
+
+import (
+	"errors"
+)
+
+var errCorruptLZ4 = errors.New("corrupt lz4 block")
+
+/* Decompresses an LZ4 block that's size bytes once decompressed */
+func decompressLZ4(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+
+		// Literals
+		literals, n, err := lz4Length(src[i:], int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		if i+literals > len(src) || len(dst)+literals > size {
+			return nil, errCorruptLZ4
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+
+		// The last sequence has no match
+		if i == len(src) {
+			break
+		}
+
+		// Match, copied a byte at a time since it can overlap itself
+		if i+2 > len(src) {
+			return nil, errCorruptLZ4
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, errCorruptLZ4
+		}
+		match, n, err := lz4Length(src[i:], int(token&0xf))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		match += 4
+		if len(dst)+match > size {
+			return nil, errCorruptLZ4
+		}
+		for start := len(dst) - offset; match > 0; match-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if len(dst) != size {
+		return nil, errCorruptLZ4
+	}
+	return dst, nil
+}
+
+/* Lengths of 15 go on in the following bytes, for as long as they're 255 */
+func lz4Length(src []byte, length int) (int, int, error) {
+	if length != 15 {
+		return length, 0, nil
+	}
+	for i, b := range src {
+		length += int(b)
+		if b != 255 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, errCorruptLZ4
+}
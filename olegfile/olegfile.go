@@ -0,0 +1,340 @@
+/*
+   Reading OlegDB databases without liboleg
+
+   An OlegDB database is an append-only log of commands, <name>.aol, and a
+   values file, <name>.val, that JAR commands point into. Every command is a
+   line of length-prefixed fields:
+
+     :3:JAR:<n>:<key>:<n>:<original size>:<n>:<data size>:<n>:<data offset>
+     :5:SCOOP:<n>:<key>
+     :5:SPOIL:<n>:<key>:<n>:<expiration>
+
+   Replaying them gives the database as it was last written. Logs from before
+   the values file existed kept the value in the JAR command itself, in place
+   of the three numbers, and those are read too. Expirations are in local time,
+   formatted like 2006-01-02T15:04:05Z.
+
+   Values are only read from the values file when someone asks for them. When
+   the data size differs from the original size, the value is LZ4 compressed.
+   Nothing is ever written, so it's safe to point at a live database, as long
+   as a half written command at the end of the log is expected.
+*/
+
+package olegfile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	expirationFormat = "2006-01-02T15:04:05Z"
+	maxFieldSize     = 1 << 30 // Anything bigger is a corrupt length
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrNoValues = errors.New("value is in a values file that isn't there")
+)
+
+type Record struct {
+	Key        string
+	Size       int       // Of the value, uncompressed
+	Expiration time.Time // Zero if it never expires
+	offset     int64     // In the values file
+	stored     int       // Bytes taking up in the values file
+	inline     []byte    // Value kept in the log itself
+}
+
+type Database struct {
+	Commands int       // Replayed from the log
+	Now      time.Time // Records expired by then are left out, the opening time by default
+	records  map[string]*Record
+	keys     []string // Sorted, expired ones included
+	values   io.ReaderAt
+	closer   io.Closer
+}
+
+/* Where and why replaying the log stopped */
+type ParseError struct {
+	Offset  int64 // Of the command in the log
+	Command int   // Counting from 1
+	Err     string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("command %d at offset %d: %s", e.Command, e.Offset, e.Err)
+}
+
+// Opens the database called name in dir. On a *ParseError the database that
+// was replayed up to that point comes back too, so it can still be looked at.
+func Open(dir, name string) (*Database, error) {
+	aol, err := os.Open(filepath.Join(dir, name+".aol"))
+	if err != nil {
+		return nil, err
+	}
+	defer aol.Close()
+
+	var values *os.File
+	values, err = os.Open(filepath.Join(dir, name+".val"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if values == nil {
+		return Read(aol, nil)
+	}
+
+	db, err := Read(aol, values)
+	if db == nil {
+		values.Close()
+		return nil, err
+	}
+	db.closer = values
+	return db, err
+}
+
+/* Replays a log, with values pointing into values, which can be nil */
+func Read(aol io.Reader, values io.ReaderAt) (*Database, error) {
+	db := &Database{
+		Now:     time.Now(),
+		records: make(map[string]*Record),
+		values:  values,
+	}
+
+	r := bufio.NewReader(aol)
+	var offset int64
+	var err error
+	for {
+		var fields [][]byte
+		var n int64
+		fields, n, err = readCommand(r)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err == nil {
+			err = db.replay(fields)
+		}
+		if err != nil {
+			break
+		}
+		db.Commands++
+		offset += n
+	}
+
+	db.keys = make([]string, 0, len(db.records))
+	for key := range db.records {
+		db.keys = append(db.keys, key)
+	}
+	sort.Strings(db.keys)
+
+	if err != nil {
+		return db, &ParseError{offset, db.Commands + 1, err.Error()}
+	}
+	return db, nil
+}
+
+/* Reads the fields of a command, and how many bytes it took up */
+func readCommand(r *bufio.Reader) ([][]byte, int64, error) {
+	fields := make([][]byte, 0, 6)
+	var n int64
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF && n == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.EOF {
+			return nil, n, errors.New("log ends in the middle of a command")
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		n++
+		if c == '\n' && len(fields) > 0 {
+			return fields, n, nil
+		}
+		if c != ':' {
+			return nil, n, fmt.Errorf("expected ':', got %q", c)
+		}
+
+		length, err := r.ReadString(':')
+		n += int64(len(length))
+		if err == io.EOF {
+			return nil, n, errors.New("log ends in the middle of a command")
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		size, err := strconv.Atoi(length[:len(length)-1])
+		if err != nil || size < 0 || size > maxFieldSize {
+			return nil, n, fmt.Errorf("bad field length %q", length[:len(length)-1])
+		}
+
+		field := make([]byte, size)
+		_, err = io.ReadFull(r, field)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, n, errors.New("log ends in the middle of a command")
+		}
+		if err != nil {
+			return nil, n, err
+		}
+		n += int64(size)
+		fields = append(fields, field)
+	}
+}
+
+func (db *Database) replay(fields [][]byte) error {
+	cmd := string(fields[0])
+	switch {
+	case cmd == "JAR" && len(fields) == 5:
+		record, err := valuesRecord(string(fields[1]), fields[2:])
+		if err != nil {
+			return err
+		}
+		db.records[record.Key] = record
+
+	case cmd == "JAR" && len(fields) >= 3:
+		value := fields[len(fields)-1]
+		db.records[string(fields[1])] = &Record{
+			Key:    string(fields[1]),
+			Size:   len(value),
+			inline: value,
+		}
+
+	case cmd == "SCOOP" && len(fields) == 2:
+		delete(db.records, string(fields[1]))
+
+	case cmd == "SPOIL" && len(fields) == 3:
+		record, ok := db.records[string(fields[1])]
+		if !ok {
+			return fmt.Errorf("SPOIL of missing key %q", fields[1])
+		}
+		expiration, err := time.ParseInLocation(expirationFormat, string(fields[2]), time.Local)
+		if err != nil {
+			return fmt.Errorf("bad expiration %q", fields[2])
+		}
+		record.Expiration = expiration
+
+	default:
+		return fmt.Errorf("bad command %q with %d fields", cmd, len(fields)-1)
+	}
+	return nil
+}
+
+/* A JAR pointing into the values file: original size, data size, offset */
+func valuesRecord(key string, fields [][]byte) (*Record, error) {
+	var numbers [3]int64
+	for i, field := range fields {
+		n, err := strconv.ParseInt(strings.TrimSpace(string(field)), 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad number %q in JAR of %q", field, key)
+		}
+		numbers[i] = n
+	}
+	if numbers[0] > maxFieldSize || numbers[1] > maxFieldSize {
+		return nil, fmt.Errorf("JAR of %q is too big", key)
+	}
+	return &Record{
+		Key:    key,
+		Size:   int(numbers[0]),
+		stored: int(numbers[1]),
+		offset: numbers[2],
+	}, nil
+}
+
+func (db *Database) Close() error {
+	if db.closer != nil {
+		return db.closer.Close()
+	}
+	return nil
+}
+
+func (db *Database) live(record *Record) bool {
+	return record.Expiration.IsZero() || record.Expiration.After(db.Now)
+}
+
+func (db *Database) Lookup(key string) (Record, bool) {
+	record, ok := db.records[key]
+	if !ok || !db.live(record) {
+		return Record{}, false
+	}
+	return *record, true
+}
+
+func (db *Database) Get(key string) ([]byte, error) {
+	record, ok := db.Lookup(key)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return db.Value(record)
+}
+
+/* Reads the value of a record, decompressing it if needs be */
+func (db *Database) Value(record Record) ([]byte, error) {
+	if record.inline != nil || record.Size == 0 {
+		return append([]byte{}, record.inline...), nil
+	}
+	if db.values == nil {
+		return nil, ErrNoValues
+	}
+
+	data := make([]byte, record.stored)
+	_, err := db.values.ReadAt(data, record.offset)
+	if err == io.EOF {
+		return nil, fmt.Errorf("value of %q is past the end of the values file", record.Key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if record.stored == record.Size {
+		return data, nil
+	}
+
+	value, err := decompressLZ4(data, record.Size)
+	if err != nil {
+		return nil, fmt.Errorf("value of %q: %s", record.Key, err.Error())
+	}
+	return value, nil
+}
+
+/* Number of records that haven't expired */
+func (db *Database) Len() int {
+	n := 0
+	for _, record := range db.records {
+		if db.live(record) {
+			n++
+		}
+	}
+	return n
+}
+
+/* Keys of the records that haven't expired, in order */
+func (db *Database) Keys() []string {
+	keys := make([]string, 0, len(db.keys))
+	db.Each("", func(record Record) bool {
+		keys = append(keys, record.Key)
+		return true
+	})
+	return keys
+}
+
+/* Calls fn on every record starting with prefix in key order, until it returns false */
+func (db *Database) Each(prefix string, fn func(Record) bool) {
+	for i := sort.SearchStrings(db.keys, prefix); i < len(db.keys); i++ {
+		if !strings.HasPrefix(db.keys[i], prefix) {
+			return
+		}
+		record := db.records[db.keys[i]]
+		if db.live(record) && !fn(*record) {
+			return
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package olegfile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func command(fields ...string) string {
+	var line strings.Builder
+	for _, field := range fields {
+		fmt.Fprintf(&line, ":%d:%s", len(field), field)
+	}
+	return line.String() + "\n"
+}
+
+// "abc", then 9 bytes copied from 3 back, then "XYZ"
+var (
+	compressed   = []byte{0x35, 'a', 'b', 'c', 0x03, 0x00, 0x30, 'X', 'Y', 'Z'}
+	decompressed = []byte("abcabcabcabcXYZ")
+)
+
+func testLog(t *testing.T) (string, []byte) {
+	values := append([]byte("plain"), compressed...)
+	future := time.Now().Add(time.Hour).Format(expirationFormat)
+	past := time.Now().Add(-time.Hour).Format(expirationFormat)
+
+	aol := command("JAR", "plain", "5", "5", "0") +
+		command("JAR", "lz4", "15", "10", "5") +
+		command("JAR", "inline", "application/octet-stream", "in the log") +
+		command("JAR", "scooped", "5", "5", "0") +
+		command("SCOOP", "scooped") +
+		command("JAR", "stale", "5", "5", "0") +
+		command("SPOIL", "stale", past) +
+		command("SPOIL", "plain", future)
+	return aol, values
+}
+
+func TestRead(t *testing.T) {
+	aol, values := testLog(t)
+	db, err := Read(strings.NewReader(aol), bytes.NewReader(values))
+	if err != nil {
+		t.Fatalf("Can't read log: %s", err.Error())
+	}
+	if db.Commands != 8 {
+		t.Errorf("Expected 8 commands, got %d", db.Commands)
+	}
+
+	expected := map[string][]byte{
+		"plain":  []byte("plain"),
+		"lz4":    decompressed,
+		"inline": []byte("in the log"),
+	}
+	for key, value := range expected {
+		got, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("Can't get %s: %s", key, err.Error())
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Value of %s is %q, expected %q", key, got, value)
+		}
+	}
+
+	for _, key := range []string{"scooped", "stale", "missing"} {
+		if _, err = db.Get(key); err != ErrNotFound {
+			t.Errorf("Got %s, and it shouldn't be there", key)
+		}
+	}
+
+	keys := db.Keys()
+	if strings.Join(keys, " ") != "inline lz4 plain" || db.Len() != 3 {
+		t.Errorf("Keys are %v", keys)
+	}
+	if record, _ := db.Lookup("plain"); record.Expiration.IsZero() {
+		t.Error("plain lost its expiration")
+	}
+}
+
+func TestEach(t *testing.T) {
+	aol := command("JAR", "a/1", "x") + command("JAR", "a/2", "x") +
+		command("JAR", "b/1", "x") + command("JAR", "a", "x")
+	db, err := Read(strings.NewReader(aol), nil)
+	if err != nil {
+		t.Fatalf("Can't read log: %s", err.Error())
+	}
+
+	var keys []string
+	db.Each("a/", func(record Record) bool {
+		keys = append(keys, record.Key)
+		return true
+	})
+	if strings.Join(keys, " ") != "a/1 a/2" {
+		t.Errorf("Prefix a/ gave %v", keys)
+	}
+
+	keys = nil
+	db.Each("", func(record Record) bool {
+		keys = append(keys, record.Key)
+		return len(keys) < 2
+	})
+	if len(keys) != 2 {
+		t.Errorf("Didn't stop after 2 records, got %v", keys)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	aol := command("JAR", "kept", "x") + command("JAR", "cut", "x")
+	db, err := Read(strings.NewReader(aol[:len(aol)-3]), nil)
+	parseErr, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a ParseError, got %v", err)
+	}
+	if parseErr.Command != 2 || parseErr.Offset != int64(len(command("JAR", "kept", "x"))) {
+		t.Errorf("Error in the wrong place: %s", parseErr.Error())
+	}
+	if _, err = db.Get("kept"); err != nil {
+		t.Error("Lost the commands before the truncated one")
+	}
+}
+
+func TestBadLog(t *testing.T) {
+	logs := []string{
+		"JAR\n",
+		":3:JAR:x:key\n",
+		command("FOO", "key"),
+		command("SCOOP"),
+		command("SPOIL", "missing", "2006-01-02T15:04:05Z"),
+		command("JAR", "key", "x") + command("SPOIL", "key", "tomorrow"),
+		command("JAR", "key", "5", "-1", "0"),
+	}
+	for _, aol := range logs {
+		if _, err := Read(strings.NewReader(aol), nil); err == nil {
+			t.Errorf("Read %q without an error", aol)
+		}
+	}
+}
+
+func TestBadValues(t *testing.T) {
+	aol := command("JAR", "short", "5", "5", "100") +
+		command("JAR", "corrupt", "100", "10", "0")
+	db, err := Read(strings.NewReader(aol), bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("Can't read log: %s", err.Error())
+	}
+	if _, err = db.Get("short"); err == nil {
+		t.Error("Read a value past the end of the values file")
+	}
+	if _, err = db.Get("corrupt"); err == nil {
+		t.Error("Decompressed to the wrong size")
+	}
+
+	db, _ = Read(strings.NewReader(aol), nil)
+	if _, err = db.Get("short"); err != ErrNoValues {
+		t.Errorf("Expected ErrNoValues, got %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "olegfile")
+	if err != nil {
+		t.Fatalf("Can't make a temp dir: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	aol, values := testLog(t)
+	ioutil.WriteFile(filepath.Join(dir, "test.aol"), []byte(aol), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "test.val"), values, 0644)
+
+	db, err := Open(dir, "test")
+	if err != nil {
+		t.Fatalf("Can't open database: %s", err.Error())
+	}
+	defer db.Close()
+	if value, err := db.Get("lz4"); err != nil || !bytes.Equal(value, decompressed) {
+		t.Errorf("Value of lz4 is %q, %v", value, err)
+	}
+
+	if _, err = Open(dir, "missing"); err == nil {
+		t.Error("Opened a database that isn't there")
+	}
+}
+
+// Length fields of an LZ4 sequence: the token nibble, and the bytes after it
+func lz4Lengths(length int) (int, []byte) {
+	if length < 15 {
+		return length, nil
+	}
+	var extra []byte
+	for length -= 15; length >= 255; length -= 255 {
+		extra = append(extra, 255)
+	}
+	return 15, append(extra, byte(length))
+}
+
+type lz4Sequence struct {
+	literals []byte
+	offset   int
+	match    int // 0 for the last sequence
+}
+
+func lz4Block(sequences ...lz4Sequence) (block, plain []byte) {
+	for _, seq := range sequences {
+		literals, literalBytes := lz4Lengths(len(seq.literals))
+		match, matchBytes := 0, []byte(nil)
+		if seq.match > 0 {
+			match, matchBytes = lz4Lengths(seq.match - 4)
+		}
+		block = append(block, byte(literals<<4|match))
+		block = append(block, literalBytes...)
+		block = append(block, seq.literals...)
+		plain = append(plain, seq.literals...)
+		if seq.match == 0 {
+			break
+		}
+		block = append(block, byte(seq.offset), byte(seq.offset>>8))
+		block = append(block, matchBytes...)
+		for i := 0; i < seq.match; i++ {
+			plain = append(plain, plain[len(plain)-seq.offset])
+		}
+	}
+	return
+}
+
+func TestLongLZ4(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 60)
+	tests := []struct {
+		name      string
+		sequences []lz4Sequence
+	}{
+		{"15 literals", []lz4Sequence{{long[:15], 0, 0}}},
+		{"270 literals", []lz4Sequence{{long[:270], 0, 0}}},
+		{"525 literals", []lz4Sequence{{long[:525], 0, 0}}},
+		{"match of 19", []lz4Sequence{{long[:20], 10, 19}, {[]byte("end"), 0, 0}}},
+		{"match of 274", []lz4Sequence{{long[:16], 16, 274}, {[]byte("end"), 0, 0}}},
+		{"match of 600", []lz4Sequence{{[]byte("a"), 1, 600}, {long[:300], 0, 0}}},
+		{"both long", []lz4Sequence{{long[:300], 7, 530}, {long[:15], 300, 259}, {long[:1], 0, 0}}},
+	}
+	for _, test := range tests {
+		block, plain := lz4Block(test.sequences...)
+		got, err := decompressLZ4(block, len(plain))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err.Error())
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%s: decompressed to %q, expected %q", test.name, got, plain)
+		}
+
+		// A length running off the end is corrupt, not a panic
+		for end := 0; end < len(block); end++ {
+			decompressLZ4(block[:end], len(plain))
+		}
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	aol, values := testLog(nil)
+	f.Add([]byte(aol), values)
+	f.Add([]byte(command("JAR", "key", "15", "10", "0")), compressed)
+	f.Add([]byte(command("JAR", "key", "x")+command("SPOIL", "key", "2006-01-02T15:04:05Z")), []byte{})
+	f.Fuzz(func(t *testing.T, aol, values []byte) {
+		db, _ := Read(bytes.NewReader(aol), bytes.NewReader(values))
+		if db == nil {
+			t.Fatal("Read gave no database")
+		}
+		for _, key := range db.Keys() {
+			if record, ok := db.Lookup(key); !ok || record.Key != key {
+				t.Fatalf("Lookup of %q gave %+v", key, record)
+			}
+			value, err := db.Get(key)
+			record, _ := db.Lookup(key)
+			if err == nil && len(value) != record.Size {
+				t.Fatalf("Value of %q is %d bytes, expected %d", key, len(value), record.Size)
+			}
+		}
+	})
+}
+
+func FuzzDecompressLZ4(f *testing.F) {
+	f.Add(compressed, len(decompressed))
+	block, plain := lz4Block(lz4Sequence{bytes.Repeat([]byte("ab"), 200), 2, 300}, lz4Sequence{[]byte("end"), 0, 0})
+	f.Add(block, len(plain))
+	f.Fuzz(func(t *testing.T, src []byte, size int) {
+		if size < 0 || size > 1<<20 {
+			return
+		}
+		value, err := decompressLZ4(src, size)
+		if err == nil && len(value) != size {
+			t.Fatalf("Decompressed to %d bytes, expected %d", len(value), size)
+		}
+	})
+}
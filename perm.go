@@ -0,0 +1,116 @@
+/*
+   Permissions
+
+   Every file has an owner, a group and the usual read/write/exec bits for
+   owner, group and others, kept in its metadata. Walking through a
+   directory takes exec permission on it.
+
+   Group membership comes from the synthetic "groups" file, which only adm
+   can write, one group per line:
+
+     name:member,member,...
+
+   Every user is also an implicit member of the group with its own name.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"strings"
+)
+
+/* Where the groups file is kept, out of reach of anything but the synthetic file */
+const groupsKey = reservedPrefix + "groups_"
+
+func (ofs *OlegFs) groupsRead(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+	data, _ := ofs.db.Unjar(groupsKey)
+	return sliceData(data, offset, count), nil
+}
+
+/* Writing at offset 0 starts over, later writes add to what's there */
+func (ofs *OlegFs) groupsWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	var groups []byte
+	if offset > 0 {
+		groups, _ = ofs.db.Unjar(groupsKey)
+		if offset > uint64(len(groups)) {
+			return 0, errors.New(lib9p.ErrBadOffset)
+		}
+		groups = groups[:offset]
+	}
+	err := storeError(ofs.db.Jar(groupsKey, append(groups[:len(groups):len(groups)], data...)))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(len(data)), nil
+}
+
+func (ofs *OlegFs) inGroup(uname, group string) bool {
+	if uname == group {
+		return true
+	}
+
+	data, _ := ofs.db.Unjar(groupsKey)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), ":", 2)
+		if len(fields) < 2 || fields[0] != group {
+			continue
+		}
+		for _, member := range strings.Split(fields[1], ",") {
+			if strings.TrimSpace(member) == uname {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ofs *OlegFs) allowed(uname string, stat lib9p.Stat, perm uint32) bool {
+	// Others first, so we don't have to read the groups file if we can avoid it
+	if stat.Mode&perm == perm {
+		return true
+	}
+	if stat.Uid == uname && (stat.Mode>>6)&perm == perm {
+		return true
+	}
+	if (stat.Mode>>3)&perm == perm && ofs.inGroup(uname, stat.Gid) {
+		return true
+	}
+	return false
+}
+
+func (ofs *OlegFs) checkPerm(client *Client, path []string, perm uint32) error {
+	stat, err := ofs.getMeta(path)
+	if err != nil {
+		return err
+	}
+	if !ofs.allowed(client.Uname, stat, perm) {
+		return errors.New(lib9p.ErrDenied)
+	}
+	return nil
+}
+
+func openPerm(mode uint8) (perm uint32) {
+	switch mode & 3 {
+	case lib9p.MRead:
+		perm = lib9p.DmRead
+	case lib9p.MWrite:
+		perm = lib9p.DmWrite
+	case lib9p.MRdwr:
+		perm = lib9p.DmRead | lib9p.DmWrite
+	case lib9p.MExec:
+		perm = lib9p.DmExec
+	}
+	if mode&lib9p.MTrunc != 0 {
+		perm |= lib9p.DmWrite
+	}
+	return
+}
+
+func parentPath(path []string) []string {
+	if len(path) < 1 {
+		return path
+	}
+	return path[:len(path)-1]
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"./lib9p"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	srv := makeTestServer(t)
+	ofs := testFs(srv)
+	check(t, ofs.db.Jar(groupsKey, []byte("sys:alice, bob\nempty:\n")))
+
+	tests := []struct {
+		uname string
+		mode  uint32
+		perm  uint32
+		want  bool
+	}{
+		{"alice", 0600, lib9p.DmRead, true},
+		{"alice", 0600, lib9p.DmRead | lib9p.DmWrite, true},
+		{"alice", 0400, lib9p.DmWrite, false},
+		{"bob", 0640, lib9p.DmRead, true}, // In sys
+		{"bob", 0640, lib9p.DmWrite, false},
+		{"carol", 0640, lib9p.DmRead, false},
+		{"carol", 0644, lib9p.DmRead, true},
+		{"carol", 0711, lib9p.DmExec, true},
+		{"carol", 0710, lib9p.DmExec, false},
+	}
+	for _, test := range tests {
+		stat := lib9p.Stat{Mode: test.mode, Uid: "alice", Gid: "sys"}
+		if got := ofs.allowed(test.uname, stat, test.perm); got != test.want {
+			t.Errorf("%s asking for %o on %o: got %v, expected %v", test.uname, test.perm, test.mode, got, test.want)
+		}
+	}
+}
+
+func TestInGroup(t *testing.T) {
+	srv := makeTestServer(t)
+	ofs := testFs(srv)
+	check(t, ofs.db.Jar(groupsKey, []byte("sys:alice, bob\n  adm:glenda\nbroken\nempty:\n")))
+
+	tests := []struct {
+		uname, group string
+		want         bool
+	}{
+		{"alice", "sys", true},
+		{"bob", "sys", true},
+		{"glenda", "adm", true},
+		{"glenda", "sys", false},
+		{"carol", "carol", true}, // Everyone has a group of their own
+		{"carol", "empty", false},
+		{"broken", "broken", true},
+		{"alice", "missing", false},
+	}
+	for _, test := range tests {
+		if got := ofs.inGroup(test.uname, test.group); got != test.want {
+			t.Errorf("%s in %s: got %v, expected %v", test.uname, test.group, got, test.want)
+		}
+	}
+}
+
+func TestGroupsFile(t *testing.T) {
+	srv := makeTestServer(t)
+	adm := attach(t, srv, "adm", "admin")
+	alice := attach(t, srv, "alice")
+	mallory := attach(t, srv, "mallory", "admin")
+	ofs := testFs(srv)
+
+	// Written in pieces, starting over at offset 0
+	fid, err := adm.open("groups", lib9p.MWrite)
+	check(t, err)
+	check(t, adm.write(fid, 0, []byte("sys:alice\n")))
+	check(t, adm.write(fid, 10, []byte("adm:adm\n")))
+	check(t, adm.clunk(fid))
+	checkFile(t, alice, "groups", "sys:alice\nadm:adm\n")
+	if !ofs.inGroup("alice", "sys") {
+		t.Fatal("alice isn't in sys")
+	}
+	check(t, adm.writeFile("groups", []byte("sys:\n")))
+	checkFile(t, alice, "groups", "sys:\n")
+
+	// Only adm writes it, whatever the policy
+	checkErr(t, mallory.writeFile("groups", []byte("adm:mallory\n")), lib9p.ErrDenied)
+	checkErr(t, alice.writeFile("groups", []byte("adm:alice\n")), lib9p.ErrDenied)
+
+	// A key that happens to be called adm/groups gives nobody anything
+	check(t, mallory.mkdir("adm", 0777))
+	check(t, mallory.createFile("adm/groups", 0666, []byte("adm:mallory\n")))
+	if ofs.inGroup("mallory", "adm") {
+		t.Fatal("adm/groups made mallory a member of adm")
+	}
+	checkErr(t, mallory.writeFile("ctl", []byte("gc\n")), lib9p.ErrDenied)
+}
+
+func TestWalkExec(t *testing.T) {
+	srv := makeTestServer(t)
+	adm := attach(t, srv, "adm", "admin")
+	alice := attach(t, srv, "alice")
+	bob := attach(t, srv, "bob")
+	carol := attach(t, srv, "carol")
+	check(t, adm.writeFile("groups", []byte("friends:bob\n")))
+
+	check(t, alice.mkdir("home", 0750))
+	check(t, alice.createFile("home/notes", 0666, []byte("nothing to see")))
+	fid, _, err := alice.walk("home")
+	check(t, err)
+	wstat := lib9p.Stat{Mode: ^uint32(0), Gid: "friends", Atime: ^uint32(0), Mtime: ^uint32(0), Length: ^uint64(0)}
+	checkErr(t, srv.Wstat(alice.con, lib9p.WstatRequest{Fid: fid, Stat: wstat}), lib9p.ErrDenied)
+	check(t, adm.writeFile("groups", []byte("friends:alice,bob\n")))
+	check(t, srv.Wstat(alice.con, lib9p.WstatRequest{Fid: fid, Stat: wstat}))
+
+	checkFile(t, alice, "home/notes", "nothing to see")
+	_, err = bob.stat("home/notes")
+	check(t, err)
+
+	// The directory itself is there to see, but nothing in it
+	_, _, err = carol.walk("home")
+	check(t, err)
+	out, err := srv.Walk(carol.con, lib9p.WalkRequest{Fid: rootFid, NewFid: 100, Paths: []string{"home", "notes"}})
+	check(t, err)
+	if len(out.Qids) != 1 {
+		t.Fatalf("Walked %d of 2 names, expected to stop at the directory", len(out.Qids))
+	}
+	_, _, err = carol.walk("home/notes")
+	checkErr(t, err, lib9p.ErrNotFound) // The walk helper's word for a partial walk
+	_, err = carol.stat("home/notes")
+	checkErr(t, err, lib9p.ErrNotFound)
+
+	// Walking straight from the directory fails outright
+	fid, _, err = carol.walk("home")
+	check(t, err)
+	_, err = srv.Walk(carol.con, lib9p.WalkRequest{Fid: fid, NewFid: 101, Paths: []string{"notes"}})
+	checkErr(t, err, lib9p.ErrDenied)
+}
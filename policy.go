@@ -0,0 +1,93 @@
+/*
+   Access policies
+
+   The attach name picks a set of capabilities that apply on top of file
+   permissions (see parseAname), so a client attaching to "ro" can't change
+   anything no matter what the permissions say. The "policy" setting adds
+   more. A read-only server takes away every capability except reading from
+   everyone, and its stores refuse writes on top of that.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Capability uint8
+
+const (
+	CapRead   Capability = 1 << iota // Open files for reading
+	CapWrite                         // Create, write, remove and wstat files
+	CapCtl                           // Write to ctl
+	CapExpire                        // Set expiration times
+	CapAll    = CapRead | CapWrite | CapCtl | CapExpire
+)
+
+var capNames = []string{"read", "write", "ctl", "expire"} // By bit
+
+/* Comma separated capability names, "all" or "none" */
+func parseCaps(value string) (caps Capability, err error) {
+	switch value {
+	case "all":
+		return CapAll, nil
+	case "none":
+		return 0, nil
+	}
+	for _, name := range strings.Split(value, ",") {
+		found := false
+		for bit, capName := range capNames {
+			if name == capName {
+				caps |= 1 << bit
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown capability %q, there's %s, all and none", name, strings.Join(capNames, ", "))
+		}
+	}
+	return caps, nil
+}
+
+func defaultPolicies() map[string]Capability {
+	return map[string]Capability{
+		"":      CapRead | CapWrite | CapExpire,
+		"ro":    CapRead,
+		"admin": CapAll,
+	}
+}
+
+func (srv *Server) policyCaps(policy string) (Capability, error) {
+	caps, ok := srv.policies[policy]
+	if !ok {
+		return 0, errors.New(lib9p.ErrDenied)
+	}
+	if srv.readOnly {
+		caps &= CapRead
+	}
+	return caps, nil
+}
+
+func (ofs *OlegFs) checkCap(client *Client, caps Capability) error {
+	if client.Caps&caps != caps {
+		return errors.New(lib9p.ErrDenied)
+	}
+	return nil
+}
+
+func (ofs *OlegFs) openCaps(path []string, mode uint8) (caps Capability) {
+	if mode&3 != lib9p.MWrite {
+		caps |= CapRead
+	}
+	if isWriteMode(mode) {
+		if synth := ofs.getSynth(path); synth != nil {
+			caps |= synth.WriteCap
+		} else {
+			caps |= CapWrite
+		}
+	}
+	return
+}
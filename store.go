@@ -0,0 +1,157 @@
+/*
+   Storage backends
+
+   OlegFs only ever talks to its database through Store, so it doesn't care
+   what's behind it. A Backend knows how to open stores by name in the data
+   directory and which ones are there. Backends register themselves in
+   backends from init, so the ones needing cgo can be left out of the build.
+*/
+
+package main
+
+import (
+	"./goleg"
+	"./lib9p"
+	"errors"
+	"fmt"
+	"iter"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Errors are goleg's: missing keys are goleg.ErrNotFound and keys over
+// goleg.KeySize are goleg.ErrKeyTooLong, wrapped in a *goleg.Error
+type Store interface {
+	Jar(key string, value []byte) error
+	Unjar(key string) ([]byte, error)
+	Scoop(key string) error
+	Exists(key string) (bool, error)
+	GetSize(key string) (int, error) // Length of the value
+	PrefixMatch(prefix string) ([]string, error)
+	DumpKeys() ([]string, error)
+	Spoil(key string, expiration time.Time) error // The zero time clears it
+	Expiration(key string) (time.Time, error)     // Zero if the key never expires
+	Cas(key string, old, value []byte) (bool, error)
+
+	/* Cursors, in key order, goleg.ErrEnd past the ends */
+	First() (string, []byte, error)
+	Last() (string, []byte, error)
+	Next(key string) (string, []byte, error) // key must exist
+	Prev(key string) (string, []byte, error) // key must exist
+
+	/* Scans from start to just before end, empty for no end */
+	Range(start, end string) iter.Seq2[goleg.Record, error]
+	RangeKeys(start, end string) iter.Seq[string]
+	Keys(prefix string) iter.Seq[string]
+	KeysBefore(end string) iter.Seq[string] // Backwards, from the last key if end is empty
+
+	Squish() error
+	Uptime() int
+	Records() int
+	Close() error
+}
+
+type Backend struct {
+	Open func(dir, name string, features int) (Store, error)
+	List func(dir string) []string // Names of the stores in dir
+
+	Features        []Feature
+	DefaultFeatures int
+	Check           func(features int) error // nil if anything goes
+}
+
+type Feature struct {
+	Name string
+	Flag int
+}
+
+var backends = make(map[string]Backend)
+
+/*
+   A read-only server hands its databases out wrapped in readOnlyStore, so
+   anything that would write gets refused by the store itself, whichever
+   path it comes from.
+*/
+
+var errReadOnly = errors.New("read-only server")
+
+type readOnlyStore struct {
+	Store
+}
+
+func (readOnlyStore) Jar(key string, value []byte) error              { return errReadOnly }
+func (readOnlyStore) Scoop(key string) error                          { return errReadOnly }
+func (readOnlyStore) Spoil(key string, expiration time.Time) error    { return errReadOnly }
+func (readOnlyStore) Cas(key string, old, value []byte) (bool, error) { return false, errReadOnly }
+func (readOnlyStore) Squish() error                                   { return errReadOnly }
+
+/* Turns store errors into the ones 9P clients get, logging the unexpected ones */
+func storeError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, goleg.ErrNotFound):
+		return errors.New(lib9p.ErrNotFound)
+	case errors.Is(err, goleg.ErrKeyTooLong):
+		return errors.New(lib9p.ErrNameTooLong)
+	case errors.Is(err, errReadOnly):
+		return errors.New(lib9p.ErrDenied)
+	}
+	logf(LogError, "%s", err.Error())
+	return errors.New(lib9p.ErrIO)
+}
+
+/* For when an error is as good as the key not being there */
+func exists(db Store, key string) bool {
+	ok, err := db.Exists(key)
+	return ok && err == nil
+}
+
+/* Same, for keys that expire */
+func expiresAt(db Store, key string) (time.Time, bool) {
+	expiration, err := db.Expiration(key)
+	return expiration, err == nil && !expiration.IsZero()
+}
+
+func backendNames() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (b Backend) featureNames(features int) []string {
+	names := make([]string, 0)
+	for _, feature := range b.Features {
+		if features&feature.Flag != 0 {
+			names = append(names, feature.Name)
+		}
+	}
+	return names
+}
+
+func (b Backend) parseFeatures(value string) (features int, err error) {
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "none" {
+			continue
+		}
+		found := false
+		for _, feature := range b.Features {
+			if feature.Name == name {
+				features |= feature.Flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("features: unknown feature %q", name)
+		}
+	}
+	if b.Check != nil {
+		err = b.Check(features)
+	}
+	return
+}
@@ -0,0 +1,61 @@
+//go:build cgo
+// +build cgo
+
+/*
+   OlegDB backend, through goleg
+*/
+
+package main
+
+import (
+	"./goleg"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var _ Store = goleg.Database{}
+
+func init() {
+	backends["oleg"] = Backend{
+		Open: openGoleg,
+		List: listGoleg,
+		Features: []Feature{
+			{"appendonly", goleg.F_APPENDONLY},
+			{"lz4", goleg.F_LZ4},
+			{"splaytree", goleg.F_SPLAYTREE},
+			{"aol_fflush", goleg.F_AOL_FFLUSH},
+		},
+		DefaultFeatures: goleg.F_APPENDONLY | goleg.F_LZ4 | goleg.F_SPLAYTREE | goleg.F_AOL_FFLUSH,
+		Check:           checkGoleg,
+	}
+}
+
+func openGoleg(dir, name string, features int) (Store, error) {
+	database, err := goleg.Open(dir, name, features)
+	if err != nil {
+		return nil, err
+	}
+	return database, nil
+}
+
+func checkGoleg(features int) error {
+	if features&goleg.F_AOL_FFLUSH != 0 && features&goleg.F_APPENDONLY == 0 {
+		return errors.New("aol_fflush needs appendonly")
+	}
+	return nil
+}
+
+/* Databases are files named after them, with an .aol or .dump extension */
+func listGoleg(dir string) []string {
+	names := make([]string, 0)
+	files, _ := ioutil.ReadDir(dir)
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if ext == ".aol" || ext == ".dump" {
+			names = append(names, strings.TrimSuffix(file.Name(), ext))
+		}
+	}
+	return names
+}
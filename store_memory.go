@@ -0,0 +1,58 @@
+/*
+   In-memory backend
+
+   Nothing touches the disk and nothing survives a restart, but it needs no
+   liboleg, so it's there for tests and builds without cgo. Databases stay
+   around when they're closed for being idle, so reopening them finds the
+   same keys.
+*/
+
+package main
+
+import (
+	"./goleg"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var _ Store = (*goleg.MemDatabase)(nil)
+
+var memoryStores = struct {
+	dbs   map[string]*goleg.MemDatabase // By directory and name
+	mutex sync.Mutex
+}{dbs: make(map[string]*goleg.MemDatabase)}
+
+func init() {
+	backends["memory"] = Backend{
+		Open: openMemory,
+		List: listMemory,
+	}
+}
+
+func openMemory(dir, name string, features int) (Store, error) {
+	memoryStores.mutex.Lock()
+	defer memoryStores.mutex.Unlock()
+
+	path := filepath.Join(dir, name)
+	database, ok := memoryStores.dbs[path]
+	if !ok {
+		database = goleg.OpenMemory()
+		memoryStores.dbs[path] = database
+	}
+	return database, nil
+}
+
+func listMemory(dir string) []string {
+	memoryStores.mutex.Lock()
+	defer memoryStores.mutex.Unlock()
+
+	names := make([]string, 0)
+	for path := range memoryStores.dbs {
+		if filepath.Dir(path) == filepath.Clean(dir) {
+			names = append(names, filepath.Base(path))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
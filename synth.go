@@ -0,0 +1,57 @@
+/*
+   Synthetic files
+
+   These live in the root directory and don't map to any key, their contents
+   are generated (or their writes handled) by the server itself.
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"time"
+)
+
+type SynthFile struct {
+	PathId   uint64
+	Mode     uint32
+	Uid      string
+	Gid      string
+	WriteCap Capability // Needed on top of permissions to write
+	Open     func(client *Client, fid *FidData) error
+	Read     func(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error)
+	Write    func(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error)
+}
+
+func (ofs *OlegFs) getSynth(path []string) *SynthFile {
+	if len(path) < 1 {
+		return nil
+	}
+	if synth, ok := ofs.synth[path[0]]; ok && len(path) == 1 {
+		return synth
+	}
+	return ofs.expiresFile(path)
+}
+
+func synthQid(synth *SynthFile) lib9p.Qid {
+	return lib9p.Qid{
+		Type:    lib9p.QtFile,
+		Version: 1,
+		PathId:  synth.PathId,
+	}
+}
+
+func synthMeta(name string, synth *SynthFile) lib9p.Stat {
+	now := time.Now().Unix()
+	return lib9p.Stat{
+		Qid:    synthQid(synth),
+		Mode:   synth.Mode,
+		Atime:  uint32(now),
+		Mtime:  0,
+		Length: 0,
+		Name:   name,
+		Uid:    synth.Uid,
+		Gid:    synth.Gid,
+		Muid:   "none",
+	}
+}
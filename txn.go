@@ -0,0 +1,350 @@
+/*
+   Transactions
+
+   Every fid open on "txn" has a private transaction. Writing to it queues
+   operations, one per line:
+
+     put <key> <length>\n<value>\n      sets a key
+     delete <key>\n                      removes a key
+     expect <key> <length>\n<value>\n   fails unless the key has that value
+     absent <key>\n                      fails unless the key doesn't exist
+     commit\n                            applies everything queued so far
+     abort\n                             drops everything queued so far
+
+   Clunking the fid commits whatever is still queued, losing the connection
+   drops it. Every operation is checked, expectations and permissions
+   included, against the state the operations before it leave behind, and
+   nothing is applied unless they all hold. As every change goes through
+   the fs mutex, nobody sees a transaction half done.
+
+   Reading the fid returns the outcome of the last commit or abort: "ok",
+   "aborted" or "failed: <reason>".
+*/
+
+package main
+
+import (
+	"./lib9p"
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+type TxnOp struct {
+	Op    string // put, delete, expect or absent
+	Path  []string
+	Key   string
+	Value []byte
+}
+
+type Txn struct {
+	Ops    []TxnOp
+	Result []byte
+}
+
+func (ofs *OlegFs) txnOpen(client *Client, fid *FidData) error {
+	fid.Txn = new(Txn)
+	return nil
+}
+
+func (ofs *OlegFs) txnRead(client *Client, fid *FidData, offset uint64, count uint32) ([]byte, error) {
+	return sliceData(fid.Txn.Result, offset, count), nil
+}
+
+func (ofs *OlegFs) txnWrite(client *Client, fid *FidData, offset uint64, data []byte) (uint32, error) {
+	txn := fid.Txn
+
+	// Values can span several writes, keep what we can't use yet around
+	fid.Pending = append(fid.Pending, data...)
+	for {
+		op, n, err := parseTxnOp(fid.Pending)
+		if err != nil {
+			// Can't tell where the next operation starts, give up on all of it
+			fid.Pending = nil
+			txn.Ops = nil
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		fid.Pending = fid.Pending[n:]
+
+		switch op.Op {
+		case "commit":
+			err = ofs.commitTxn(client, txn)
+			if err != nil {
+				txn.Result = []byte("failed: " + err.Error() + "\n")
+			} else {
+				txn.Result = []byte("ok\n")
+			}
+		case "abort":
+			txn.Ops = nil
+			txn.Result = []byte("aborted\n")
+		default:
+			txn.Ops = append(txn.Ops, op)
+		}
+	}
+	return uint32(len(data)), nil
+}
+
+/* Parses the first operation in data, n is 0 if it's incomplete */
+func parseTxnOp(data []byte) (op TxnOp, n int, err error) {
+	nl := bytes.IndexByte(data, '\n')
+	if nl < 0 {
+		return
+	}
+	op.Op = string(data[:nl])
+	name := ""
+	if i := strings.Index(op.Op, " "); i >= 0 {
+		op.Op, name = op.Op[:i], op.Op[i+1:]
+	}
+
+	switch op.Op {
+	case "put", "expect":
+		i := strings.LastIndex(name, " ")
+		if i < 0 {
+			return op, 0, errors.New(ErrBadCtl)
+		}
+		size, err := strconv.Atoi(name[i+1:])
+		if err != nil || size < 0 {
+			return op, 0, errors.New(ErrBadCtl)
+		}
+		name = name[:i]
+
+		// The value is followed by a newline, so the next operation starts on its own line
+		end := nl + 1 + size
+		if len(data) < end+1 {
+			return op, 0, nil
+		}
+		if data[end] != '\n' {
+			return op, 0, errors.New(ErrBadCtl)
+		}
+		op.Value = append([]byte{}, data[nl+1:end]...)
+		n = end + 1
+	case "delete", "absent":
+		n = nl + 1
+	case "commit", "abort":
+		if name != "" {
+			return op, 0, errors.New(ErrBadCtl)
+		}
+		return op, nl + 1, nil
+	default:
+		return op, 0, errors.New(ErrBadCtl)
+	}
+
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return op, 0, errors.New(ErrBadCtl)
+	}
+	op.Path = strings.Split(name, "/")
+	op.Key = pathKey(op.Path)
+	return
+}
+
+/* What the operations checked so far would do, without doing it */
+type txnOverlay struct {
+	ofs     *OlegFs
+	values  map[string][]byte // Put so far
+	created map[string]bool   // Put, and not there before
+	deleted map[string]bool
+}
+
+func (o *txnOverlay) exists(key string) bool {
+	if o.deleted[key] {
+		return false
+	}
+	if _, ok := o.values[key]; ok {
+		return true
+	}
+	return exists(o.ofs.db, key)
+}
+
+/* Only for keys that exist */
+func (o *txnOverlay) value(key string) ([]byte, error) {
+	if value, ok := o.values[key]; ok {
+		return value, nil
+	}
+	return o.ofs.readValue(key)
+}
+
+func (o *txnOverlay) isDir(key string) bool {
+	for put := range o.values {
+		if strings.HasPrefix(put, key+"/") {
+			return true
+		}
+	}
+	if o.ofs.meta.IsMarkedDir(key) {
+		return true
+	}
+	for child := range o.ofs.db.Keys(key + "/") {
+		if !o.deleted[child] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *txnOverlay) put(key string, value []byte) {
+	if !o.exists(key) {
+		o.created[key] = true
+	}
+	o.values[key] = value
+	delete(o.deleted, key)
+}
+
+func (o *txnOverlay) remove(key string) {
+	delete(o.values, key)
+	delete(o.created, key)
+	o.deleted[key] = true
+}
+
+func (ofs *OlegFs) commitTxn(client *Client, txn *Txn) error {
+	ops := txn.Ops
+	txn.Ops = nil
+
+	// Check everything, in order, before touching anything
+	overlay := &txnOverlay{
+		ofs:     ofs,
+		values:  make(map[string][]byte),
+		created: make(map[string]bool),
+		deleted: make(map[string]bool),
+	}
+	for _, op := range ops {
+		err := ofs.checkTxnOp(client, overlay, op)
+		if err != nil {
+			return err
+		}
+		switch op.Op {
+		case "put":
+			overlay.put(op.Key, op.Value)
+		case "delete":
+			overlay.remove(op.Key)
+		}
+	}
+
+	for _, op := range ops {
+		var err error
+		switch op.Op {
+		case "put":
+			err = ofs.txnPut(client, op)
+		case "delete":
+			err = ofs.removeKey(op.Key)
+		}
+		if err != nil {
+			// The checks held, so the database failed, and what's applied stays applied
+			return err
+		}
+	}
+	return nil
+}
+
+/* Keys the transaction creates belong to the client already, so they skip permission checks */
+func (ofs *OlegFs) checkTxnOp(client *Client, overlay *txnOverlay, op TxnOp) error {
+	name := strings.Join(op.Path, "/")
+	created := overlay.created[op.Key]
+	switch op.Op {
+	case "expect":
+		if !created {
+			err := ofs.checkPerm(client, op.Path, lib9p.DmRead)
+			if err != nil {
+				return err
+			}
+		}
+		if !overlay.exists(op.Key) {
+			return errors.New("value mismatch on " + name)
+		}
+		value, err := overlay.value(op.Key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(value, op.Value) {
+			return errors.New("value mismatch on " + name)
+		}
+	case "absent":
+		if overlay.exists(op.Key) {
+			return errors.New(lib9p.ErrExists + ": " + name)
+		}
+	case "put":
+		err := ofs.checkCap(client, CapWrite)
+		if err != nil {
+			return err
+		}
+		if ofs.getSynth(op.Path) != nil {
+			return errors.New(lib9p.ErrDenied)
+		}
+		if ofs.checkKeyLength(op.Key) != nil {
+			return errors.New(lib9p.ErrNameTooLong + ": " + name)
+		}
+		for i := 1; i < len(op.Path); i++ {
+			if overlay.exists(pathKey(op.Path[:i])) {
+				return errors.New(lib9p.ErrNotDirectory + ": " + strings.Join(op.Path[:i], "/"))
+			}
+		}
+		if created {
+			return nil
+		}
+		if overlay.exists(op.Key) {
+			return ofs.checkPerm(client, op.Path, lib9p.DmWrite)
+		}
+		if overlay.isDir(op.Key) {
+			return errors.New(lib9p.ErrIsDirectory)
+		}
+		return ofs.checkPerm(client, ofs.existingParent(op.Path), lib9p.DmWrite)
+	case "delete":
+		err := ofs.checkCap(client, CapWrite)
+		if err != nil {
+			return err
+		}
+		if !overlay.exists(op.Key) {
+			return errors.New(lib9p.ErrNotFound + ": " + name)
+		}
+		if created {
+			return nil
+		}
+		return ofs.checkPerm(client, parentPath(op.Path), lib9p.DmWrite)
+	}
+	return nil
+}
+
+func (ofs *OlegFs) txnPut(client *Client, op TxnOp) error {
+	existed := exists(ofs.db, op.Key)
+	if !existed {
+		_, err := ofs.meta.NewPathId(op.Key)
+		if err != nil {
+			return err
+		}
+	}
+	buffer := ofs.openBuffer(op.Key, true)
+	ofs.writeBuffer(buffer, 0, op.Value)
+	err := ofs.commit(client, &FidData{Path: op.Path, Buffer: buffer, Dirty: true})
+	if err != nil || existed {
+		return err
+	}
+
+	// New keys are owned like they were created
+	stat, err := ofs.getMeta(op.Path)
+	if err != nil {
+		return err
+	}
+	dir, err := ofs.getMeta(ofs.existingParent(op.Path))
+	if err != nil {
+		return err
+	}
+	stat.Mode = stat.Mode&^0777 | dir.Mode&0666
+	stat.Uid = client.Uname
+	stat.Gid = dir.Gid
+	return ofs.meta.Save(op.Key, stat)
+}
+
+/* Closest directory above path that exists, keys can create the rest */
+func (ofs *OlegFs) existingParent(path []string) []string {
+	parent := parentPath(path)
+	for len(parent) > 0 {
+		if _, err := ofs.getMeta(parent); err == nil {
+			break
+		}
+		parent = parentPath(parent)
+	}
+	return parent
+}